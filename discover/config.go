@@ -2,6 +2,7 @@ package discover
 
 type EtcdConf struct {
 	Hosts []string
-	User  string
-	Pass  string
+	// User and Pass are the optional account, see SetAccount.
+	User string
+	Pass string
 }
@@ -2,8 +2,8 @@ package discover
 
 import (
 	"fmt"
+	"gamerouter/logx"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"log"
 	"time"
 )
 
@@ -77,7 +77,8 @@ func (p *Publisher) keepAliveAsync(cli *clientv3.Client) error {
 					p.revoke(cli)
 					// 重新注册
 					if err := p.doKeepAlive(); err != nil {
-						log.Printf("etcd publisher KeepAlive: %s", err.Error())
+						logger.Error("etcd publisher failed to keep alive",
+							logx.F("key", p.key), logx.Err(err))
 					}
 					return
 				}
@@ -101,12 +102,14 @@ func (p *Publisher) doKeepAlive() error {
 		default:
 			cli, err := p.doRegister()
 			if err != nil {
-				log.Printf("etcd publisher doRegister: %s", err.Error())
+				hotLogger.Warn("etcd publisher failed to register",
+					logx.F("key", p.key), logx.Err(err))
 				break
 			}
 
 			if err := p.keepAliveAsync(cli); err != nil {
-				log.Printf("etcd publisher keepAliveAsync: %s", err.Error())
+				hotLogger.Warn("etcd publisher failed to keep alive",
+					logx.F("key", p.key), logx.Err(err))
 				break
 			}
 			return nil
@@ -118,7 +121,8 @@ func (p *Publisher) doKeepAlive() error {
 
 func (p *Publisher) revoke(cli *clientv3.Client) {
 	if _, err := cli.Revoke(cli.Ctx(), p.lease); err != nil {
-		log.Printf("etcd publisher revoke error: %s", err.Error())
+		logger.Warn("etcd publisher failed to revoke the lease",
+			logx.F("key", p.key), logx.Err(err))
 	}
 }
 
@@ -4,15 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"gamerouter/logx"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"log"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	logger = logx.Named("discover")
+	// for the loops retrying every second while etcd is unreachable
+	hotLogger = logx.RateLimited(logger, 10*time.Second)
+)
+
 const (
 	EtcdPathDelimiter = '/'
 
@@ -24,6 +30,7 @@ const (
 var (
 	manager = RegistryManager{
 		registries: make(map[string]*Registry),
+		accounts:   make(map[string]EtcdConf),
 	}
 )
 
@@ -33,25 +40,47 @@ const (
 
 type RegistryManager struct {
 	registries map[string]*Registry
-	lock       sync.Mutex
+	// the accounts by endpoints key, see SetAccount
+	accounts map[string]EtcdConf
+	lock     sync.Mutex
 }
 
+// GetRegistry returns the registry of endpoints, nil if its etcd client
+// cannot be created.
 func GetRegistry(endpoints []string) *Registry {
+	registry, _ := OpenRegistry(endpoints)
+	return registry
+}
+
+// OpenRegistry returns the registry of endpoints, or why its etcd client
+// cannot be created. A registry which failed to be created is tried again.
+func OpenRegistry(endpoints []string) (*Registry, error) {
 	key := getKey(endpoints)
-	registry, ok := manager.registries[key]
-	if ok {
-		return registry
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if registry, ok := manager.registries[key]; ok {
+		return registry, nil
 	}
+	registry, err := newRegistry(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	manager.registries[key] = registry
+	return registry, nil
+}
+
+// SetAccount sets the account the registry of conf.Hosts authenticates
+// with. Call it before the first GetRegistry of these hosts, e.g. before
+// dialling or serving.
+func SetAccount(conf EtcdConf) {
+	key := getKey(append([]string(nil), conf.Hosts...))
 	manager.lock.Lock()
 	defer manager.lock.Unlock()
-	if _, ok = manager.registries[key]; !ok {
-		var err error
-		manager.registries[key], err = newRegistry(endpoints)
-		if err == nil {
-			return manager.registries[key]
-		}
+	if _, ok := manager.registries[key]; ok {
+		logger.Warn("etcd account set after the registry was created",
+			logx.F("endpoints", key))
 	}
-	return manager.registries[key]
+	manager.accounts[key] = conf
 }
 
 func getKey(endpoints []string) string {
@@ -62,7 +91,9 @@ func getKey(endpoints []string) string {
 type Registry struct {
 	client     *clientv3.Client
 	values     map[string]map[string]string // prefix->key->value
+	revisions  map[string]int64             // prefix->last revision seen
 	listeners  map[string][]UpdateListener
+	stops      map[string]chan struct{} // prefix->closed by Unmonitor
 	watchGroup sync.WaitGroup
 	done       chan struct{}
 	lock       sync.RWMutex
@@ -76,7 +107,10 @@ func newRegistry(endpoints []string) (*Registry, error) {
 		RejectOldCluster:    true,
 		PermitWithoutStream: true,
 	}
-	// todo: account?
+	if account, ok := manager.accounts[getKey(endpoints)]; ok {
+		cfg.Username = account.User
+		cfg.Password = account.Pass
+	}
 	cli, err := clientv3.New(cfg)
 	if err != nil {
 		return nil, err
@@ -84,7 +118,9 @@ func newRegistry(endpoints []string) (*Registry, error) {
 	return &Registry{
 		client:    cli,
 		values:    make(map[string]map[string]string),
+		revisions: make(map[string]int64),
 		listeners: make(map[string][]UpdateListener),
+		stops:     make(map[string]chan struct{}),
 		done:      make(chan struct{}),
 	}, nil
 }
@@ -93,10 +129,22 @@ func (r *Registry) GetConn() *clientv3.Client {
 	return r.client
 }
 
+// Monitor notifies l of the values under key, starting with the current
+// ones. The prefix is watched once, however many listeners it has.
 func (r *Registry) Monitor(
 	key string,
 	l UpdateListener,
 ) {
+	r.MonitorUntil(key, l, nil)
+}
+
+// MonitorUntil is Monitor giving up loading the values of key once done is
+// closed, l is then not monitored and false is returned.
+func (r *Registry) MonitorUntil(
+	key string,
+	l UpdateListener,
+	done <-chan struct{},
+) bool {
 	kvs := r.getCurrent(key)
 	for _, kv := range kvs {
 		l.OnAdd(kv)
@@ -104,16 +152,63 @@ func (r *Registry) Monitor(
 
 	r.lock.Lock()
 	r.listeners[key] = append(r.listeners[key], l)
+	stop, watching := r.stops[key]
+	if !watching {
+		stop = make(chan struct{})
+		r.stops[key] = stop
+	}
 	r.lock.Unlock()
 
-	rev := r.load(key)
+	rev, ok := r.load(key, done)
+	if !ok {
+		r.Unmonitor(key, l)
+		if !watching {
+			// the listeners which joined meanwhile still wait for the values,
+			// stop is closed if there are none
+			go func() {
+				if rev, ok := r.load(key, stop); ok {
+					r.watch(key, rev, stop)
+				}
+			}()
+		}
+		return false
+	}
+	if !watching {
+		go func() {
+			r.watch(key, rev, stop)
+		}()
+	}
+	return true
+}
 
-	go func() {
-		r.watch(key, rev)
-	}()
+// Unmonitor stops notifying l, the watch of key stops with its last
+// listener.
+func (r *Registry) Unmonitor(key string, l UpdateListener) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	listeners := r.listeners[key]
+	for i, listener := range listeners {
+		if listener == l {
+			listeners = append(listeners[:i:i], listeners[i+1:]...)
+			break
+		}
+	}
+	if len(listeners) > 0 {
+		r.listeners[key] = listeners
+		return
+	}
+	if stop, ok := r.stops[key]; ok {
+		close(stop)
+	}
+	delete(r.listeners, key)
+	delete(r.stops, key)
+	delete(r.values, key)
+	delete(r.revisions, key)
 }
 
-func (r *Registry) load(prefix string) int64 {
+// load notifies the listeners of prefix of its values, retrying until done
+// is closed, in which case it returns false.
+func (r *Registry) load(prefix string, done <-chan struct{}) (int64, bool) {
 	var resp *clientv3.GetResponse
 	for {
 		var err error
@@ -124,8 +219,14 @@ func (r *Registry) load(prefix string) int64 {
 		if err == nil {
 			break
 		}
-		log.Printf("%s, prefix is %s", err.Error(), prefix)
-		time.Sleep(time.Second)
+		hotLogger.Warn("etcd registry failed to load", logx.Prefix(prefix),
+			logx.Err(err))
+		r.notifyError(prefix, err)
+		select {
+		case <-done:
+			return 0, false
+		case <-time.After(time.Second):
+		}
 	}
 	var kvs []KV
 	for _, ev := range resp.Kvs {
@@ -136,8 +237,22 @@ func (r *Registry) load(prefix string) int64 {
 	}
 
 	r.handleChanges(prefix, kvs)
+	r.lock.Lock()
+	r.revisions[prefix] = resp.Header.Revision
+	r.lock.Unlock()
+
+	return resp.Header.Revision, true
+}
 
-	return resp.Header.Revision
+func (r *Registry) notifyError(prefix string, err error) {
+	r.lock.RLock()
+	listeners := append([]UpdateListener(nil), r.listeners[prefix]...)
+	r.lock.RUnlock()
+	for _, l := range listeners {
+		if el, ok := l.(ErrorListener); ok {
+			el.OnError(err)
+		}
+	}
 }
 
 func (r *Registry) handleChanges(key string, kvs []KV) {
@@ -191,23 +306,27 @@ func (r *Registry) handleChanges(key string, kvs []KV) {
 	}
 }
 
-func (r *Registry) watch(key string, rev int64) {
+func (r *Registry) watch(key string, rev int64, stop <-chan struct{}) {
 	for {
-		err := r.watchStream(key, rev)
+		err := r.watchStream(key, rev, stop)
 		if err == nil {
 			return
 		}
 
 		if rev != 0 && errors.Is(err, rpctypes.ErrCompacted) {
-			log.Printf("etcd compacted, try to reload, rev %d", rev)
-			rev = r.load(key)
+			logger.Info("etcd compacted, reloading", logx.Prefix(key),
+				logx.F("rev", rev))
+			var ok bool
+			if rev, ok = r.load(key, stop); !ok {
+				return
+			}
 		}
 
-		log.Printf(err.Error())
+		hotLogger.Warn("etcd watch failed", logx.Prefix(key), logx.Err(err))
 	}
 }
 
-func (r *Registry) watchStream(key string, rev int64) error {
+func (r *Registry) watchStream(key string, rev int64, stop <-chan struct{}) error {
 	var rch clientv3.WatchChan
 	if rev != 0 {
 		rch = r.client.Watch(clientv3.WithRequireLeader(r.client.Ctx()),
@@ -233,6 +352,11 @@ func (r *Registry) watchStream(key string, rev int64) error {
 				return fmt.Errorf("etcd monitor chan error: %w", wresp.Err())
 			}
 			r.handleWatchEvents(key, wresp.Events)
+			r.lock.Lock()
+			r.revisions[key] = wresp.Header.Revision
+			r.lock.Unlock()
+		case <-stop:
+			return nil
 		case <-r.done:
 			return nil
 		}
@@ -275,7 +399,8 @@ func (r *Registry) handleWatchEvents(key string, events []*clientv3.Event) {
 				})
 			}
 		default:
-			log.Printf("unknown event type: %v", ev.Type)
+			logger.Warn("etcd registry got an unknown event type",
+				logx.Prefix(key), logx.F("type", ev.Type))
 		}
 	}
 }
@@ -294,6 +419,60 @@ func (r *Registry) getCurrent(key string) []KV {
 	return kvs
 }
 
+type (
+	// RegistryState is the cache of a Registry, see Registries.
+	RegistryState struct {
+		Endpoints string        `json:"endpoints"`
+		Prefixes  []PrefixState `json:"prefixes"`
+	}
+
+	// PrefixState is the cache of a monitored prefix.
+	PrefixState struct {
+		Prefix string `json:"prefix"`
+		// Revision is the etcd revision of the last load or watch event.
+		Revision  int64             `json:"revision"`
+		Listeners int               `json:"listeners"`
+		Values    map[string]string `json:"values"`
+	}
+)
+
+// Registries returns the state of every Registry, for debugging.
+func Registries() []RegistryState {
+	manager.lock.Lock()
+	registries := make(map[string]*Registry, len(manager.registries))
+	for key, r := range manager.registries {
+		registries[key] = r
+	}
+	manager.lock.Unlock()
+
+	res := make([]RegistryState, 0, len(registries))
+	for key, r := range registries {
+		res = append(res, RegistryState{Endpoints: key, Prefixes: r.prefixes()})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Endpoints < res[j].Endpoints })
+	return res
+}
+
+func (r *Registry) prefixes() []PrefixState {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	res := make([]PrefixState, 0, len(r.listeners))
+	for prefix, listeners := range r.listeners {
+		values := make(map[string]string, len(r.values[prefix]))
+		for k, v := range r.values[prefix] {
+			values[k] = v
+		}
+		res = append(res, PrefixState{
+			Prefix:    prefix,
+			Revision:  r.revisions[prefix],
+			Listeners: len(listeners),
+			Values:    values,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Prefix < res[j].Prefix })
+	return res
+}
+
 func makeKeyPrefix(key string) string {
 	return fmt.Sprintf("%s%c", key, EtcdPathDelimiter)
 }
@@ -1,8 +1,11 @@
 package discover
 
 import (
+	"gamerouter/logx"
+	"maps"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type (
@@ -10,27 +13,77 @@ type (
 
 	Subscriber struct {
 		endpoints []string
+		key       string
 		mapping   map[string]string
 		snapshot  atomic.Value
 		dirty     atomic.Bool
 		listeners []func() // notify updates
-		lock      sync.Mutex
+		onError   func(err error)
+		done      <-chan struct{}
+		// the registry monitoring key, nil if done closed first
+		registry *Registry
+		lock     sync.Mutex
 	}
 )
 
+// WithErrorHandler calls onError when the values of the subscriber cannot
+// be loaded, NewSubscriber retries until they are.
+func WithErrorHandler(onError func(err error)) SubOption {
+	return func(sub *Subscriber) {
+		sub.onError = onError
+	}
+}
+
+// WithDone makes NewSubscriber stop retrying once done is closed, the
+// subscriber then has no values and no updates.
+func WithDone(done <-chan struct{}) SubOption {
+	return func(sub *Subscriber) {
+		sub.done = done
+	}
+}
+
 func NewSubscriber(endpoints []string, key string, opts ...SubOption) *Subscriber {
 	sub := &Subscriber{
 		endpoints: endpoints,
+		key:       key,
 		mapping:   make(map[string]string),
 	}
 	for _, opt := range opts {
 		opt(sub)
 	}
-	GetRegistry(endpoints).Monitor(key, sub)
+	for {
+		select {
+		case <-sub.done:
+			return sub
+		default:
+		}
+		registry, err := OpenRegistry(endpoints)
+		if err == nil {
+			if registry.MonitorUntil(key, sub, sub.done) {
+				sub.registry = registry
+			}
+			break
+		}
+		hotLogger.Warn("etcd registry failed to connect", logx.Prefix(key),
+			logx.Err(err))
+		sub.OnError(err)
+		select {
+		case <-sub.done:
+			return sub
+		case <-time.After(time.Second):
+		}
+	}
 
 	return sub
 }
 
+// Close stops the updates of s, its values are kept.
+func (s *Subscriber) Close() {
+	if s.registry != nil {
+		s.registry.Unmonitor(s.key, s)
+	}
+}
+
 func (s *Subscriber) AddListener(listener func()) {
 	s.lock.Lock()
 	s.listeners = append(s.listeners, listener)
@@ -67,6 +120,12 @@ func (s *Subscriber) OnDelete(kv KV) {
 	s.notifyChange()
 }
 
+func (s *Subscriber) OnError(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
 func (s *Subscriber) KeyValues() map[string]string {
 	if !s.dirty.Load() {
 		if m, ok := s.snapshot.Load().(map[string]string); ok {
@@ -76,10 +135,13 @@ func (s *Subscriber) KeyValues() map[string]string {
 	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.snapshot.Store(s.mapping)
+	// the snapshot is read without the lock, later updates must not
+	// change it
+	m := maps.Clone(s.mapping)
+	s.snapshot.Store(m)
 	s.dirty.Store(false)
 
-	return s.mapping
+	return m
 }
 
 func (s *Subscriber) Values() []string {
@@ -91,8 +153,9 @@ func (s *Subscriber) Values() []string {
 	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	vals := toSlice(s.mapping)
-	s.snapshot.Store(s.mapping)
+	m := maps.Clone(s.mapping)
+	vals := toSlice(m)
+	s.snapshot.Store(m)
 	s.dirty.Store(false)
 
 	return vals
@@ -10,4 +10,10 @@ type (
 		OnAdd(kv KV)
 		OnDelete(kv KV)
 	}
+
+	// ErrorListener is implemented by the UpdateListeners which want to know
+	// that the values of their prefix cannot be loaded.
+	ErrorListener interface {
+		OnError(err error)
+	}
 )
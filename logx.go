@@ -1,21 +1,21 @@
 package minigamerouter
 
-import "log"
+import (
+	"fmt"
+	"gamerouter/logx"
+)
 
 const (
-	DebugLevel = iota
-	InfoLevel
-	ErrorLevel
+	DebugLevel = logx.DebugLevel
+	InfoLevel  = logx.InfoLevel
+	ErrorLevel = logx.ErrorLevel
 )
 
-const logLevel = ErrorLevel
-
-func shallLog(level int) bool {
-	return logLevel >= level
-}
-
+// Errorf logs an error through logx.Default.
+//
+// Deprecated: use the gamerouter/logx package.
 func Errorf(format string, v ...any) {
-	if shallLog(ErrorLevel) {
-		log.Printf(format, v)
+	if logx.Enabled(ErrorLevel) {
+		logx.Default().Error(fmt.Sprintf(format, v...))
 	}
 }
@@ -0,0 +1,75 @@
+package logx
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"log/slog"
+)
+
+// NewSlog returns a Logger writing to l, or slog.Default() if nil.
+func NewSlog(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return New(slogSink{l})
+}
+
+type slogSink struct {
+	l *slog.Logger
+}
+
+func (s slogSink) Log(level Level, msg string, fields []Field) {
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	s.l.LogAttrs(context.Background(), slogLevel(level), msg, attrs...)
+}
+
+func slogLevel(l Level) slog.Level {
+	switch l {
+	case DebugLevel:
+		return slog.LevelDebug
+	case InfoLevel:
+		return slog.LevelInfo
+	case WarnLevel:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// NewZap returns a Logger writing to l.
+func NewZap(l *zap.Logger) Logger {
+	return New(zapSink{l.WithOptions(zap.AddCallerSkip(2))})
+}
+
+type zapSink struct {
+	l *zap.Logger
+}
+
+func (s zapSink) Log(level Level, msg string, fields []Field) {
+	ce := s.l.Check(zapLevel(level), msg)
+	if ce == nil {
+		return
+	}
+	zfs := make([]zap.Field, len(fields))
+	for i, f := range fields {
+		zfs[i] = zap.Any(f.Key, f.Value)
+	}
+	ce.Write(zfs...)
+}
+
+func zapLevel(l Level) zapcore.Level {
+	switch l {
+	case DebugLevel:
+		return zapcore.DebugLevel
+	case InfoLevel:
+		return zapcore.InfoLevel
+	case WarnLevel:
+		return zapcore.WarnLevel
+	default:
+		return zapcore.ErrorLevel
+	}
+}
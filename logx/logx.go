@@ -0,0 +1,208 @@
+// Package logx is the logger of discover, minirpc and router. Entries go
+// through the Logger interface to a Sink, by default the standard log
+// package, or slog and zap through NewSlog and NewZap. The level is set at
+// runtime with SetLevel.
+package logx
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", s)
+}
+
+type (
+	// Field is a structured key value pair of an entry.
+	Field struct {
+		Key   string
+		Value any
+	}
+
+	// Logger logs leveled entries with structured fields.
+	Logger interface {
+		Debug(msg string, fields ...Field)
+		Info(msg string, fields ...Field)
+		Warn(msg string, fields ...Field)
+		Error(msg string, fields ...Field)
+		// With returns a Logger adding fields to every entry.
+		With(fields ...Field) Logger
+	}
+
+	// Sink writes the entries enabled by the level, fields must not be
+	// retained.
+	Sink interface {
+		Log(level Level, msg string, fields []Field)
+	}
+)
+
+func F(key string, value any) Field { return Field{Key: key, Value: value} }
+
+// fields shared by the packages
+func Service(name string) Field  { return Field{Key: "service", Value: name} }
+func Instance(id string) Field   { return Field{Key: "instance", Value: id} }
+func Prefix(prefix string) Field { return Field{Key: "prefix", Value: prefix} }
+func Err(err error) Field        { return Field{Key: "error", Value: err} }
+
+var level atomic.Int32
+
+func init() {
+	level.Store(int32(InfoLevel))
+	SetDefault(NewStd(log.Default()))
+}
+
+// SetLevel sets the minimum level of the entries logged by every Logger of
+// this package, InfoLevel by default.
+func SetLevel(l Level) { level.Store(int32(l)) }
+
+func GetLevel() Level { return Level(level.Load()) }
+
+func Enabled(l Level) bool { return l >= GetLevel() }
+
+type defaultHolder struct{ Logger }
+
+var defaultLogger atomic.Pointer[defaultHolder]
+
+// SetDefault replaces the Logger behind Default and Named.
+func SetDefault(l Logger) { defaultLogger.Store(&defaultHolder{l}) }
+
+func Default() Logger { return defaultLogger.Load().Logger }
+
+// Named returns a Logger of a component which follows SetDefault, the
+// entries have a component field.
+func Named(component string) Logger {
+	return named{fields: []Field{{Key: "component", Value: component}}}
+}
+
+type named struct {
+	fields []Field
+}
+
+func (n named) log(l Level, msg string, fields []Field) {
+	if !Enabled(l) {
+		return
+	}
+	logger := Default().With(n.fields...)
+	switch l {
+	case DebugLevel:
+		logger.Debug(msg, fields...)
+	case InfoLevel:
+		logger.Info(msg, fields...)
+	case WarnLevel:
+		logger.Warn(msg, fields...)
+	default:
+		logger.Error(msg, fields...)
+	}
+}
+
+func (n named) Debug(msg string, fields ...Field) { n.log(DebugLevel, msg, fields) }
+func (n named) Info(msg string, fields ...Field)  { n.log(InfoLevel, msg, fields) }
+func (n named) Warn(msg string, fields ...Field)  { n.log(WarnLevel, msg, fields) }
+func (n named) Error(msg string, fields ...Field) { n.log(ErrorLevel, msg, fields) }
+
+func (n named) With(fields ...Field) Logger {
+	return named{fields: appendFields(n.fields, fields)}
+}
+
+// New returns a Logger writing to sink.
+func New(sink Sink) Logger {
+	return &logger{sink: sink}
+}
+
+type logger struct {
+	sink   Sink
+	fields []Field
+}
+
+func (l *logger) log(level Level, msg string, fields []Field) {
+	if !Enabled(level) {
+		return
+	}
+	l.sink.Log(level, msg, appendFields(l.fields, fields))
+}
+
+func (l *logger) Debug(msg string, fields ...Field) { l.log(DebugLevel, msg, fields) }
+func (l *logger) Info(msg string, fields ...Field)  { l.log(InfoLevel, msg, fields) }
+func (l *logger) Warn(msg string, fields ...Field)  { l.log(WarnLevel, msg, fields) }
+func (l *logger) Error(msg string, fields ...Field) { l.log(ErrorLevel, msg, fields) }
+
+func (l *logger) With(fields ...Field) Logger {
+	return &logger{sink: l.sink, fields: appendFields(l.fields, fields)}
+}
+
+// appendFields never modifies the backing array of a.
+func appendFields(a, b []Field) []Field {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	return append(a[:len(a):len(a)], b...)
+}
+
+// NewStd returns a Logger writing lines like
+// "WARN etcd watch failed component=discover prefix=/svc/ error=...".
+func NewStd(l *log.Logger) Logger {
+	return New(stdSink{l})
+}
+
+type stdSink struct {
+	l *log.Logger
+}
+
+func (s stdSink) Log(level Level, msg string, fields []Field) {
+	var sb strings.Builder
+	sb.WriteString(strings.ToUpper(level.String()))
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for _, f := range fields {
+		sb.WriteByte(' ')
+		sb.WriteString(f.Key)
+		sb.WriteByte('=')
+		v := fmt.Sprint(f.Value)
+		if strings.ContainsAny(v, " \"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		sb.WriteString(v)
+	}
+	_ = s.l.Output(3, sb.String())
+}
@@ -0,0 +1,153 @@
+package logx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"log"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// memSink records the entries.
+type memSink struct {
+	entries []string
+}
+
+func (s *memSink) Log(level Level, msg string, fields []Field) {
+	entry := level.String() + " " + msg
+	for _, f := range fields {
+		entry += " " + f.Key + "=" + fmt.Sprint(f.Value)
+	}
+	s.entries = append(s.entries, entry)
+}
+
+func withLevel(t *testing.T, l Level) {
+	old := GetLevel()
+	SetLevel(l)
+	t.Cleanup(func() { SetLevel(old) })
+}
+
+func TestLevels(t *testing.T) {
+	withLevel(t, WarnLevel)
+	sink := &memSink{}
+	l := New(sink).With(Service("player"))
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn", Instance("p-1"))
+	l.Error("error", Err(errors.New("boom")))
+	assert.Equal(t, []string{
+		"warn warn service=player instance=p-1",
+		"error error service=player error=boom",
+	}, sink.entries)
+
+	SetLevel(DebugLevel)
+	l.Debug("debug", Prefix("/a"))
+	assert.Equal(t, "debug debug service=player prefix=/a", sink.entries[2])
+
+	level, err := ParseLevel("WARNING")
+	assert.Nil(t, err)
+	assert.Equal(t, WarnLevel, level)
+	_, err = ParseLevel("loud")
+	assert.NotNil(t, err)
+}
+
+func TestWithDoesNotShareFields(t *testing.T) {
+	sink := &memSink{}
+	base := New(sink).With(Service("a"), Instance("1"))
+	// derived loggers must not overwrite the fields of each other
+	l1 := base.With(Prefix("x"))
+	l2 := base.With(Prefix("y"))
+	l1.Info("m")
+	l2.Info("m")
+	assert.Equal(t, []string{
+		"info m service=a instance=1 prefix=x",
+		"info m service=a instance=1 prefix=y",
+	}, sink.entries)
+}
+
+func TestNamedFollowsDefault(t *testing.T) {
+	old := Default()
+	t.Cleanup(func() { SetDefault(old) })
+	l := Named("discover").With(Prefix("/svc/"))
+
+	sink := &memSink{}
+	SetDefault(New(sink))
+	l.Info("watch")
+	assert.Equal(t, []string{"info watch component=discover prefix=/svc/"},
+		sink.entries)
+
+	var buf bytes.Buffer
+	SetDefault(NewStd(log.New(&buf, "", 0)))
+	l.Warn("watch failed", Err(errors.New("etcd down")))
+	assert.Equal(t,
+		"WARN watch failed component=discover prefix=/svc/ error=\"etcd down\"\n",
+		buf.String())
+}
+
+func TestSlog(t *testing.T) {
+	withLevel(t, DebugLevel)
+	var buf bytes.Buffer
+	l := NewSlog(slog.New(slog.NewJSONHandler(&buf,
+		&slog.HandlerOptions{Level: slog.LevelDebug})))
+	l.With(Service("player")).Warn("slow", F("ms", 120))
+	assert.Contains(t, buf.String(), `"level":"WARN"`)
+	assert.Contains(t, buf.String(), `"msg":"slow","service":"player","ms":120`)
+}
+
+func TestZap(t *testing.T) {
+	withLevel(t, DebugLevel)
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := NewZap(zap.New(core))
+	l.Debug("dropped by zap")
+	l.With(Service("player")).Error("failed", Err(errors.New("boom")))
+	entries := logs.AllUntimed()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	assert.Equal(t, map[string]any{"service": "player", "error": "boom"},
+		entries[0].ContextMap())
+}
+
+func TestRateLimited(t *testing.T) {
+	sink := &memSink{}
+	l := RateLimited(New(sink), 50*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		l.Warn("etcd down")
+		l.With(Prefix("/a")).Warn("other")
+	}
+	assert.Equal(t, []string{"warn etcd down", "warn other prefix=/a"},
+		sink.entries)
+
+	time.Sleep(60 * time.Millisecond)
+	l.Warn("etcd down")
+	assert.Equal(t, "warn etcd down suppressed=4", sink.entries[2])
+
+	// disabled entries are not counted
+	withLevel(t, ErrorLevel)
+	l.Warn("quiet")
+	SetLevel(InfoLevel)
+	l.Warn("quiet")
+	assert.Equal(t, "warn quiet", sink.entries[3])
+}
+
+func TestRateLimitedScope(t *testing.T) {
+	sink := &memSink{}
+	l := RateLimited(New(sink), time.Minute)
+	lobby := l.With(Service("lobby"))
+	for i := 0; i < 3; i++ {
+		lobby.Warn("no instance")
+		l.Warn("no instance", Service("match"))
+		l.Warn("no instance", Service("match"), Prefix("/a"))
+		l.With(Instance("10.0.0.1:8000")).Warn("no instance", Service("match"))
+	}
+	assert.Equal(t, []string{
+		"warn no instance service=lobby",
+		"warn no instance service=match",
+		"warn no instance service=match prefix=/a",
+	}, sink.entries)
+}
@@ -0,0 +1,97 @@
+package logx
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimited returns a Logger which logs each message at most once per
+// interval and per service and prefix fields, for hot paths such as watch
+// loops and pickers, so that a noisy service does not hide the others. The
+// next entry after an interval has a suppressed field counting the entries
+// dropped meanwhile. Loggers derived with With share the limit.
+func RateLimited(l Logger, interval time.Duration) Logger {
+	return &rateLimited{
+		l:       l,
+		limiter: &limiter{interval: interval, msgs: make(map[string]*msgState)},
+	}
+}
+
+type rateLimited struct {
+	l       Logger
+	limiter *limiter
+	// service and prefix fields added by With
+	scope string
+}
+
+type limiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	msgs     map[string]*msgState
+}
+
+type msgState struct {
+	last       time.Time
+	suppressed int
+}
+
+// allow returns whether the entries of key may be logged now and how many
+// of them were suppressed since the last one was logged.
+func (l *limiter) allow(key string, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.msgs[key]
+	if !ok {
+		if len(l.msgs) >= maxLimitedMsgs {
+			// keys are expected to be few, do not grow forever
+			clear(l.msgs)
+		}
+		l.msgs[key] = &msgState{last: now}
+		return true, 0
+	}
+	if now.Sub(s.last) < l.interval {
+		s.suppressed++
+		return false, 0
+	}
+	suppressed := s.suppressed
+	s.last, s.suppressed = now, 0
+	return true, suppressed
+}
+
+const maxLimitedMsgs = 1024
+
+func (r *rateLimited) log(level Level, msg string, fields []Field, write func(string, ...Field)) {
+	if !Enabled(level) {
+		return
+	}
+	ok, suppressed := r.limiter.allow(scopeOf(r.scope, fields)+msg, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		fields = appendFields(fields, []Field{{Key: "suppressed", Value: suppressed}})
+	}
+	write(msg, fields...)
+}
+
+func (r *rateLimited) Debug(msg string, fields ...Field) { r.log(DebugLevel, msg, fields, r.l.Debug) }
+func (r *rateLimited) Info(msg string, fields ...Field)  { r.log(InfoLevel, msg, fields, r.l.Info) }
+func (r *rateLimited) Warn(msg string, fields ...Field)  { r.log(WarnLevel, msg, fields, r.l.Warn) }
+func (r *rateLimited) Error(msg string, fields ...Field) { r.log(ErrorLevel, msg, fields, r.l.Error) }
+
+func (r *rateLimited) With(fields ...Field) Logger {
+	return &rateLimited{l: r.l.With(fields...), limiter: r.limiter,
+		scope: scopeOf(r.scope, fields)}
+}
+
+// scopeOf appends the service and prefix fields to scope, the entries of
+// a message are limited per scope.
+func scopeOf(scope string, fields []Field) string {
+	for _, f := range fields {
+		if f.Key == "service" || f.Key == "prefix" {
+			scope += f.Key + "=" + fmt.Sprint(f.Value) + " "
+		}
+	}
+	return scope
+}
@@ -0,0 +1,238 @@
+package minirpc
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// the number of samples averaged by the short and long term RTT
+	shortRTTWindow = 10
+	longRTTWindow  = 600
+	// the factor applied to the limit when a call is dropped
+	limitBackoffRatio = 0.9
+)
+
+type (
+	// AdaptiveLimitConfig configures the concurrency limiter of
+	// WithAdaptiveLimit. Zero fields take defaults.
+	AdaptiveLimitConfig struct {
+		// InitialLimit is 20 and the limit stays within [MinLimit, MaxLimit],
+		// which default to 1 and 1000.
+		InitialLimit int
+		MinLimit     int
+		MaxLimit     int
+		// MaxQueue is the number of calls waiting for the limit, further
+		// calls fail at once with ResourceExhausted. 0 rejects every call
+		// over the limit.
+		MaxQueue int
+		// Tolerance is how much the short term RTT may exceed the long term
+		// one before the limit shrinks, 2 by default.
+		Tolerance float64
+		// Smoothing is the weight of a new limit, 0.2 by default.
+		Smoothing float64
+	}
+
+	// AdaptiveLimitStats is the state of an adaptive limiter, see
+	// AdaptiveLimit.
+	AdaptiveLimitStats struct {
+		Limit    int           `json:"limit"`
+		InFlight int           `json:"inFlight"`
+		Queued   int           `json:"queued"`
+		ShortRTT time.Duration `json:"shortRTT"`
+		LongRTT  time.Duration `json:"longRTT"`
+	}
+)
+
+// WithAdaptiveLimit limits the calls in flight to the service. The limit is
+// learned from latency like Netflix's gradient limiter: it grows while the
+// short term RTT stays close to the long term one and shrinks as queues
+// build up downstream. Dropped calls, i.e. those failing with Unavailable,
+// DeadlineExceeded or ResourceExhausted, cut the limit by 10%.
+func WithAdaptiveLimit(conf AdaptiveLimitConfig) DialOption {
+	return func(options *dialOptions) {
+		options.AdaptiveLimit = &conf
+	}
+}
+
+func (c AdaptiveLimitConfig) withDefaults() AdaptiveLimitConfig {
+	if c.MinLimit <= 0 {
+		c.MinLimit = 1
+	}
+	if c.MaxLimit <= 0 {
+		c.MaxLimit = 1000
+	}
+	if c.InitialLimit <= 0 {
+		c.InitialLimit = 20
+	}
+	c.InitialLimit = max(c.MinLimit, min(c.MaxLimit, c.InitialLimit))
+	if c.Tolerance <= 0 {
+		c.Tolerance = 2
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		c.Smoothing = 0.2
+	}
+	return c
+}
+
+type adaptiveLimiter struct {
+	serviceName string
+	conf        AdaptiveLimitConfig
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// chan struct{} closed when the waiter gets a slot
+	waiters list.List
+	// RTTs in nanoseconds, 0 until the first sample
+	shortRTT float64
+	longRTT  float64
+}
+
+func newAdaptiveLimiter(serviceName string, conf AdaptiveLimitConfig) *adaptiveLimiter {
+	conf = conf.withDefaults()
+	return &adaptiveLimiter{
+		serviceName: serviceName,
+		conf:        conf,
+		limit:       float64(conf.InitialLimit),
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is room.
+func (l *adaptiveLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.inFlight < int(l.limit) {
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.waiters.Len() >= l.conf.MaxQueue {
+		l.mu.Unlock()
+		return status.Errorf(codes.ResourceExhausted,
+			"concurrency limit %d of %s reached", int(l.limit), l.serviceName)
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	select {
+	case <-ready:
+		// got a slot while giving up
+		l.inFlight--
+		l.wakeLocked()
+	default:
+		l.waiters.Remove(elem)
+	}
+	l.mu.Unlock()
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// release frees the slot of a call which took rtt and failed with err.
+func (l *adaptiveLimiter) release(rtt time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inFlight := l.inFlight
+	l.inFlight--
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		l.limit = math.Max(float64(l.conf.MinLimit), l.limit*limitBackoffRatio)
+	case codes.Canceled:
+		// says nothing about the service
+	default:
+		l.sampleLocked(float64(rtt), inFlight)
+	}
+	l.wakeLocked()
+}
+
+// sampleLocked updates the limit with the RTT of a call made while inFlight
+// calls were running.
+func (l *adaptiveLimiter) sampleLocked(rtt float64, inFlight int) {
+	if l.shortRTT == 0 {
+		l.shortRTT, l.longRTT = rtt, rtt
+	} else {
+		l.shortRTT += (rtt - l.shortRTT) * 2 / (shortRTTWindow + 1)
+		l.longRTT += (rtt - l.longRTT) * 2 / (longRTTWindow + 1)
+	}
+	// let the long term RTT recover quickly after a period of overload
+	if l.longRTT/l.shortRTT > 2 {
+		l.longRTT *= 0.95
+	}
+	gradient := math.Max(0.5, math.Min(1, l.conf.Tolerance*l.longRTT/l.shortRTT))
+	// calls far below the limit tell nothing about a higher one
+	if inFlight < int(l.limit)/2 && gradient == 1 {
+		return
+	}
+	queueSize := math.Sqrt(l.limit)
+	newLimit := l.limit*gradient + queueSize
+	newLimit = l.limit*(1-l.conf.Smoothing) + newLimit*l.conf.Smoothing
+	l.limit = math.Max(float64(l.conf.MinLimit),
+		math.Min(float64(l.conf.MaxLimit), newLimit))
+}
+
+// wakeLocked hands free slots to waiters.
+func (l *adaptiveLimiter) wakeLocked() {
+	for l.inFlight < int(l.limit) && l.waiters.Len() > 0 {
+		ready := l.waiters.Remove(l.waiters.Front()).(chan struct{})
+		l.inFlight++
+		close(ready)
+	}
+}
+
+func (l *adaptiveLimiter) stats() AdaptiveLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return AdaptiveLimitStats{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		Queued:   l.waiters.Len(),
+		ShortRTT: time.Duration(l.shortRTT),
+		LongRTT:  time.Duration(l.longRTT),
+	}
+}
+
+// AdaptiveLimit returns the state of the limiter of a ClientConn created
+// by DialContext with WithAdaptiveLimit, it is also listed by the balancers
+// section of the admin endpoint.
+func AdaptiveLimit(cc *grpc.ClientConn) (AdaptiveLimitStats, error) {
+	n, err := getNamingBalancer(cc)
+	if err != nil {
+		return AdaptiveLimitStats{}, err
+	}
+	n.rwMutex.RLock()
+	l := n.limiter
+	n.rwMutex.RUnlock()
+	if l == nil {
+		return AdaptiveLimitStats{}, fmt.Errorf("%s has no adaptive limit", cc.Target())
+	}
+	return l.stats(), nil
+}
+
+func (l *adaptiveLimiter) UnaryClientInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply any,
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	if err := l.acquire(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	l.release(time.Since(start), err)
+	return err
+}
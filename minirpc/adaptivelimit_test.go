@@ -0,0 +1,85 @@
+package minirpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+// sampleAt feeds n calls of the given RTT made at the current limit.
+func sampleAt(l *adaptiveLimiter, n int, rtt time.Duration) {
+	for i := 0; i < n; i++ {
+		l.mu.Lock()
+		l.sampleLocked(float64(rtt), int(l.limit))
+		l.mu.Unlock()
+	}
+}
+
+func TestAdaptiveLimitGradient(t *testing.T) {
+	l := newAdaptiveLimiter("test", AdaptiveLimitConfig{MaxLimit: 200})
+	// a steady latency lets the limit grow up to MaxLimit
+	sampleAt(l, 1000, 10*time.Millisecond)
+	assert.Equal(t, 200, l.stats().Limit)
+
+	// queueing downstream shrinks it
+	sampleAt(l, 50, 100*time.Millisecond)
+	shrunk := l.stats().Limit
+	assert.Less(t, shrunk, 100)
+
+	// calls far below the limit do not grow it
+	l.mu.Lock()
+	for i := 0; i < 100; i++ {
+		l.sampleLocked(float64(time.Millisecond), 1)
+	}
+	l.mu.Unlock()
+	assert.LessOrEqual(t, l.stats().Limit, shrunk)
+}
+
+func TestAdaptiveLimitDrops(t *testing.T) {
+	l := newAdaptiveLimiter("test", AdaptiveLimitConfig{InitialLimit: 10})
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, l.acquire(context.Background()))
+		l.release(time.Millisecond, status.Error(codes.Unavailable, "down"))
+	}
+	assert.Equal(t, 7, l.stats().Limit)
+
+	// the limit stays above MinLimit
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, l.acquire(context.Background()))
+		l.release(time.Millisecond, status.Error(codes.DeadlineExceeded, "slow"))
+	}
+	assert.Equal(t, 1, l.stats().Limit)
+}
+
+func TestAdaptiveLimitQueue(t *testing.T) {
+	l := newAdaptiveLimiter("test", AdaptiveLimitConfig{
+		InitialLimit: 1, MaxLimit: 1, MaxQueue: 1})
+	ctx := context.Background()
+	assert.Nil(t, l.acquire(ctx))
+
+	acquired := make(chan error)
+	go func() { acquired <- l.acquire(ctx) }()
+	assert.Eventually(t, func() bool { return l.stats().Queued == 1 },
+		time.Second, time.Millisecond)
+
+	// the queue is full
+	err := l.acquire(ctx)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// releasing hands the slot to the waiter
+	l.release(time.Millisecond, nil)
+	assert.Nil(t, <-acquired)
+	assert.Equal(t, 1, l.stats().InFlight)
+
+	// waiters give up with their context
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = l.acquire(cctx)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Equal(t, 0, l.stats().Queued)
+	l.release(time.Millisecond, nil)
+	assert.Equal(t, 0, l.stats().InFlight)
+}
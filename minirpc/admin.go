@@ -0,0 +1,236 @@
+package minirpc
+
+import (
+	"encoding/json"
+	"gamerouter/discover"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// resolverState is the last update of a namingResolver.
+	resolverState struct {
+		ConnID        string         `json:"connID"`
+		Namespace     string         `json:"namespace"`
+		Service       string         `json:"service"`
+		Instances     []ServerInfo   `json:"instances"`
+		TrafficSplit  *TrafficSplit  `json:"trafficSplit,omitempty"`
+		ServiceConfig *ServiceConfig `json:"serviceConfig,omitempty"`
+		// Rejected lists the keys of the malformed instance records.
+		Rejected []string `json:"rejected,omitempty"`
+		// Draining lists the keys or addresses of the draining instances.
+		Draining []string `json:"draining,omitempty"`
+		// Error explains why there is no instance to resolve.
+		Error   string    `json:"error,omitempty"`
+		Updated time.Time `json:"updated"`
+	}
+
+	// balancerState is the state of a namingBalancer and its picker.
+	balancerState struct {
+		ConnID  string `json:"connID"`
+		Service string `json:"service"`
+		State   string `json:"state"`
+		// LbPolicy is the policy of the calls without a method or request
+		// scope override.
+		LbPolicy string `json:"lbPolicy,omitempty"`
+		// Picking lists the instances the picker chooses from, after the
+		// selector, priority and locality filters.
+		Picking       []string             `json:"picking"`
+		SubConns      []subConnState       `json:"subConns"`
+		ResolverError string               `json:"resolverError,omitempty"`
+		ConnError     string               `json:"connError,omitempty"`
+		Breakers      *CircuitBreakerStats `json:"breakers,omitempty"`
+		AdaptiveLimit *AdaptiveLimitStats  `json:"adaptiveLimit,omitempty"`
+	}
+
+	subConnState struct {
+		Addr  string `json:"addr"`
+		State string `json:"state"`
+	}
+
+	adminSection struct {
+		name        string
+		description string
+		state       func() any
+	}
+)
+
+// adminResolver is a resolver listed by the admin endpoint.
+type adminResolver interface {
+	// adminState returns the last update, nil before the first one.
+	adminState() *resolverState
+	// lastError returns the error last reported to the ClientConn, nil
+	// once instances are resolved.
+	lastError() error
+}
+
+// namingResolvers indexes the live adminResolvers by dialOptions.ConnID.
+var namingResolvers sync.Map
+
+var adminSections = struct {
+	sync.Mutex
+	list []adminSection
+}{}
+
+func init() {
+	HandleAdmin("registries", "etcd registries: the cache and revision of each watched prefix",
+		func() any { return discover.Registries() })
+	HandleAdmin("resolvers", "resolvers: the instances, traffic split and service config last resolved",
+		resolverStates)
+	HandleAdmin("balancers", "balancers: SubConn states, the instances being picked and the LB policy",
+		balancerStates)
+}
+
+// HandleAdmin adds a section to the admin endpoint, state is called on each
+// request to the section and its result is written as JSON. A section
+// replaces an earlier one of the same name.
+func HandleAdmin(name, description string, state func() any) {
+	adminSections.Lock()
+	defer adminSections.Unlock()
+	section := adminSection{name: name, description: description, state: state}
+	for i, s := range adminSections.list {
+		if s.name == name {
+			adminSections.list[i] = section
+			return
+		}
+	}
+	adminSections.list = append(adminSections.list, section)
+}
+
+func getAdminSection(name string) (adminSection, bool) {
+	adminSections.Lock()
+	defer adminSections.Unlock()
+	for _, s := range adminSections.list {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return adminSection{}, false
+}
+
+var adminIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>minirpc admin</title></head>
+<body>
+<h1>minirpc admin</h1>
+<ul>
+{{range .}}<li><a href="{{.Name}}">{{.Name}}</a>: {{.Description}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// AdminHandler returns the handler of the admin endpoint. It serves an
+// HTML index at / and the JSON state of each section at /<name>, mount it
+// with http.StripPrefix under another path.
+func AdminHandler() http.Handler {
+	return http.HandlerFunc(serveAdmin)
+}
+
+func serveAdmin(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if len(name) == 0 {
+		adminSections.Lock()
+		index := make([]struct{ Name, Description string }, len(adminSections.list))
+		for i, s := range adminSections.list {
+			index[i].Name, index[i].Description = s.name, s.description
+		}
+		adminSections.Unlock()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = adminIndex.Execute(w, index)
+		return
+	}
+	section, ok := getAdminSection(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(section.state())
+}
+
+// ServeAdmin serves AdminHandler on addr, e.g. "127.0.0.1:9091". Close the
+// returned server to stop.
+func ServeAdmin(addr string) (*http.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: AdminHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = srv.Serve(lis) }()
+	return srv, nil
+}
+
+func resolverStates() any {
+	res := make([]*resolverState, 0)
+	namingResolvers.Range(func(_, v any) bool {
+		if state := v.(adminResolver).adminState(); state != nil {
+			res = append(res, state)
+		}
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].ConnID < res[j].ConnID })
+	return res
+}
+
+func balancerStates() any {
+	res := make([]*balancerState, 0)
+	namingBalancers.Range(func(_, v any) bool {
+		res = append(res, v.(*namingBalancer).adminState())
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].ConnID < res[j].ConnID })
+	return res
+}
+
+func (n *namingBalancer) adminState() *balancerState {
+	n.rwMutex.RLock()
+	defer n.rwMutex.RUnlock()
+	state := &balancerState{
+		ConnID:   n.connID,
+		Service:  n.serviceName,
+		State:    n.state.String(),
+		Picking:  make([]string, 0),
+		SubConns: make([]subConnState, 0, len(n.subConns)),
+	}
+	for addr, sc := range n.subConns {
+		state.SubConns = append(state.SubConns, subConnState{
+			Addr: addr, State: n.scStates[sc].String()})
+	}
+	sort.Slice(state.SubConns, func(i, j int) bool {
+		return state.SubConns[i].Addr < state.SubConns[j].Addr
+	})
+	// the picker of a balancer in TransientFailure fails with the errors
+	if p, ok := n.picker.(*namingPicker); ok {
+		lbPolicy, _ := p.callPolicy("", nil)
+		if _, ok := getPickerPolicy(lbPolicy); !ok {
+			lbPolicy = Random
+		}
+		state.LbPolicy = lbPolicy
+		for _, instance := range p.instances {
+			state.Picking = append(state.Picking, instanceAddr(instance.Info))
+		}
+		sort.Strings(state.Picking)
+	}
+	if n.resolverErr != nil {
+		state.ResolverError = n.resolverErr.Error()
+	}
+	if n.connErr != nil {
+		state.ConnError = n.connErr.Error()
+	}
+	if n.breakers != nil {
+		state.Breakers = n.breakers.stats()
+	}
+	if n.limiter != nil {
+		stats := n.limiter.stats()
+		state.AdaptiveLimit = &stats
+	}
+	return state
+}
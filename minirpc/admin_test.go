@@ -0,0 +1,109 @@
+package minirpc
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getAdmin(t *testing.T, path string, v any) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if v != nil {
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec
+}
+
+func TestAdminIndex(t *testing.T) {
+	HandleAdmin("test", "test <section>", func() any {
+		return map[string]int{"answer": 42}
+	})
+	rec := getAdmin(t, "/", nil)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	for _, name := range []string{"registries", "resolvers", "balancers"} {
+		assert.Contains(t, rec.Body.String(), `<a href="`+name+`">`)
+	}
+	assert.Contains(t, rec.Body.String(), "test &lt;section&gt;")
+
+	var v map[string]int
+	getAdmin(t, "/test", &v)
+	assert.Equal(t, 42, v["answer"])
+	assert.Equal(t, http.StatusNotFound, getAdmin(t, "/nothing", nil).Code)
+
+	var registries []any
+	getAdmin(t, "/registries", &registries)
+}
+
+func TestAdminResolvers(t *testing.T) {
+	r := &namingResolver{options: &dialOptions{ConnID: "admin-test"},
+		done: make(chan struct{})}
+	r.last.Store(&resolverState{
+		ConnID:    "admin-test",
+		Namespace: DefaultNamespace,
+		Service:   "player",
+		Instances: retryInfos(1),
+	})
+	namingResolvers.Store("admin-test", r)
+	defer r.Close()
+
+	var states []resolverState
+	getAdmin(t, "/resolvers", &states)
+	var state *resolverState
+	for i := range states {
+		if states[i].ConnID == "admin-test" {
+			state = &states[i]
+		}
+	}
+	if assert.NotNil(t, state) {
+		assert.Equal(t, "player", state.Service)
+		assert.Equal(t, retryInfos(1), state.Instances)
+	}
+}
+
+func TestAdminBalancers(t *testing.T) {
+	c := newBufCluster(t, retryInfos(2))
+	cli := c.connect(t, WithLoadBalancer(WeightRandom),
+		WithCircuitBreaker(testBreakerConfig),
+		WithAdaptiveLimit(AdaptiveLimitConfig{InitialLimit: 50}))
+	assert.Len(t, hostCounts(t, cli, 10), 1)
+	// wait for both instances
+	for i := 0; i < 100 && len(connBalancerState(t, c).Picking) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	state := connBalancerState(t, c)
+	assert.Equal(t, "READY", state.State)
+	assert.Equal(t, WeightRandom, state.LbPolicy)
+	assert.Equal(t, []string{"10.0.0.1:8000", "10.0.0.1:8001"}, state.Picking)
+	assert.Equal(t, []subConnState{
+		{Addr: "10.0.0.1:8000", State: "READY"},
+		{Addr: "10.0.0.1:8001", State: "READY"},
+	}, state.SubConns)
+	assert.NotNil(t, state.Breakers)
+	if assert.NotNil(t, state.AdaptiveLimit) {
+		assert.Equal(t, 50, state.AdaptiveLimit.Limit)
+	}
+	stats, err := AdaptiveLimit(c.cc)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.InFlight)
+}
+
+// connBalancerState returns the admin state of the balancer of c.cc.
+func connBalancerState(t *testing.T, c *bufCluster) balancerState {
+	connID, err := connIDOf(c.cc)
+	assert.Nil(t, err)
+	var states []balancerState
+	getAdmin(t, "/balancers", &states)
+	for _, state := range states {
+		if state.ConnID == connID {
+			return state
+		}
+	}
+	t.Fatalf("no balancer %s", connID)
+	return balancerState{}
+}
@@ -1,20 +1,22 @@
 package minirpc
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
+	"gamerouter/logx"
 	router "gamerouter/router/proto"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
-	"log"
+	"google.golang.org/grpc/status"
 	"math/rand"
-	"sort"
-	"stathat.com/c/consistent"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,7 +26,7 @@ type balancerBuilder struct {
 func (bb *balancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
 	target := opts.Target
 	host, _, _ := parseHost(target.URL.Host)
-	return &namingBalancer{
+	n := &namingBalancer{
 		cc:          cc,
 		target:      opts.Target,
 		serviceName: host,
@@ -32,12 +34,20 @@ func (bb *balancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOpti
 		scStates:    make(map[balancer.SubConn]connectivity.State),
 		csEvltr:     &balancer.ConnectivityStateEvaluator{},
 	}
+	if n.connID = connIDFromTarget(target.URL); len(n.connID) > 0 {
+		namingBalancers.Store(n.connID, n)
+	}
+	return n
 }
 
 func (bb *balancerBuilder) Name() string { return EtcdScheme }
 
+// namingBalancers indexes the live balancers by dialOptions.ConnID.
+var namingBalancers sync.Map
+
 type namingBalancer struct {
 	cc          balancer.ClientConn
+	connID      string
 	target      resolver.Target
 	serviceName string
 	rwMutex     sync.RWMutex
@@ -50,9 +60,21 @@ type namingBalancer struct {
 	serverInfos []ServerInfo
 	picker      balancer.Picker
 
-	cons *consistent.Consistent
+	dialOptions  *dialOptions
+	selector     Selector
+	trafficSplit *TrafficSplit
+	// read by the hash key interceptor as well
+	svcConfig atomic.Pointer[ServiceConfig]
+	// nil without WithCircuitBreaker
+	breakers *breakerGroup
+	// nil without WithAdaptiveLimit
+	limiter *adaptiveLimiter
+	// nil without WithMetrics
+	metrics *Metrics
 
-	dialOptions *dialOptions
+	priority        priorityGate
+	regenerateTimer *time.Timer
+	closed          bool
 
 	resolverErr error // the last error reported by the resolver; cleared on successful resolution
 	connErr     error // the last connection error; cleared upon leaving TransientFailure
@@ -69,7 +91,8 @@ func (n *namingBalancer) createSubConnection(key string, addr resolver.Address)
 		[]resolver.Address{addr},
 		balancer.NewSubConnOptions{HealthCheckEnabled: false})
 	if err != nil {
-		fmt.Printf("balancer failed to create new SubConn: %v", err)
+		n.dialOptions.log().Warn("balancer failed to create SubConn",
+			logx.Service(n.serviceName), logx.Instance(addr.Addr), logx.Err(err))
 		return
 	}
 	n.subConns[key] = sc
@@ -84,20 +107,51 @@ func (n *namingBalancer) createSubConnection(key string, addr resolver.Address)
 // exponential backoff until a subsequent call to UpdateClientConnState
 // returns a nil error.  Any other errors are currently ignored.
 func (n *namingBalancer) UpdateClientConnState(state balancer.ClientConnState) error {
+	n.rwMutex.Lock()
 	if n.dialOptions == nil && state.ResolverState.Attributes != nil {
 		n.dialOptions = state.ResolverState.Attributes.Value(keyDialOptions).(*dialOptions)
+		n.breakers = n.dialOptions.breakers
+		n.limiter = n.dialOptions.limiter
+		n.metrics = n.dialOptions.metrics
+		selector, err := n.dialOptions.selector()
+		if err != nil {
+			n.dialOptions.log().Warn("balancer ignores invalid selector",
+				logx.Service(n.serviceName), logx.Err(err))
+		}
+		n.selector = selector
 	}
 	if state.ResolverState.Attributes != nil {
 		n.serverInfos = state.ResolverState.Attributes.Value(keyServerInfo).([]ServerInfo)
+		n.trafficSplit, _ = state.ResolverState.Attributes.Value(keyTrafficSplit).(*TrafficSplit)
+		conf, _ := state.ResolverState.Attributes.Value(keyServiceConfig).(*ServiceConfig)
+		n.svcConfig.Store(conf)
 	}
+	n.rwMutex.Unlock()
 	if len(state.ResolverState.Addresses) == 0 {
-		log.Printf("balancer receive empty address, service name=%s",
-			n.serviceName)
-		n.ResolverError(errors.New("produced zero addresses"))
+		// the instances are gone or draining, the resolvers tell why
+		n.dialOptions.hotLog().Warn("balancer received no address",
+			logx.Service(n.serviceName))
+		n.rwMutex.Lock()
+		defer n.rwMutex.Unlock()
+		if err, ok := state.ResolverState.Attributes.Value(keyResolverError).(error); ok {
+			n.resolverErr = err
+		}
+		for a, sc := range n.subConns {
+			delete(n.subConns, a)
+			sc.Shutdown()
+		}
+		n.connErr = nil
+		n.state = connectivity.TransientFailure
+		n.regeneratePicker(n.dialOptions)
+		n.cc.UpdateState(balancer.State{
+			ConnectivityState: n.state, Picker: n.picker,
+		})
 		return balancer.ErrBadResolverState
 	}
 	// resolution succeed
+	n.rwMutex.Lock()
 	n.resolverErr = nil
+	n.rwMutex.Unlock()
 	addrSet := make(map[string]struct{})
 	for _, a := range state.ResolverState.Addresses {
 		key := fmt.Sprintf("%s", a.Addr)
@@ -123,58 +177,71 @@ func (n *namingBalancer) UpdateClientConnState(state balancer.ClientConnState) e
 }
 
 func (n *namingBalancer) regeneratePicker(options *dialOptions) {
-	if n.state == connectivity.TransientFailure {
+	// the SubConns being shut down may still count as ready
+	if n.state == connectivity.TransientFailure || len(n.subConns) == 0 {
 		n.picker = base.NewErrPicker(n.mergeErrors())
 		return
 	}
 	readySCs := make(map[string]balancer.SubConn)
+	connecting := make(map[string]bool)
 	// Filter out all ready SCs from full subConn map.
 	for addr, sc := range n.subConns {
-		if st, ok := n.scStates[sc]; ok && st == connectivity.Ready {
+		switch n.scStates[sc] {
+		case connectivity.Ready:
 			readySCs[addr] = sc
+		case connectivity.Idle, connectivity.Connecting:
+			connecting[addr] = true
 		}
 	}
 
 	readyInstances := make([]ServerInfo, 0, len(readySCs))
-	readyAddr := make([]string, 0, len(readySCs))
-
-	preWeight := make([]int, 0, len(readySCs))
-	totalWeight := 0
 	for _, instance := range n.serverInfos {
-		// see buildAddressKey
-		key := instance.Host + ":" + strconv.FormatInt(int64(instance.Port),
-			10)
-		if _, ok := readySCs[key]; ok {
+		if _, ok := readySCs[instanceAddr(instance)]; ok {
 			readyInstances = append(readyInstances, instance)
-			readyAddr = append(readyAddr, key)
-
-			preWeight = append(preWeight, totalWeight)
-			totalWeight += instance.Weight
 		}
 	}
 
-	picker := &namingPicker{
-		balancer:    n,
-		readySCs:    readySCs,
-		options:     options,
-		serverInfos: readyInstances,
-		preWeight:   preWeight,
+	n.breakers.retain(n.serverInfos)
+	known := filterInstances(n.serverInfos, n.selector)
+	candidates := n.preferPriority(
+		filterInstances(readyInstances, n.selector), known)
+	picker := newNamingPicker(n, readySCs, options,
+		preferLocal(options, candidates, known))
+	picker.readyInstances = readyInstances
+	picker.knownInstances = n.serverInfos
+	picker.connecting = connecting
+	picker.selector = n.selector
+	picker.svcConfig = n.svcConfig.Load()
+	picker.applySplit(n.trafficSplit)
+	n.picker = picker
+}
+
+// instanceAddr returns the key of the instance in subConns.
+func instanceAddr(info ServerInfo) string {
+	return info.Host + ":" + strconv.FormatInt(int64(info.Port), 10)
+}
+
+func filterInstances(infos []ServerInfo, selector Selector) []ServerInfo {
+	if selector.Empty() {
+		return infos
 	}
-	if options.LbPolicy == KetamaWeightName {
-		if n.cons == nil {
-			n.cons = consistent.New()
+	res := make([]ServerInfo, 0, len(infos))
+	for _, info := range infos {
+		if selector.Matches(info.ServerMetadata) {
+			res = append(res, info)
 		}
-		n.cons.Set(readyAddr)
-		picker.Cons = n.cons
 	}
-	n.picker = picker
+	return res
 }
 
 // mergeErrors builds an error from the last connection error and the last resolver error.
 // It Must only be called if the b.state is TransientFailure.
 func (n *namingBalancer) mergeErrors() error {
 	// connErr must always be non-nil unless there are no SubConns, in which
-	// case resolverErr must be non-nil.
+	// case resolverErr is non-nil once the resolver reported why.
+	if n.connErr == nil && n.resolverErr == nil {
+		return errors.New("no instance resolved")
+	}
 	if n.connErr == nil {
 		return fmt.Errorf("last resolver error: %w", n.resolverErr)
 	}
@@ -187,6 +254,8 @@ func (n *namingBalancer) mergeErrors() error {
 
 // ResolverError is called by gRPC when the name resolver reports an error.
 func (n *namingBalancer) ResolverError(err error) {
+	n.rwMutex.Lock()
+	defer n.rwMutex.Unlock()
 	n.resolverErr = err
 	if len(n.subConns) == 0 {
 		n.state = connectivity.TransientFailure
@@ -194,8 +263,9 @@ func (n *namingBalancer) ResolverError(err error) {
 	if n.state != connectivity.TransientFailure {
 		return
 	}
-	n.rwMutex.RLock()
-	defer n.rwMutex.RUnlock()
+	n.dialOptions.hotLog().Warn("balancer has no instance",
+		logx.Service(n.serviceName), logx.Err(err))
+	n.picker = base.NewErrPicker(n.mergeErrors())
 	n.cc.UpdateState(balancer.State{
 		ConnectivityState: n.state,
 		Picker:            n.picker,
@@ -209,8 +279,8 @@ func (n *namingBalancer) UpdateSubConnState(conn balancer.SubConn, state balance
 	defer n.rwMutex.Unlock()
 	oldS, ok := n.scStates[conn]
 	if !ok {
-		fmt.Printf("[Polaris][Balancer] got state changes for an unknown SubConn: %p, %v",
-			conn, s)
+		n.dialOptions.hotLog().Debug("balancer got a state change of an unknown SubConn",
+			logx.Service(n.serviceName), logx.F("state", s.String()))
 		return
 	}
 	if oldS == connectivity.TransientFailure && (s == connectivity.Connecting || s == connectivity.Idle) {
@@ -235,9 +305,11 @@ func (n *namingBalancer) UpdateSubConnState(conn balancer.SubConn, state balance
 
 	// Regenerate picker when one of the following happens:
 	//  - this sc entered or left ready
+	//  - this sc entered TransientFailure, calls pinned to it must fail
 	//  - the aggregated state of balancer is TransientFailure
 	//    (may need to update error message)
 	if (s == connectivity.Ready) != (oldS == connectivity.Ready) ||
+		s == connectivity.TransientFailure ||
 		n.state == connectivity.TransientFailure {
 		n.regeneratePicker(n.dialOptions)
 	}
@@ -248,6 +320,25 @@ func (n *namingBalancer) UpdateSubConnState(conn balancer.SubConn, state balance
 }
 
 func (n *namingBalancer) Close() {
+	n.rwMutex.Lock()
+	defer n.rwMutex.Unlock()
+	n.closed = true
+	if len(n.connID) > 0 {
+		namingBalancers.CompareAndDelete(n.connID, n)
+	}
+	if n.regenerateTimer != nil {
+		n.regenerateTimer.Stop()
+	}
+}
+
+// pickable returns the number of instances the picker chooses from.
+func (n *namingBalancer) pickable() int {
+	n.rwMutex.RLock()
+	defer n.rwMutex.RUnlock()
+	if p, ok := n.picker.(*namingPicker); ok {
+		return len(p.instances)
+	}
+	return 0
 }
 
 type namingPicker struct {
@@ -255,88 +346,295 @@ type namingPicker struct {
 	readySCs    map[string]balancer.SubConn
 	options     *dialOptions
 	serverInfos []ServerInfo
-	// 权重的前缀和，用于带权重的随机算法
-	preWeight []int
-	Cons      *consistent.Consistent
+	instances   []PickerInstance
+	// policy name -> PolicyPicker, built on first use
+	policies sync.Map
+
+	// all ready and all resolved instances, not filtered by the dial time
+	// selector, used by per-request selectors
+	readyInstances []ServerInfo
+	knownInstances []ServerInfo
+	connecting     map[string]bool
+	selector       Selector
+	subPickers     subPickerCache
+
+	split     *splitPicker
+	splitConf *TrafficSplit
+	// SubConn -> instance address
+	addrs     map[balancer.SubConn]string
+	svcConfig *ServiceConfig
 
 	routerAPI *router.RouterClient
 }
 
+func newNamingPicker(
+	n *namingBalancer,
+	readySCs map[string]balancer.SubConn,
+	options *dialOptions,
+	instances []ServerInfo,
+) *namingPicker {
+	p := &namingPicker{
+		balancer:    n,
+		readySCs:    readySCs,
+		options:     options,
+		serverInfos: instances,
+		instances:   make([]PickerInstance, 0, len(instances)),
+		addrs:       make(map[balancer.SubConn]string, len(readySCs)),
+	}
+	for addr, sc := range readySCs {
+		p.addrs[sc] = addr
+	}
+	for _, info := range instances {
+		if sc, ok := p.getSubConns(info); ok {
+			p.instances = append(p.instances,
+				PickerInstance{Info: info, SubConn: sc})
+		}
+	}
+	return p
+}
+
 func (p *namingPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
-	if len(p.serverInfos) < 1 {
-		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	res, err := p.pickCall(info)
+	if err != nil {
+		return res, err
+	}
+	if call := getRetryCall(info.Ctx); call != nil {
+		call.add(res.SubConn)
+	}
+	if breakers := p.breakers(); breakers != nil {
+		var ok bool
+		if res, ok = breakers.track(p.addrs[res.SubConn], res); !ok {
+			return balancer.PickResult{}, &CircuitOpenError{ServiceName: p.serviceName()}
+		}
 	}
-	if len(p.serverInfos) == 1 {
-		sc, ok := p.getSubConns(p.serverInfos[0])
-		if !ok {
-			return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	if p.balancer != nil && p.balancer.metrics != nil {
+		res = p.trackAttempt(info.FullMethodName, res)
+	}
+	if span := SpanFromContext(info.Ctx); span != nil && span.Kind == SpanKindClient {
+		md, _ := metadata.FromOutgoingContext(info.Ctx)
+		lbPolicy, hashKey := p.callPolicy(info.FullMethodName, md)
+		span.SetAttribute(SpanAttrInstance, p.addrs[res.SubConn])
+		span.SetAttribute(SpanAttrLbPolicy, lbPolicy)
+		if len(hashKey) > 0 {
+			span.SetAttribute(SpanAttrHashKey, hashKey)
 		}
-		return balancer.PickResult{
-			SubConn: sc,
-		}, nil
+		span.incAttempts()
 	}
+	return res, nil
+}
+
+// trackAttempt records the attempt in the metrics when it is done.
+func (p *namingPicker) trackAttempt(method string, res balancer.PickResult) balancer.PickResult {
+	start := time.Now()
+	instance := p.addrs[res.SubConn]
+	done := res.Done
+	res.Done = func(info balancer.DoneInfo) {
+		p.balancer.metrics.recordAttempt(p.serviceName(), method, instance,
+			time.Since(start), info.Err)
+		if done != nil {
+			done(info)
+		}
+	}
+	return res
+}
+
+func (p *namingPicker) breakers() *breakerGroup {
+	if p.balancer == nil {
+		return nil
+	}
+	return p.balancer.breakers
+}
+
+func (p *namingPicker) pickCall(info balancer.PickInfo) (balancer.PickResult, error) {
 	md, ok := metadata.FromOutgoingContext(info.Ctx)
-	lbPolicy := p.options.LbPolicy
-	var lbHashKey string
+	lbPolicy, hashKey := p.callPolicy(info.FullMethodName, md)
+	pickInfo := PickInfo{PickInfo: info, HashKey: hashKey}
 	if ok {
-		lbPolicyValues := md.Get(miniRequestLbPolicy)
-		lbHashKeyValues := md.Get(miniRequestLbHashKey)
-
-		if len(lbPolicyValues) > 0 {
-			lbPolicy = lbPolicyValues[0]
+		if instanceValues := md.Get(miniRequestInstance); len(instanceValues) > 0 {
+			return p.pickInstance(instanceValues[0])
 		}
-		if len(lbHashKeyValues) > 0 {
-			lbHashKey = lbHashKeyValues[0]
+		if selectorValues := md.Get(miniRequestSelector); len(selectorValues) > 0 {
+			sub, err := p.subPicker(selectorValues[0])
+			if err != nil {
+				return balancer.PickResult{}, err
+			}
+			return sub.pick(lbPolicy, pickInfo)
 		}
 	}
-	switch lbPolicy {
-	case Random:
-		return p.pickRandom()
-	case WeightRandom:
-		return p.pickWeightRandom()
-	case KetamaWeightName:
-		return p.pickKetamaWeightRandom(lbHashKey)
+	return p.pick(lbPolicy, pickInfo)
+}
+
+// callPolicy returns the LB policy and hash key of a call, from the
+// request scope metadata md, the service config or the dial options.
+func (p *namingPicker) callPolicy(method string, md metadata.MD) (lbPolicy, hashKey string) {
+	lbPolicy = p.options.LbPolicy
+	if policy := p.svcConfig.lbPolicy(method); len(policy) > 0 {
+		lbPolicy = policy
+	}
+	if values := md.Get(miniRequestLbPolicy); len(values) > 0 {
+		lbPolicy = values[0]
+	}
+	if values := md.Get(miniRequestLbHashKey); len(values) > 0 {
+		hashKey = values[0]
 	}
-	return p.pickRandom()
+	return lbPolicy, hashKey
 }
-func (p *namingPicker) pickRandom() (balancer.PickResult, error) {
-	rand.NewSource(time.Now().UnixNano())
-	scLen := len(p.serverInfos)
-	info := p.serverInfos[rand.Intn(scLen)]
-	subconn, ok := p.getSubConns(info)
-	if !ok {
-		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+
+// subPicker returns a picker over the ready instances matching selector.
+func (p *namingPicker) subPicker(expr string) (*namingPicker, error) {
+	if sub, ok := p.subPickers.get(expr); ok {
+		return sub, nil
+	}
+	selector, err := ParseSelector(expr)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	return balancer.PickResult{SubConn: subconn}, nil
+	sub := newNamingPicker(p.balancer, p.readySCs, p.options,
+		filterInstances(p.readyInstances, selector))
+	sub.readyInstances = p.readyInstances
+	sub.knownInstances = p.knownInstances
+	sub.selector = selector
+	sub.applySplit(p.splitConf)
+	return p.subPickers.add(expr, sub), nil
 }
 
-func (p *namingPicker) pickWeightRandom() (balancer.PickResult, error) {
-	bound := p.preWeight[len(p.preWeight)-1]
-	if bound <= 0 {
-		return p.pickRandom()
+// maxSubPickers bounds the pickers of per-request selectors kept by a
+// picker, the least recently used one is dropped beyond it.
+const maxSubPickers = 32
+
+// subPickerCache is a small LRU of the pickers of per-request selectors,
+// keyed by the selector expression of the request.
+type subPickerCache struct {
+	mu sync.Mutex
+	// of *subPickerEntry, the most recently used first
+	order   list.List
+	entries map[string]*list.Element
+}
+
+type subPickerEntry struct {
+	expr   string
+	picker *namingPicker
+}
+
+func (c *subPickerCache) get(expr string) (*namingPicker, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[expr]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*subPickerEntry).picker, true
 	}
-	x := rand.Intn(bound) + 1
-	index := sort.SearchInts(p.preWeight, x)
-	subconn, _ := p.getSubConns(p.serverInfos[index])
-	return balancer.PickResult{SubConn: subconn}, nil
+	return nil, false
 }
 
-func (p *namingPicker) pickKetamaWeightRandom(hashKey string) (balancer.PickResult, error) {
-	if p.Cons == nil {
-		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+// add stores sub for expr and returns it, or the picker stored by a
+// concurrent call first.
+func (c *subPickerCache) add(expr string, sub *namingPicker) *namingPicker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[expr]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*subPickerEntry).picker
 	}
-	addr, err := p.Cons.Get(hashKey)
-	if err != nil {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	c.entries[expr] = c.order.PushFront(&subPickerEntry{expr: expr, picker: sub})
+	if c.order.Len() > maxSubPickers {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*subPickerEntry).expr)
+	}
+	return sub
+}
+
+func (c *subPickerCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (p *namingPicker) pick(lbPolicy string, info PickInfo) (balancer.PickResult, error) {
+	if len(p.instances) < 1 {
+		if len(p.knownInstances) > 0 &&
+			len(filterInstances(p.knownInstances, p.selector)) == 0 {
+			// waiting for a new picker will not help
+			return balancer.PickResult{}, status.Errorf(codes.Unavailable,
+				"no instance of %s matches selector %q",
+				p.serviceName(), p.selector.String())
+		}
 		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
 	}
-	if res, ok := p.readySCs[addr]; ok {
-		return balancer.PickResult{SubConn: res}, nil
+	if p.split != nil {
+		// fall back to all instances if the group is empty
+		if g := p.split.pick(info.HashKey); g != nil {
+			return g.pick(lbPolicy, info)
+		}
+	}
+	res := balancer.PickResult{SubConn: p.instances[0].SubConn}
+	if len(p.instances) > 1 {
+		var err error
+		if res, err = p.policyPicker(lbPolicy).Pick(info); err != nil {
+			return res, err
+		}
+	}
+	return p.avoid(info, res)
+}
+
+// avoid replaces an instance whose circuit breaker is open, or which was
+// already tried by an attempt of the call, with a random other one.
+func (p *namingPicker) avoid(info PickInfo, res balancer.PickResult) (balancer.PickResult, error) {
+	call := getRetryCall(info.Ctx)
+	breakers := p.breakers()
+	if call == nil && breakers == nil {
+		return res, nil
+	}
+	now := time.Now()
+	usable := func(sc balancer.SubConn) bool {
+		return breakers.allow(p.addrs[sc], now)
+	}
+	untried := func(sc balancer.SubConn) bool {
+		return call == nil || !call.isTried(sc)
+	}
+	if usable(res.SubConn) && untried(res.SubConn) {
+		return res, nil
+	}
+	var left, tried []balancer.SubConn
+	for _, ins := range p.instances {
+		if !usable(ins.SubConn) {
+			continue
+		}
+		if untried(ins.SubConn) {
+			left = append(left, ins.SubConn)
+		} else {
+			tried = append(tried, ins.SubConn)
+		}
+	}
+	switch {
+	case len(left) > 0:
+		return balancer.PickResult{SubConn: left[rand.Intn(len(left))]}, nil
+	case usable(res.SubConn):
+		return res, nil
+	case len(tried) > 0:
+		return balancer.PickResult{SubConn: tried[rand.Intn(len(tried))]}, nil
+	}
+	return balancer.PickResult{}, &CircuitOpenError{ServiceName: p.serviceName()}
+}
+
+// policyPicker returns the picker of the named policy, unknown policies
+// fall back to random.
+func (p *namingPicker) policyPicker(name string) PolicyPicker {
+	if pp, ok := p.policies.Load(name); ok {
+		return pp.(PolicyPicker)
+	}
+	builder, ok := getPickerPolicy(name)
+	if !ok {
+		builder, _ = getPickerPolicy(Random)
 	}
-	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	pp, _ := p.policies.LoadOrStore(name, builder.Build(p.instances))
+	return pp.(PolicyPicker)
 }
 
 func (p *namingPicker) getSubConns(info ServerInfo) (balancer.SubConn, bool) {
-	addr := fmt.Sprintf("%s:%d", info.Host, info.Port)
-	subconn, ok := p.readySCs[addr]
+	subconn, ok := p.readySCs[instanceAddr(info)]
 	return subconn, ok
 }
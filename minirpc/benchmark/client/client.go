@@ -2,33 +2,57 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
+	"gamerouter/discover"
+	"gamerouter/logx"
 	"gamerouter/minirpc"
 	echo "gamerouter/minirpc/benchmark/proto"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"os"
 	"runtime/pprof"
 	"time"
 )
 
 var (
-	endpoints = []string{"127.0.0.1:2379"}
+	confFile = flag.String("f", "", "YAML, TOML or JSON conf file, see minirpc.LoadConf")
+	// e.g. static://EchoServer/localhost:60000,localhost:60001 without etcd
+	target = flag.String("target", "", "dial target, unless set by the conf")
+
+	logger = logx.Named("benchmark")
 )
 
 func main() {
+	flag.Parse()
+	conf := minirpc.ClientConf{
+		Etcd:     discover.EtcdConf{Hosts: []string{"127.0.0.1:2379"}},
+		Target:   *target,
+		Service:  "EchoServer",
+		LbPolicy: minirpc.KetamaWeightName,
+		Insecure: true,
+	}
+	var files []string
+	if len(*confFile) > 0 {
+		files = append(files, *confFile)
+	}
+	if err := minirpc.LoadConf(&conf, files...); err != nil {
+		panic(err)
+	}
 	f, _ := os.Create("cpuhash.pprof")
 	mem, _ := os.Create("memhash.pprof")
 	pprof.StartCPUProfile(f)
 	defer pprof.StopCPUProfile()
 	defer pprof.WriteHeapProfile(mem)
-	cc, _ := minirpc.DialContext(context.Background(),
-		"etcd://EchoServer",
-		minirpc.WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())),
-		minirpc.WithEtcdHosts(endpoints),
-		minirpc.WithLoadBalancer(minirpc.KetamaWeightName))
-	time.Sleep(2 * time.Second)
-	cli := echo.NewEchoServerClient(cc)
+	client, err := minirpc.NewClientFromConf(context.Background(), conf)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err = client.WaitForReady(ctx, 1)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	cli := echo.NewEchoServerClient(client.Conn())
 	for range 30 {
 		ctx := minirpc.RequestScopeHashKey(context.Background(), "123")
 		resp, err := cli.Echo(ctx,
@@ -36,7 +60,7 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		fmt.Printf("receive respond: %s \n", resp.Msg)
+		logger.Info("echo replied", logx.F("msg", resp.Msg))
 		time.Sleep(time.Second)
 	}
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"gamerouter/discover"
+	"gamerouter/logx"
 	"gamerouter/minirpc"
 	echo "gamerouter/minirpc/benchmark/proto"
 	"google.golang.org/grpc"
@@ -15,10 +17,17 @@ import (
 
 var (
 	RouterServiceName = "EchoServer"
-	endpoints         = []string{"127.0.0.1:2379"}
+	confFile          = flag.String("f", "", "YAML, TOML or JSON conf file of the etcd hosts, see minirpc.LoadConf")
 	addrPattern       = "localhost:%d"
 	startPort         = flag.Int("startPort", 60000, "server start port")
 	num               = flag.Int("num", 10, "server number")
+	register          = flag.Bool("register", true, "register the servers in etcd, disable for static:// clients")
+)
+
+var (
+	// etcd is loaded by main
+	etcd   discover.EtcdConf
+	logger = logx.Named("benchmark")
 )
 
 type Server struct {
@@ -39,21 +48,40 @@ func startAServer(port int, wg *sync.WaitGroup) {
 	if err != nil {
 		log.Fatalf("failed to addr %s: %v", addr, err)
 	}
-	fmt.Printf("router is listening at %s\n", listen.Addr().String())
+	logger.Info("echo server is listening", logx.F("addr", listen.Addr().String()))
 	srv := grpc.NewServer()
 	echo.RegisterEchoServerServer(srv, Server{listen: listen})
 
-	if err = minirpc.Serve(srv, listen,
-		minirpc.WithServerNamespace(minirpc.DefaultNamespace),
-		minirpc.WithServiceName(RouterServiceName),
-		minirpc.WithEtcdEndPoints(endpoints)); err != nil {
-		log.Printf("lisen err: %v", err)
+	if !*register {
+		err = srv.Serve(listen)
+	} else {
+		err = minirpc.Serve(srv, listen,
+			minirpc.WithServerNamespace(minirpc.DefaultNamespace),
+			minirpc.WithServiceName(RouterServiceName),
+			minirpc.WithEtcdEndPoints(etcd.Hosts))
+	}
+	if err != nil {
+		logger.Error("echo server stopped serving", logx.F("addr", addr),
+			logx.Err(err))
 	}
 	wg.Done()
 }
 
 func main() {
 	flag.Parse()
+	conf := minirpc.ServerConf{
+		Etcd:       discover.EtcdConf{Hosts: []string{"127.0.0.1:2379"}},
+		ServerName: RouterServiceName,
+	}
+	var files []string
+	if len(*confFile) > 0 {
+		files = append(files, *confFile)
+	}
+	if err := minirpc.LoadConf(&conf, files...); err != nil {
+		log.Fatal(err)
+	}
+	etcd, RouterServiceName = conf.Etcd, conf.ServerName
+	discover.SetAccount(etcd)
 	offset := *startPort
 	var wg sync.WaitGroup
 	wg.Add(*num)
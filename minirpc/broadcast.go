@@ -0,0 +1,145 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"sync"
+	"time"
+)
+
+const defaultBroadcastConcurrency = 16
+
+type (
+	// BroadcastResult is the outcome of a broadcast call on one instance.
+	BroadcastResult[T any] struct {
+		Instance ServerInfo
+		Reply    T
+		Err      error
+	}
+
+	BroadcastOption func(options *broadcastOptions)
+
+	broadcastOptions struct {
+		filter      func(ServerInfo) bool
+		concurrency int
+		timeout     time.Duration
+		callOptions []grpc.CallOption
+	}
+)
+
+// WithBroadcastFilter only calls the instances for which filter is true.
+func WithBroadcastFilter(filter func(ServerInfo) bool) BroadcastOption {
+	return func(options *broadcastOptions) {
+		options.filter = filter
+	}
+}
+
+// WithBroadcastSelector only calls the instances whose ServerMetadata
+// matches selector, see ParseSelector for the syntax.
+func WithBroadcastSelector(selector Selector) BroadcastOption {
+	return WithBroadcastFilter(func(info ServerInfo) bool {
+		return selector.Matches(info.ServerMetadata)
+	})
+}
+
+// WithBroadcastConcurrency limits the number of calls in flight, the
+// default is 16.
+func WithBroadcastConcurrency(n int) BroadcastOption {
+	return func(options *broadcastOptions) {
+		options.concurrency = n
+	}
+}
+
+// WithBroadcastTimeout bounds the whole broadcast, calls which have not
+// finished by then fail with DeadlineExceeded.
+func WithBroadcastTimeout(timeout time.Duration) BroadcastOption {
+	return func(options *broadcastOptions) {
+		options.timeout = timeout
+	}
+}
+
+// WithBroadcastCallOptions passes opts to every call. The calls run
+// concurrently, so options writing an output of the call, such as
+// grpc.Header, grpc.Trailer and grpc.Peer, make Broadcast fail.
+func WithBroadcastCallOptions(opts ...grpc.CallOption) BroadcastOption {
+	return func(options *broadcastOptions) {
+		options.callOptions = opts
+	}
+}
+
+// Broadcast invokes the unary method on every instance resolved by cc and
+// gathers the replies, e.g. to send a GM command to all game servers:
+//
+//	results, err := minirpc.Broadcast(ctx, cc, "/gm.GM/Reload", req,
+//		func() *gm.ReloadReply { return new(gm.ReloadReply) })
+//
+// The returned error only reports failures to list the instances, errors of
+// the calls are in the results, which follow the order of Instances.
+func Broadcast[T any](
+	ctx context.Context,
+	cc *grpc.ClientConn,
+	method string,
+	req any,
+	newReply func() T,
+	opts ...BroadcastOption,
+) ([]BroadcastResult[T], error) {
+	options := &broadcastOptions{concurrency: defaultBroadcastConcurrency}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.concurrency <= 0 {
+		options.concurrency = 1
+	}
+	for _, opt := range options.callOptions {
+		switch opt.(type) {
+		case grpc.HeaderCallOption, grpc.TrailerCallOption, grpc.PeerCallOption:
+			return nil, fmt.Errorf("broadcast call option %T is not supported", opt)
+		}
+	}
+	instances, err := Instances(cc)
+	if err != nil {
+		return nil, err
+	}
+	if options.filter != nil {
+		instances = filterBy(instances, options.filter)
+	}
+	if options.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.timeout)
+		defer cancel()
+	}
+
+	results := make([]BroadcastResult[T], len(instances))
+	sem := make(chan struct{}, options.concurrency)
+	var wg sync.WaitGroup
+	for i, info := range instances {
+		results[i].Instance = info
+		if len(info.InstanceID) == 0 {
+			results[i].Err = fmt.Errorf("instance %s has no id",
+				instanceAddr(info))
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(res *BroadcastResult[T]) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			reply := newReply()
+			res.Err = cc.Invoke(RequestScopeInstanceID(ctx, res.Instance.InstanceID),
+				method, req, reply, options.callOptions...)
+			if res.Err == nil {
+				res.Reply = reply
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,75 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	var infos []ServerInfo
+	for i := 0; i < 5; i++ {
+		infos = append(infos, ServerInfo{
+			Host: "gs", Port: i, Weight: 1, InstanceID: fmt.Sprintf("gs-%d", i),
+			ServerMetadata: map[string]string{"odd": fmt.Sprint(i%2 == 1)},
+		})
+	}
+	c := newBufCluster(t, infos)
+	c.connect(t)
+	c.stop("gs:4")
+
+	ctx := context.Background()
+	newReply := func() *echo.EchoReply { return new(echo.EchoReply) }
+	results, err := Broadcast(ctx, c.cc, "/echo.EchoServer/Echo",
+		&echo.EchoRequest{}, newReply,
+		WithBroadcastConcurrency(2), WithBroadcastTimeout(5*time.Second))
+	assert.Nil(t, err)
+	assert.Len(t, results, 5)
+	var replies []string
+	for _, res := range results {
+		if res.Instance.InstanceID == "gs-4" {
+			assert.Equal(t, codes.Unavailable, status.Code(res.Err))
+			continue
+		}
+		assert.Nil(t, res.Err)
+		assert.Equal(t, instanceAddr(res.Instance), res.Reply.GetMsg())
+		replies = append(replies, res.Reply.GetMsg())
+	}
+	sort.Strings(replies)
+	assert.Equal(t, []string{"gs:0", "gs:1", "gs:2", "gs:3"}, replies)
+
+	selector, err := ParseSelector("odd=true")
+	assert.Nil(t, err)
+	results, err = Broadcast(ctx, c.cc, "/echo.EchoServer/Echo",
+		&echo.EchoRequest{}, newReply, WithBroadcastSelector(selector))
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	for _, res := range results {
+		assert.Nil(t, res.Err)
+	}
+
+	// the outputs would be written by every call
+	var header metadata.MD
+	_, err = Broadcast(ctx, c.cc, "/echo.EchoServer/Echo", &echo.EchoRequest{},
+		newReply, WithBroadcastCallOptions(grpc.WaitForReady(true),
+			grpc.Header(&header)))
+	assert.NotNil(t, err)
+}
+
+func TestInstancesNotMinirpc(t *testing.T) {
+	cc, err := DialContext(context.Background(), "passthrough:///127.0.0.1:1",
+		WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	assert.Nil(t, err)
+	defer cc.Close()
+	_, err = Instances(cc)
+	assert.NotNil(t, err)
+}
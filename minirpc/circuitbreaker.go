@@ -0,0 +1,447 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+// circuitOpenReason marks circuit breaker errors in the gRPC status.
+const circuitOpenReason = "CIRCUIT_OPEN"
+
+// the number of buckets of the sliding window
+const circuitBuckets = 10
+
+type (
+	CircuitState int
+
+	// CircuitBreakerConfig configures the breakers of a ClientConn, one for
+	// the service and one for each instance. A breaker opens when at least
+	// MinCalls calls were made in Window and the rate of failed or slow
+	// calls reaches its threshold. After OpenDuration it lets HalfOpenCalls
+	// probes through, and closes if they all succeed.
+	CircuitBreakerConfig struct {
+		Window   time.Duration
+		MinCalls int
+		// ErrorRate counts calls failed with Unavailable, DeadlineExceeded,
+		// ResourceExhausted, Internal, Unknown or DataLoss.
+		ErrorRate float64
+		// SlowCallDuration of 0 disables the slow call threshold.
+		SlowCallDuration time.Duration
+		SlowCallRate     float64
+		OpenDuration     time.Duration
+		HalfOpenCalls    int
+	}
+
+	// CircuitStats is the state of a breaker and the calls counted in its
+	// window.
+	CircuitStats struct {
+		State     CircuitState `json:"state"`
+		Calls     int          `json:"calls"`
+		Failures  int          `json:"failures"`
+		SlowCalls int          `json:"slowCalls"`
+		// OpenedAt is the time the breaker last opened.
+		OpenedAt time.Time `json:"openedAt,omitempty"`
+	}
+
+	// CircuitBreakerStats are the breakers of a ClientConn, instances are
+	// keyed by "host:port".
+	CircuitBreakerStats struct {
+		ServiceName string                  `json:"serviceName"`
+		Service     CircuitStats            `json:"service"`
+		Instances   map[string]CircuitStats `json:"instances"`
+	}
+
+	// CircuitOpenError fails calls while a breaker is open. Its gRPC code
+	// is Unavailable, use IsCircuitOpen to tell it from other errors.
+	CircuitOpenError struct {
+		ServiceName string
+		// Instance is empty if the service breaker is open, or if the
+		// breakers of all instances are open.
+		Instance string
+	}
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *CircuitState) UnmarshalText(text []byte) error {
+	for _, state := range []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+		if string(text) == state.String() {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown circuit state %q", text)
+}
+
+func (e *CircuitOpenError) Error() string {
+	if len(e.Instance) > 0 {
+		return fmt.Sprintf("circuit breaker of %s instance %s is open",
+			e.ServiceName, e.Instance)
+	}
+	return fmt.Sprintf("circuit breaker of %s is open", e.ServiceName)
+}
+
+func (e *CircuitOpenError) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, e.Error())
+	if ds, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: circuitOpenReason,
+		Domain: "minirpc",
+		Metadata: map[string]string{
+			"service":  e.ServiceName,
+			"instance": e.Instance,
+		},
+	}); err == nil {
+		return ds
+	}
+	return st
+}
+
+// IsCircuitOpen tells whether a call failed fast because of an open
+// circuit breaker.
+func IsCircuitOpen(err error) bool {
+	var openErr *CircuitOpenError
+	if errors.As(err, &openErr) {
+		return true
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == circuitOpenReason {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCircuitBreaker enables circuit breakers, zero fields of conf take
+// defaults: a 10s window, 20 calls, an error rate of 0.5, a slow call rate
+// of 0.5, 5s open and 3 probes.
+func WithCircuitBreaker(conf CircuitBreakerConfig) DialOption {
+	return func(options *dialOptions) {
+		options.CircuitBreaker = &conf
+	}
+}
+
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if c.Window <= 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.MinCalls <= 0 {
+		c.MinCalls = 20
+	}
+	if c.ErrorRate <= 0 {
+		c.ErrorRate = 0.5
+	}
+	if c.SlowCallRate <= 0 {
+		c.SlowCallRate = 0.5
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = 5 * time.Second
+	}
+	if c.HalfOpenCalls <= 0 {
+		c.HalfOpenCalls = 3
+	}
+	return c
+}
+
+// isBreakerFailure tells whether err counts against a breaker, errors of
+// the application such as NotFound do not.
+func isBreakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Internal, codes.Unknown, codes.DataLoss:
+		return !IsCircuitOpen(err)
+	}
+	return false
+}
+
+type circuitBucket struct {
+	start     time.Time
+	calls     int
+	failures  int
+	slowCalls int
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	conf     CircuitBreakerConfig
+	state    CircuitState
+	openedAt time.Time
+	buckets  [circuitBuckets]circuitBucket
+	// probes let through and succeeded while half-open
+	probes    int
+	succeeded int
+}
+
+func newCircuitBreaker(conf CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{conf: conf}
+}
+
+// allow tells whether a call may go through without taking a probe.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	return b.state == CircuitClosed ||
+		b.state == CircuitHalfOpen && b.probes < b.conf.HalfOpenCalls
+}
+
+// acquire is allow for a call which is made, it takes a probe while
+// half-open.
+func (b *circuitBreaker) acquire(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	switch b.state {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if b.probes < b.conf.HalfOpenCalls {
+			b.probes++
+			return true
+		}
+	}
+	return false
+}
+
+// advance moves an open breaker to half-open once OpenDuration passed.
+func (b *circuitBreaker) advance(now time.Time) {
+	if b.state == CircuitOpen && now.Sub(b.openedAt) >= b.conf.OpenDuration {
+		b.state = CircuitHalfOpen
+		b.probes = 0
+		b.succeeded = 0
+	}
+}
+
+func (b *circuitBreaker) record(now time.Time, err error, latency time.Duration) {
+	failed := isBreakerFailure(err)
+	slow := b.conf.SlowCallDuration > 0 && latency >= b.conf.SlowCallDuration
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		// a call made before the breaker opened
+		return
+	case CircuitHalfOpen:
+		if failed || slow {
+			b.open(now)
+			return
+		}
+		if b.succeeded++; b.succeeded >= b.conf.HalfOpenCalls {
+			b.state = CircuitClosed
+			b.buckets = [circuitBuckets]circuitBucket{}
+		}
+		return
+	}
+	bucket := b.bucket(now)
+	bucket.calls++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slowCalls++
+	}
+	calls, failures, slowCalls := b.counts(now)
+	if calls < b.conf.MinCalls {
+		return
+	}
+	if float64(failures) >= b.conf.ErrorRate*float64(calls) ||
+		b.conf.SlowCallDuration > 0 &&
+			float64(slowCalls) >= b.conf.SlowCallRate*float64(calls) {
+		b.open(now)
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = CircuitOpen
+	b.openedAt = now
+	b.buckets = [circuitBuckets]circuitBucket{}
+}
+
+// bucket returns the bucket of now, resetting it if it is stale.
+func (b *circuitBreaker) bucket(now time.Time) *circuitBucket {
+	width := b.conf.Window / circuitBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%circuitBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+	return bucket
+}
+
+func (b *circuitBreaker) counts(now time.Time) (calls, failures, slowCalls int) {
+	for i := range b.buckets {
+		if now.Sub(b.buckets[i].start) < b.conf.Window {
+			calls += b.buckets[i].calls
+			failures += b.buckets[i].failures
+			slowCalls += b.buckets[i].slowCalls
+		}
+	}
+	return
+}
+
+func (b *circuitBreaker) stats(now time.Time) CircuitStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	s := CircuitStats{State: b.state, OpenedAt: b.openedAt}
+	s.Calls, s.Failures, s.SlowCalls = b.counts(now)
+	return s
+}
+
+// breakerGroup holds the breakers of a ClientConn. It outlives the
+// balancer, which is closed while the ClientConn is idle.
+type breakerGroup struct {
+	serviceName string
+	conf        CircuitBreakerConfig
+	service     *circuitBreaker
+	mu          sync.Mutex
+	instances   map[string]*circuitBreaker
+}
+
+func newBreakerGroup(serviceName string, conf CircuitBreakerConfig) *breakerGroup {
+	conf = conf.withDefaults()
+	return &breakerGroup{
+		serviceName: serviceName,
+		conf:        conf,
+		service:     newCircuitBreaker(conf),
+		instances:   make(map[string]*circuitBreaker),
+	}
+}
+
+// instance returns the breaker of addr, g may be nil.
+func (g *breakerGroup) instance(addr string) *circuitBreaker {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.instances[addr]
+	if !ok {
+		b = newCircuitBreaker(g.conf)
+		g.instances[addr] = b
+	}
+	return b
+}
+
+// allow tells whether addr may be picked.
+func (g *breakerGroup) allow(addr string, now time.Time) bool {
+	return g == nil || g.instance(addr).allow(now)
+}
+
+// retain drops the breakers of instances which are gone.
+func (g *breakerGroup) retain(infos []ServerInfo) {
+	if g == nil {
+		return
+	}
+	known := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		known[instanceAddr(info)] = true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr := range g.instances {
+		if !known[addr] {
+			delete(g.instances, addr)
+		}
+	}
+}
+
+// track makes the instance breaker of a picked SubConn count the call, it
+// returns false if the breaker lets no call through, e.g. when the probes
+// of a half-open breaker are taken by concurrent picks.
+func (g *breakerGroup) track(addr string, res balancer.PickResult) (balancer.PickResult, bool) {
+	b := g.instance(addr)
+	start := time.Now()
+	if !b.acquire(start) {
+		return res, false
+	}
+	done := res.Done
+	res.Done = func(info balancer.DoneInfo) {
+		b.record(time.Now(), info.Err, time.Since(start))
+		if done != nil {
+			done(info)
+		}
+	}
+	return res, true
+}
+
+func (g *breakerGroup) stats() *CircuitBreakerStats {
+	now := time.Now()
+	s := &CircuitBreakerStats{
+		ServiceName: g.serviceName,
+		Service:     g.service.stats(now),
+		Instances:   make(map[string]CircuitStats),
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr, b := range g.instances {
+		s.Instances[addr] = b.stats(now)
+	}
+	return s
+}
+
+// UnaryClientInterceptor fails calls fast while the service breaker is
+// open.
+func (g *breakerGroup) UnaryClientInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply any,
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	start := time.Now()
+	if !g.service.acquire(start) {
+		return &CircuitOpenError{ServiceName: g.serviceName}
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	g.service.record(time.Now(), err, time.Since(start))
+	return err
+}
+
+// CircuitBreakers returns the breakers of a ClientConn created by
+// DialContext with WithCircuitBreaker.
+func CircuitBreakers(cc *grpc.ClientConn) (*CircuitBreakerStats, error) {
+	n, err := getNamingBalancer(cc)
+	if err != nil {
+		return nil, err
+	}
+	n.rwMutex.RLock()
+	g := n.breakers
+	n.rwMutex.RUnlock()
+	if g == nil {
+		return nil, fmt.Errorf("%s has no circuit breaker", cc.Target())
+	}
+	return g.stats(), nil
+}
@@ -0,0 +1,218 @@
+package minirpc
+
+import (
+	"context"
+	"encoding/json"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testBreakerConfig = CircuitBreakerConfig{
+	Window:        time.Second,
+	MinCalls:      4,
+	ErrorRate:     0.5,
+	OpenDuration:  100 * time.Millisecond,
+	HalfOpenCalls: 2,
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	b := newCircuitBreaker(testBreakerConfig.withDefaults())
+	now := time.Now()
+	unavailable := status.Error(codes.Unavailable, "down")
+	notFound := status.Error(codes.NotFound, "no such player")
+
+	// application errors do not count
+	for i := 0; i < 10; i++ {
+		assert.True(t, b.acquire(now))
+		b.record(now, notFound, time.Millisecond)
+	}
+	assert.Equal(t, CircuitClosed, b.stats(now).State)
+
+	b = newCircuitBreaker(testBreakerConfig.withDefaults())
+	b.record(now, nil, 0)
+	b.record(now, unavailable, 0)
+	b.record(now, nil, 0)
+	assert.Equal(t, CircuitClosed, b.stats(now).State)
+	b.record(now, unavailable, 0)
+	assert.Equal(t, CircuitOpen, b.stats(now).State)
+	assert.False(t, b.allow(now))
+
+	// half-open lets two probes through
+	now = now.Add(testBreakerConfig.OpenDuration)
+	assert.Equal(t, CircuitHalfOpen, b.stats(now).State)
+	assert.True(t, b.acquire(now))
+	assert.True(t, b.acquire(now))
+	assert.False(t, b.acquire(now))
+	b.record(now, unavailable, 0)
+	assert.Equal(t, CircuitOpen, b.stats(now).State)
+
+	now = now.Add(testBreakerConfig.OpenDuration)
+	assert.True(t, b.acquire(now))
+	assert.True(t, b.acquire(now))
+	b.record(now, nil, 0)
+	b.record(now, nil, 0)
+	assert.Equal(t, CircuitClosed, b.stats(now).State)
+
+	// calls outside the window are forgotten
+	b.record(now, unavailable, 0)
+	b.record(now, unavailable, 0)
+	now = now.Add(2 * testBreakerConfig.Window)
+	b.record(now, unavailable, 0)
+	b.record(now, nil, 0)
+	b.record(now, nil, 0)
+	assert.Equal(t, CircuitClosed, b.stats(now).State)
+	assert.Equal(t, 3, b.stats(now).Calls)
+}
+
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	conf := testBreakerConfig
+	conf.SlowCallDuration = 50 * time.Millisecond
+	b := newCircuitBreaker(conf.withDefaults())
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		b.record(now, nil, time.Duration(i)*30*time.Millisecond)
+	}
+	assert.Equal(t, CircuitOpen, b.stats(now).State)
+}
+
+func TestPickerCircuitBreaker(t *testing.T) {
+	infos := retryInfos(3)
+	p := newTestPicker(t, infos)
+	p.balancer.breakers = newBreakerGroup("test", testBreakerConfig)
+	now := time.Now()
+	for _, addr := range []string{"10.0.0.1:8000", "10.0.0.1:8001"} {
+		p.balancer.breakers.instance(addr).open(now)
+	}
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		assert.Nil(t, err)
+		assert.Equal(t, "10.0.0.1:8002", res.SubConn.(*fakeSubConn).addr)
+		res.Done(balancer.DoneInfo{})
+	}
+
+	// pinned calls fail fast
+	_, err := p.Pick(balancer.PickInfo{Ctx: RequestScopeInstanceID(ctx, "")})
+	assert.True(t, IsCircuitOpen(err))
+
+	p.balancer.breakers.instance("10.0.0.1:8002").open(now)
+	_, err = p.Pick(balancer.PickInfo{Ctx: ctx})
+	assert.True(t, IsCircuitOpen(err))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestPickerHalfOpenProbes(t *testing.T) {
+	p := newTestPicker(t, retryInfos(1))
+	p.balancer.breakers = newBreakerGroup("test", testBreakerConfig)
+	b := p.balancer.breakers.instance("10.0.0.1:8000")
+	b.open(time.Now().Add(-testBreakerConfig.OpenDuration))
+
+	// concurrent picks take at most HalfOpenCalls probes
+	const picks = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var probes []balancer.PickResult
+	start := make(chan struct{})
+	for i := 0; i < picks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+			if err != nil {
+				assert.True(t, IsCircuitOpen(err), err)
+				return
+			}
+			mu.Lock()
+			probes = append(probes, res)
+			mu.Unlock()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if !assert.Len(t, probes, testBreakerConfig.HalfOpenCalls) {
+		return
+	}
+	// a pick which found the breaker usable before the probes were taken
+	_, ok := p.balancer.breakers.track("10.0.0.1:8000", balancer.PickResult{})
+	assert.False(t, ok)
+
+	// the breaker closes once every probe succeeded
+	probes[0].Done(balancer.DoneInfo{})
+	assert.Equal(t, CircuitHalfOpen, b.stats(time.Now()).State)
+	probes[1].Done(balancer.DoneInfo{})
+	assert.Equal(t, CircuitClosed, b.stats(time.Now()).State)
+}
+
+func TestCircuitBreakerCluster(t *testing.T) {
+	c := newBufCluster(t, retryInfos(2))
+	conf := testBreakerConfig
+	conf.OpenDuration = time.Minute
+	cli := c.connect(t, WithCircuitBreaker(conf))
+	// wait for both instances, the calls also keep the service breaker
+	// closed while the failing instance is being detected
+	seen := make(map[string]bool)
+	for i := 0; i < 100 && len(seen) < 2; i++ {
+		resp, err := cli.Echo(context.Background(), &echo.EchoRequest{},
+			grpc.WaitForReady(true))
+		if assert.Nil(t, err) {
+			seen[resp.Msg] = true
+		}
+	}
+	hostCounts(t, cli, 10)
+	c.setHandler(func(_ context.Context, addr string) error {
+		if addr == "10.0.0.1:8000" {
+			return status.Error(codes.Unavailable, "down")
+		}
+		return nil
+	})
+	for i := 0; i < 40; i++ {
+		_, _ = cli.Echo(context.Background(), &echo.EchoRequest{},
+			grpc.WaitForReady(true))
+	}
+	// the failing instance is no longer picked
+	assert.Equal(t, map[string]int{"10.0.0.1": 20}, hostCounts(t, cli, 20))
+
+	stats, err := CircuitBreakers(c.cc)
+	assert.Nil(t, err)
+	assert.Equal(t, CircuitOpen, stats.Instances["10.0.0.1:8000"].State)
+	assert.Equal(t, CircuitClosed, stats.Instances["10.0.0.1:8001"].State)
+	js, err := json.Marshal(stats)
+	assert.Nil(t, err)
+	assert.Contains(t, string(js), `"state":"open"`)
+
+	// picker errors keep their details through gRPC
+	c.setHandler(func(context.Context, string) error {
+		return status.Error(codes.Unavailable, "down")
+	})
+	// the calls made so far have to be outweighed
+	for i := 0; i < 100; i++ {
+		_, err = cli.Echo(context.Background(), &echo.EchoRequest{})
+	}
+	assert.True(t, IsCircuitOpen(err), err)
+}
+
+func TestServiceCircuitBreaker(t *testing.T) {
+	g := newBreakerGroup("test", testBreakerConfig)
+	calls := 0
+	invoker := func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+		calls++
+		return status.Error(codes.DeadlineExceeded, "slow")
+	}
+	for i := 0; i < 10; i++ {
+		err := g.UnaryClientInterceptor(context.Background(), echoMethod,
+			nil, nil, nil, invoker)
+		if i >= 4 {
+			assert.True(t, IsCircuitOpen(err))
+		}
+	}
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, CircuitOpen, g.stats().Service.State)
+}
@@ -2,24 +2,15 @@ package minirpc
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"gamerouter/discover"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/resolver"
+	"net/url"
+	"strconv"
 	"strings"
-)
-
-type (
-	ClientConf struct {
-		Etcd discover.EtcdConf
-	}
-
-	Client interface {
-		Conn() *grpc.ClientConn
-	}
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -31,11 +22,16 @@ const (
         }
     ]
 }`
-	optionsKey = "options"
+	// connKey is the target query parameter of the ConnID
+	connKey = "conn"
 )
 
+var connSeq atomic.Int64
+
 func init() {
 	resolver.Register(&etcdResolverBuilder{})
+	resolver.Register(&staticResolverBuilder{})
+	resolver.Register(&fileResolverBuilder{})
 	balancer.Register(&balancerBuilder{})
 }
 
@@ -45,18 +41,333 @@ func DialContext(ctx context.Context, target string, opts ...DialOption) (conn *
 		opt(options)
 	}
 
-	if !strings.HasPrefix(target, EtcdScheme) {
+	if !isNamingTarget(target) {
+		if options.interceptors != nil {
+			unary, stream := options.interceptors.clientInterceptors(target)
+			options.gRPCDialOptions = append(options.gRPCDialOptions,
+				grpc.WithChainUnaryInterceptor(unary),
+				grpc.WithChainStreamInterceptor(stream))
+		}
 		return grpc.DialContext(ctx, target, options.gRPCDialOptions...)
 	}
 	if len(options.Namespace) == 0 {
 		options.Namespace = DefaultNamespace
 	}
+	if _, err = options.selector(); err != nil {
+		return nil, err
+	}
+	if err = options.validateRetry(); err != nil {
+		return nil, err
+	}
 
+	// the etcd balancer goes first, so that a service config passed by
+	// WithGRPCDialOptions takes precedence, e.g. to use weight_random.
 	lbStr := fmt.Sprintf(lbConfig, EtcdScheme)
+	options.gRPCDialOptions = append([]grpc.DialOption{
+		grpc.WithDefaultServiceConfig(lbStr)}, options.gRPCDialOptions...)
+	target = buildTarget(target, options)
+	// the resolvers of the ClientConn get options as is, with their
+	// callbacks and other unserializable values
+	options.gRPCDialOptions = append(options.gRPCDialOptions,
+		grpc.WithResolvers(options.resolverBuilders(ctx)...))
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	serviceName, _, _ := parseHost(u.Host)
 	options.gRPCDialOptions = append(options.gRPCDialOptions,
-		grpc.WithDefaultServiceConfig(lbStr))
-	jsonConfig, err := json.Marshal(options)
-	endpoint := base64.URLEncoding.EncodeToString(jsonConfig)
-	target = fmt.Sprintf("%s?%s=%s", target, optionsKey, endpoint)
-	return grpc.DialContext(ctx, target, options.gRPCDialOptions...)
+		options.chainOptions(serviceName)...)
+	conn, err = grpc.DialContext(ctx, target, options.gRPCDialOptions...)
+	if err != nil || options.BlockTimeout <= 0 {
+		return conn, err
+	}
+	blockCtx, cancel := context.WithTimeout(ctx, options.BlockTimeout)
+	defer cancel()
+	if err = waitForReady(blockCtx, conn, options.BlockMinInstances); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Client is a connection to a service, it owns the grpc.ClientConn and the
+// registry watches and router connection of its resolver, all released by
+// Close.
+type Client struct {
+	cc *grpc.ClientConn
+}
+
+// readyPollInterval is how often WaitForReady checks the balancer.
+var readyPollInterval = 10 * time.Millisecond
+
+// NewClient dials target, see DialContext.
+func NewClient(ctx context.Context, target string, opts ...DialOption) (*Client, error) {
+	cc, err := DialContext(ctx, target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cc: cc}, nil
+}
+
+// NewClientFromConf dials the service of conf, see DialFromConf.
+func NewClientFromConf(ctx context.Context, conf ClientConf, opts ...DialOption) (*Client, error) {
+	cc, err := DialFromConf(ctx, conf, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cc: cc}, nil
+}
+
+// Conn returns the connection to create the service stubs with.
+func (c *Client) Conn() *grpc.ClientConn {
+	return c.cc
+}
+
+// Close closes the connection and stops watching the service.
+func (c *Client) Close() error {
+	return c.cc.Close()
+}
+
+// Instances returns the resolved instances of the service.
+func (c *Client) Instances() ([]ServerInfo, error) {
+	return Instances(c.cc)
+}
+
+// WaitForReady waits until the client can pick among minInstances ready
+// instances, or ctx is done. Use it instead of sleeping after dialling.
+func (c *Client) WaitForReady(ctx context.Context, minInstances int) error {
+	return waitForReady(ctx, c.cc, minInstances)
+}
+
+func waitForReady(ctx context.Context, cc *grpc.ClientConn, minInstances int) error {
+	if minInstances < 1 {
+		minInstances = 1
+	}
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	ready := 0
+	for {
+		// the balancer is built after the first resolution
+		if n, err := getNamingBalancer(cc); err == nil {
+			if ready = n.pickable(); ready >= minInstances {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if resolverErr := resolverError(cc); resolverErr != nil {
+				return fmt.Errorf("%s: %d of %d instances ready: %w: %w",
+					cc.Target(), ready, minInstances, ctx.Err(), resolverErr)
+			}
+			return fmt.Errorf("%s: %d of %d instances ready: %w",
+				cc.Target(), ready, minInstances, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Random picks an instance at random for the calls of ctx.
+func (c *Client) Random(ctx context.Context) context.Context {
+	return RequestScopeLbPolicy(ctx, Random)
+}
+
+// WeightRandom picks an instance at random by weight for the calls of ctx.
+func (c *Client) WeightRandom(ctx context.Context) context.Context {
+	return RequestScopeLbPolicy(ctx, WeightRandom)
+}
+
+// Ketama routes the calls of ctx by key on the weighted ketama ring.
+func (c *Client) Ketama(ctx context.Context, key string) context.Context {
+	return c.hash(ctx, KetamaWeightName, key)
+}
+
+// Maglev routes the calls of ctx by key on the maglev table.
+func (c *Client) Maglev(ctx context.Context, key string) context.Context {
+	return c.hash(ctx, Maglev, key)
+}
+
+// Rendezvous routes the calls of ctx by key with rendezvous hashing.
+func (c *Client) Rendezvous(ctx context.Context, key string) context.Context {
+	return c.hash(ctx, Rendezvous, key)
+}
+
+func (c *Client) hash(ctx context.Context, policy, key string) context.Context {
+	return RequestScopeHashKey(RequestScopeLbPolicy(ctx, policy), key)
+}
+
+// Instance sends the calls of ctx to the instance id, see
+// RequestScopeInstanceID.
+func (c *Client) Instance(ctx context.Context, id string) context.Context {
+	return RequestScopeInstanceID(ctx, id)
+}
+
+// Select picks among the instances matching selector for the calls of ctx,
+// see RequestScopeDstSelector.
+func (c *Client) Select(ctx context.Context, selector string) context.Context {
+	return RequestScopeDstSelector(ctx, selector)
+}
+
+// isNamingTarget reports whether target is resolved to ServerInfo instances
+// balanced by minirpc, from etcd or without a registry.
+func isNamingTarget(target string) bool {
+	for _, scheme := range []string{EtcdScheme, StaticScheme, FileScheme} {
+		if strings.HasPrefix(target, scheme+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// chainOptions returns the interceptors of options, it is called after
+// buildTarget assigned the ConnID.
+func (o *dialOptions) chainOptions(serviceName string) []grpc.DialOption {
+	var res []grpc.DialOption
+	// hash key fields, timeouts and retries may also come from the service
+	// config in etcd
+	svcConfig := serviceConfigOf(o.ConnID)
+	// the deadlines cover the retries and hedges
+	timeouts := &timeoutInterceptor{callTimeout: o.CallTimeout, svcConfig: svcConfig}
+	interceptors := []grpc.UnaryClientInterceptor{timeouts.UnaryClientInterceptor}
+	res = append(res, grpc.WithChainStreamInterceptor(timeouts.StreamClientInterceptor))
+	if o.interceptors != nil {
+		unary, stream := o.interceptors.clientInterceptors(serviceName)
+		interceptors = append(interceptors, unary)
+		res = append(res, grpc.WithChainStreamInterceptor(stream))
+		// the picker records the attempts per instance
+		o.metrics = o.interceptors.metrics
+	}
+	// the hash key is extracted once for all attempts
+	extractor := newHashKeyExtractor(o.HashKeyFields, svcConfig)
+	extractor.skipZero = o.HashKeySkipZero
+	interceptors = append(interceptors, extractor.UnaryClientInterceptor)
+	if o.CircuitBreaker != nil {
+		// an open service breaker skips the retries
+		o.breakers = newBreakerGroup(serviceName, *o.CircuitBreaker)
+		interceptors = append(interceptors, o.breakers.UnaryClientInterceptor)
+	}
+	retry := newRetryInterceptor(o, svcConfig)
+	interceptors = append(interceptors, retry.UnaryClientInterceptor)
+	if o.AdaptiveLimit != nil {
+		// every attempt takes a slot
+		o.limiter = newAdaptiveLimiter(serviceName, *o.AdaptiveLimit)
+		interceptors = append(interceptors, o.limiter.UnaryClientInterceptor)
+	}
+	return append(res, grpc.WithChainUnaryInterceptor(interceptors...))
+}
+
+// timeoutInterceptor sets the deadline of the calls: the method timeout of
+// the service config shortens the deadline of the caller as in gRPC, the
+// call timeout applies to the calls without a deadline.
+type timeoutInterceptor struct {
+	callTimeout time.Duration
+	svcConfig   func() *ServiceConfig
+}
+
+func (t *timeoutInterceptor) withTimeout(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	if timeout := t.svcConfig().timeout(method); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	if _, ok := ctx.Deadline(); !ok && t.callTimeout > 0 {
+		return context.WithTimeout(ctx, t.callTimeout)
+	}
+	return ctx, nil
+}
+
+func (t *timeoutInterceptor) UnaryClientInterceptor(ctx context.Context, method string, req, reply any,
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, cancel := t.withTimeout(ctx, method)
+	if cancel != nil {
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (t *timeoutInterceptor) StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc,
+	cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, cancel := t.withTimeout(ctx, method)
+	if cancel == nil {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the stream outlives the call, the deadline releases the context
+	context.AfterFunc(ctx, cancel)
+	return cs, nil
+}
+
+// buildTarget gives options a unique ConnID and adds it to the target
+// query, where the balancer and connIDOf find it.
+func buildTarget(target string, options *dialOptions) string {
+	options.ConnID = strconv.FormatInt(connSeq.Add(1), 10)
+	return fmt.Sprintf("%s?%s=%s", target, connKey, options.ConnID)
+}
+
+// resolverBuilders returns the builders of the naming schemes which
+// resolve with options.
+func (o *dialOptions) resolverBuilders(ctx context.Context) []resolver.Builder {
+	return []resolver.Builder{
+		&etcdResolverBuilder{options: o, ctx: context.WithoutCancel(ctx)},
+		&staticResolverBuilder{options: o},
+		&fileResolverBuilder{options: o},
+	}
+}
+
+// connIDFromTarget returns the ConnID of the target built by buildTarget.
+func connIDFromTarget(u url.URL) string {
+	return u.Query().Get(connKey)
+}
+
+// Instances returns the instances resolved by a ClientConn created by
+// DialContext with an etcd target.
+func Instances(cc *grpc.ClientConn) ([]ServerInfo, error) {
+	n, err := getNamingBalancer(cc)
+	if err != nil {
+		return nil, err
+	}
+	n.rwMutex.RLock()
+	defer n.rwMutex.RUnlock()
+	return append([]ServerInfo(nil), n.serverInfos...), nil
+}
+
+// resolverError returns the error last reported by the resolver of a
+// ClientConn created by DialContext.
+func resolverError(cc *grpc.ClientConn) error {
+	connID, err := connIDOf(cc)
+	if err != nil {
+		return nil
+	}
+	if r, ok := namingResolvers.Load(connID); ok {
+		return r.(adminResolver).lastError()
+	}
+	return nil
+}
+
+func getNamingBalancer(cc *grpc.ClientConn) (*namingBalancer, error) {
+	// the balancer is closed while the ClientConn is idle
+	cc.Connect()
+	connID, err := connIDOf(cc)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := namingBalancers.Load(connID)
+	if !ok {
+		return nil, fmt.Errorf("no balancer for %s, it may be closed or not built yet",
+			cc.Target())
+	}
+	return n.(*namingBalancer), nil
+}
+
+func connIDOf(cc *grpc.ClientConn) (string, error) {
+	u, err := url.Parse(cc.Target())
+	if err != nil {
+		return "", err
+	}
+	connID := connIDFromTarget(*u)
+	if len(connID) == 0 {
+		return "", fmt.Errorf("%s is not dialled by minirpc", cc.Target())
+	}
+	return connID, nil
 }
@@ -2,13 +2,18 @@ package minirpc
 
 import (
 	"context"
+	"gamerouter/logx"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
+	"time"
 )
 
 const (
 	miniRequestLbHashKey = "mini.request.hashKey"
 	miniRequestLbPolicy  = "mini.request.lbPolicy"
+	miniRequestSelector  = "mini.request.selector"
+	miniRequestInstance  = "mini.request.instanceID"
+	miniRequestCaller    = "mini.request.caller"
 )
 
 func RequestScopeHashKey(ctx context.Context, key string) context.Context {
@@ -37,6 +42,52 @@ func RequestScopeLbPolicy(ctx context.Context, policy string) context.Context {
 	return metadata.AppendToOutgoingContext(ctx, miniRequestLbPolicy, policy)
 }
 
+// RequestScopeDstSelector overrides the dial time destination selector of
+// a single call, see ParseSelector for the syntax.
+func RequestScopeDstSelector(ctx context.Context, selector string) context.Context {
+	_, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(map[string]string{
+			miniRequestSelector: selector,
+		}))
+
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, miniRequestSelector, selector)
+}
+
+// RequestScopeInstanceID sends the call to the instance with the given
+// ServerInfo.InstanceID, bypassing the load balancing policy. The call fails
+// with an *InstanceUnavailableError if the instance is unknown or down.
+func RequestScopeInstanceID(ctx context.Context, id string) context.Context {
+	_, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(map[string]string{
+			miniRequestInstance: id,
+		}))
+
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, miniRequestInstance, id)
+}
+
+// RequestScopeCaller names the caller of a call, servers limit the rate of
+// each caller separately, see RateLimit.
+func RequestScopeCaller(ctx context.Context, caller string) context.Context {
+	_, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(map[string]string{
+			miniRequestCaller: caller,
+		}))
+
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, miniRequestCaller, caller)
+}
+
 type DialOption func(options *dialOptions)
 
 type dialOptions struct {
@@ -45,13 +96,44 @@ type dialOptions struct {
 	Namespace       string
 	LbPolicy        string
 	DstMetadata     map[string]string
+	DstSelector     string
 	RouteKey        string
 	HashKey         string
+	HashKeyFields   map[string]string
+	HashKeySkipZero bool
+	RetryPolicies   map[string]*RetryPolicy
+	HedgingPolicies map[string]*HedgingPolicy
+	RetryThrottling *RetryThrottling
+	CircuitBreaker  *CircuitBreakerConfig
+	AdaptiveLimit   *AdaptiveLimitConfig
+	interceptors    *interceptorOptions
+	Region          string
+	Zone            string
+	// LocalityThreshold is the ready fraction of the local zone below which
+	// traffic spills to other zones.
+	LocalityThreshold float64
+	PriorityMinReady  float64
+	PriorityFailback  time.Duration
+	CallTimeout       time.Duration
+	// see WithBlockUntilResolved
+	BlockTimeout      time.Duration
+	BlockMinInstances int
+	// ConnID identifies the ClientConn, see Instances.
+	ConnID string
+	// set by chainOptions for the balancer
+	metrics  *Metrics
+	breakers *breakerGroup
+	limiter  *adaptiveLimiter
+	// the loggers of WithLogger
+	logger    logx.Logger
+	hotLogger logx.Logger
 }
 
+// WithGRPCDialOptions adds gRPC dial options, e.g. the transport
+// credentials. It may be given several times.
 func WithGRPCDialOptions(opts ...grpc.DialOption) DialOption {
 	return func(options *dialOptions) {
-		options.gRPCDialOptions = opts
+		options.gRPCDialOptions = append(options.gRPCDialOptions, opts...)
 	}
 }
 
@@ -73,14 +155,107 @@ func WithLoadBalancer(lb string) DialOption {
 	}
 }
 
+// WithDstMetadata only routes to instances whose ServerMetadata contains
+// all the given key/value pairs.
 func WithDstMetadata(metadata map[string]string) DialOption {
 	return func(options *dialOptions) {
 		options.DstMetadata = metadata
 	}
 }
 
+// WithDstSelector only routes to instances whose ServerMetadata matches
+// selector, see ParseSelector for the syntax. It is combined with
+// WithDstMetadata.
+func WithDstSelector(selector string) DialOption {
+	return func(options *dialOptions) {
+		options.DstSelector = selector
+	}
+}
+
+// WithLocality declares the locality of the client, calls prefer instances
+// in the same zone, then the same region.
+func WithLocality(region, zone string) DialOption {
+	return func(options *dialOptions) {
+		options.Region = region
+		options.Zone = zone
+	}
+}
+
+// WithLocalityThreshold spills traffic out of the local zone or region once
+// less than threshold of its instances are ready, the default is 0.7.
+func WithLocalityThreshold(threshold float64) DialOption {
+	return func(options *dialOptions) {
+		options.LocalityThreshold = threshold
+	}
+}
+
+// WithPriorityFailover tunes the failover between ServerInfo.Priority
+// levels. A level is healthy when at least minReady of its instances are
+// ready, traffic fails back to a recovered level only after it has been
+// healthy for failback. The defaults are 0.5 and 10s.
+func WithPriorityFailover(minReady float64, failback time.Duration) DialOption {
+	return func(options *dialOptions) {
+		options.PriorityMinReady = minReady
+		options.PriorityFailback = failback
+	}
+}
+
+// WithCallTimeout sets the deadline of the unary calls made without one,
+// retries and hedges included.
+func WithCallTimeout(timeout time.Duration) DialOption {
+	return func(options *dialOptions) {
+		options.CallTimeout = timeout
+	}
+}
+
+// WithBlockUntilResolved makes DialContext wait until minInstances
+// instances are resolved and ready, rather than failing the first calls
+// while the resolver loads. DialContext fails after timeout with the last
+// resolver error, e.g. ErrServiceNotFound.
+func WithBlockUntilResolved(timeout time.Duration, minInstances int) DialOption {
+	return func(options *dialOptions) {
+		options.BlockTimeout = timeout
+		options.BlockMinInstances = minInstances
+	}
+}
+
+// WithLogger logs the resolver and balancer events of the ClientConn to
+// l rather than to the minirpc logger of logx.
+func WithLogger(l logx.Logger) DialOption {
+	return func(options *dialOptions) {
+		options.logger = l
+		options.hotLogger = logx.RateLimited(l, hotLogInterval)
+	}
+}
+
+// log returns the logger of the ClientConn, o may be nil.
+func (o *dialOptions) log() logx.Logger {
+	if o == nil || o.logger == nil {
+		return logger
+	}
+	return o.logger
+}
+
+// hotLog returns the rate limited logger of the ClientConn, o may be nil.
+func (o *dialOptions) hotLog() logx.Logger {
+	if o == nil || o.hotLogger == nil {
+		return hotLogger
+	}
+	return o.hotLogger
+}
+
 func WithRouteKey(routeKey string) DialOption {
 	return func(options *dialOptions) {
 		options.RouteKey = routeKey
 	}
 }
+
+// selector returns the destination selector combined from DstMetadata and
+// DstSelector.
+func (o *dialOptions) selector() (Selector, error) {
+	s, err := ParseSelector(o.DstSelector)
+	if err != nil {
+		return Selector{}, err
+	}
+	return SelectorFromMap(o.DstMetadata).And(s), nil
+}
@@ -0,0 +1,166 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"gamerouter/logx"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSink records the log entries.
+type memSink struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (s *memSink) Log(level logx.Level, msg string, fields []logx.Field) {
+	entry := level.String() + " " + msg
+	for _, f := range fields {
+		entry += " " + f.Key + "=" + fmt.Sprint(f.Value)
+	}
+	s.mu.Lock()
+	s.entries = append(s.entries, entry)
+	s.mu.Unlock()
+}
+
+func (s *memSink) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.entries, "\n")
+}
+
+func TestDialOptionsReachResolver(t *testing.T) {
+	// a logger does not survive serialization, the resolver gets it as is
+	sink := &memSink{}
+	path := filepath.Join(t.TempDir(), "missing.json")
+	cc, err := DialContext(context.Background(), "file://test"+path,
+		WithLogger(logx.New(sink)),
+		WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	assert.Nil(t, err)
+	defer cc.Close()
+	assert.Contains(t, sink.String(), "warn file resolver failed to load instances service=test")
+
+	connID, err := connIDOf(cc)
+	assert.Nil(t, err)
+	assert.Equal(t, "file://test"+path+"?"+connKey+"="+connID, cc.Target())
+}
+
+func TestClient(t *testing.T) {
+	c := newBufCluster(t, retryInfos(3))
+	client, err := NewClient(context.Background(),
+		"static://test/10.0.0.1:8000,10.0.0.1:8001,10.0.0.1:8002",
+		WithGRPCDialOptions(grpc.WithContextDialer(c.dial),
+			grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, client.WaitForReady(ctx, 3))
+	infos, err := client.Instances()
+	assert.Nil(t, err)
+	assert.Len(t, infos, 3)
+
+	cli := echo.NewEchoServerClient(client.Conn())
+	for _, route := range []func(ctx context.Context, key string) context.Context{
+		client.Ketama, client.Maglev, client.Rendezvous,
+	} {
+		addrs := make(map[string]bool)
+		for i := 0; i < 10; i++ {
+			resp, err := cli.Echo(route(ctx, "player-1"), &echo.EchoRequest{})
+			if assert.Nil(t, err) {
+				addrs[resp.GetMsg()] = true
+			}
+		}
+		assert.Len(t, addrs, 1)
+	}
+	resp, err := cli.Echo(client.Instance(ctx, "10.0.0.1:8002"), &echo.EchoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:8002", resp.GetMsg())
+
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	err = client.WaitForReady(short, 4)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "3 of 4 instances ready")
+
+	assert.Nil(t, client.Close())
+	_, err = client.Instances()
+	assert.NotNil(t, err)
+}
+
+func TestBlockUntilResolved(t *testing.T) {
+	c := newBufCluster(t, retryInfos(2))
+	cc, err := DialContext(context.Background(),
+		"static://test/10.0.0.1:8000,10.0.0.1:8001",
+		WithBlockUntilResolved(5*time.Second, 2),
+		WithGRPCDialOptions(grpc.WithContextDialer(c.dial),
+			grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer cc.Close()
+	n, err := getNamingBalancer(cc)
+	assert.Nil(t, err)
+	ready := n.pickable()
+	assert.Equal(t, 2, ready)
+}
+
+func TestResolverErrors(t *testing.T) {
+	dir := t.TempDir()
+	draining := retryInfos(2)
+	for i := range draining {
+		draining[i].ServerMetadata = map[string]string{DrainingMetadata: ""}
+	}
+	drainingPath := filepath.Join(dir, "draining.json")
+	writeInstanceFile(t, drainingPath, draining)
+	emptyPath := filepath.Join(dir, "empty.json")
+	replaceFile(t, emptyPath, []byte("[]"))
+
+	for target, want := range map[string]error{
+		"file://test" + emptyPath:               ErrServiceNotFound,
+		"file://test" + drainingPath:            ErrAllInstancesDraining,
+		"static://test/10.0.0.1:8000;draining=": ErrAllInstancesDraining,
+	} {
+		_, err := DialContext(context.Background(), target,
+			WithBlockUntilResolved(100*time.Millisecond, 1),
+			WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())))
+		assert.ErrorIs(t, err, want, target)
+		assert.ErrorIs(t, err, context.DeadlineExceeded, target)
+	}
+
+	// without blocking, the calls fail with the resolver error
+	cc, err := DialContext(context.Background(), "file://test"+drainingPath,
+		WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = echo.NewEchoServerClient(cc).Echo(ctx, &echo.EchoRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), ErrAllInstancesDraining.Error())
+}
+
+func TestRegistryUnavailable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the etcd dial timeout")
+	}
+	_, err := DialContext(context.Background(), "etcd://test",
+		WithEtcdHosts([]string{"127.0.0.1:1"}),
+		WithBlockUntilResolved(7*time.Second, 1),
+		WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	assert.ErrorIs(t, err, ErrRegistryUnavailable)
+}
@@ -1,12 +1,282 @@
 package minirpc
 
-import "gamerouter/discover"
+import (
+	"context"
+	"fmt"
+	"gamerouter/discover"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"time"
+)
 
 type (
+	// ClientConf configures DialFromConf, see LoadConf. Durations are
+	// strings such as "500ms".
+	ClientConf struct {
+		Etcd discover.EtcdConf
+		// Target is the dial target, etcd://<Service> by default.
+		Target    string
+		Service   string
+		Namespace string
+		LbPolicy  string
+		// DstMetadata and DstSelector filter the instances, see
+		// WithDstMetadata and WithDstSelector.
+		DstMetadata map[string]string
+		DstSelector string
+		Region      string
+		Zone        string
+		// Timeout is the deadline of the unary calls made without one.
+		Timeout string
+		// BlockTimeout and BlockMinInstances make DialFromConf wait for the
+		// instances, see WithBlockUntilResolved.
+		BlockTimeout      string
+		BlockMinInstances int
+		// Insecure dials without transport security, otherwise pass the
+		// credentials to DialFromConf with WithGRPCDialOptions.
+		Insecure bool
+		// RetryPolicies and HedgingPolicies are keyed by full method name
+		// or AnyMethod.
+		RetryPolicies   map[string]RetryPolicy
+		HedgingPolicies map[string]HedgingPolicy
+		RetryThrottling *RetryThrottling
+		CircuitBreaker  *CircuitBreakerConf
+		AdaptiveLimit   *AdaptiveLimitConfig
+		Interceptors    InterceptorConf
+	}
+
+	// CircuitBreakerConf is CircuitBreakerConfig with string durations.
+	CircuitBreakerConf struct {
+		Window           string
+		MinCalls         int
+		ErrorRate        float64
+		SlowCallDuration string
+		SlowCallRate     float64
+		OpenDuration     string
+		HalfOpenCalls    int
+	}
+
+	// InterceptorConf enables the built-in interceptors.
+	InterceptorConf struct {
+		// Metrics records to DefaultMetrics.
+		Metrics bool
+		// AccessLog and Tracing log to the minirpc logger of logx.
+		AccessLog bool
+		Recovery  bool
+		Tracing   bool
+	}
+
+	// ServerConf configures ServeFromConf, see LoadConf.
 	ServerConf struct {
 		Etcd       discover.EtcdConf
 		ServerName string
+		// ListenOn is the address to listen on, e.g. ":8080".
+		ListenOn string
 		// optional fields
 		InstanceId string
+		Namespace  string
+		// Host is the address published to clients, the host of the
+		// listener by default.
+		Host     string
+		Weight   int
+		Priority int
+		Region   string
+		Zone     string
+		Metadata map[string]string
+		// RecordFormat is "json", the default, or "proto".
+		RecordFormat string
+		RateLimits   []RateLimit
+		Interceptors InterceptorConf
 	}
 )
+
+// DialFromConf dials a service configured by conf, opts are applied after
+// the options of conf.
+func DialFromConf(ctx context.Context, conf ClientConf, opts ...DialOption) (*grpc.ClientConn, error) {
+	target := conf.Target
+	if len(target) == 0 {
+		if len(conf.Service) == 0 {
+			return nil, fmt.Errorf("client conf has neither target nor service")
+		}
+		target = EtcdScheme + "://" + conf.Service
+	}
+	confOpts, err := conf.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Etcd.User) > 0 {
+		discover.SetAccount(conf.Etcd)
+	}
+	return DialContext(ctx, target, append(confOpts, opts...)...)
+}
+
+func (c ClientConf) dialOptions() ([]DialOption, error) {
+	var opts []DialOption
+	if len(c.Etcd.Hosts) > 0 {
+		opts = append(opts, WithEtcdHosts(c.Etcd.Hosts))
+	}
+	if len(c.Namespace) > 0 {
+		opts = append(opts, WithNamespace(c.Namespace))
+	}
+	if len(c.LbPolicy) > 0 {
+		opts = append(opts, WithLoadBalancer(c.LbPolicy))
+	}
+	if len(c.DstMetadata) > 0 {
+		opts = append(opts, WithDstMetadata(c.DstMetadata))
+	}
+	if len(c.DstSelector) > 0 {
+		opts = append(opts, WithDstSelector(c.DstSelector))
+	}
+	if len(c.Region) > 0 || len(c.Zone) > 0 {
+		opts = append(opts, WithLocality(c.Region, c.Zone))
+	}
+	if len(c.Timeout) > 0 {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+		opts = append(opts, WithCallTimeout(timeout))
+	}
+	if len(c.BlockTimeout) > 0 {
+		timeout, err := time.ParseDuration(c.BlockTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block timeout: %w", err)
+		}
+		opts = append(opts, WithBlockUntilResolved(timeout, c.BlockMinInstances))
+	}
+	if c.Insecure {
+		opts = append(opts, WithGRPCDialOptions(
+			grpc.WithTransportCredentials(insecure.NewCredentials())))
+	}
+	for method, policy := range c.RetryPolicies {
+		opts = append(opts, WithRetryPolicy(method, policy))
+	}
+	for method, policy := range c.HedgingPolicies {
+		opts = append(opts, WithHedgingPolicy(method, policy))
+	}
+	if c.RetryThrottling != nil {
+		opts = append(opts, WithRetryThrottling(c.RetryThrottling.MaxTokens,
+			c.RetryThrottling.TokenRatio))
+	}
+	if c.CircuitBreaker != nil {
+		conf, err := c.CircuitBreaker.config()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithCircuitBreaker(conf))
+	}
+	if c.AdaptiveLimit != nil {
+		opts = append(opts, WithAdaptiveLimit(*c.AdaptiveLimit))
+	}
+	if interceptors := c.Interceptors.options(); len(interceptors) > 0 {
+		opts = append(opts, WithInterceptors(interceptors...))
+	}
+	return opts, nil
+}
+
+func (c CircuitBreakerConf) config() (CircuitBreakerConfig, error) {
+	conf := CircuitBreakerConfig{
+		MinCalls:      c.MinCalls,
+		ErrorRate:     c.ErrorRate,
+		SlowCallRate:  c.SlowCallRate,
+		HalfOpenCalls: c.HalfOpenCalls,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"window", c.Window, &conf.Window},
+		{"slowCallDuration", c.SlowCallDuration, &conf.SlowCallDuration},
+		{"openDuration", c.OpenDuration, &conf.OpenDuration},
+	} {
+		if len(d.value) == 0 {
+			continue
+		}
+		var err error
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			return conf, fmt.Errorf("invalid circuit breaker %s: %w", d.name, err)
+		}
+	}
+	return conf, nil
+}
+
+func (c InterceptorConf) options() []InterceptorOption {
+	var opts []InterceptorOption
+	if c.Metrics {
+		opts = append(opts, WithMetrics(nil))
+	}
+	if c.AccessLog {
+		opts = append(opts, WithAccessLog(nil))
+	}
+	if c.Recovery {
+		opts = append(opts, WithRecovery())
+	}
+	if c.Tracing {
+		opts = append(opts, WithTracing(NewLogExporter(nil)))
+	}
+	return opts
+}
+
+// ServeFromConf listens on conf.ListenOn, registers the services with
+// register and serves them until the server stops. opts are added to the
+// options of conf.
+func ServeFromConf(conf ServerConf, register RegisterFn, opts ...grpc.ServerOption) error {
+	serverOpts, err := conf.serverOptions()
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", conf.ListenOn)
+	if err != nil {
+		return err
+	}
+	if len(conf.Etcd.User) > 0 {
+		discover.SetAccount(conf.Etcd)
+	}
+	var grpcOpts []grpc.ServerOption
+	if interceptors := conf.Interceptors.options(); len(interceptors) > 0 {
+		grpcOpts = append(grpcOpts, ServerInterceptors(interceptors...)...)
+	}
+	if len(conf.RateLimits) > 0 {
+		limiter := NewRateLimiter(conf.RateLimits...)
+		grpcOpts = append(grpcOpts,
+			grpc.ChainUnaryInterceptor(limiter.UnaryServerInterceptor),
+			grpc.ChainStreamInterceptor(limiter.StreamServerInterceptor))
+	}
+	srv := grpc.NewServer(append(grpcOpts, opts...)...)
+	register(srv)
+	return Serve(srv, lis, serverOpts...)
+}
+
+func (c ServerConf) serverOptions() ([]ServerOption, error) {
+	if len(c.ServerName) == 0 {
+		return nil, fmt.Errorf("server conf has no server name")
+	}
+	opts := []ServerOption{
+		WithServiceName(c.ServerName),
+		WithEtcdEndPoints(c.Etcd.Hosts),
+		WithWeight(c.Weight),
+		WithPriority(c.Priority),
+		WithServerLocality(c.Region, c.Zone),
+	}
+	if len(c.InstanceId) > 0 {
+		opts = append(opts, WithInstanceID(c.InstanceId))
+	}
+	if len(c.Namespace) > 0 {
+		opts = append(opts, WithServerNamespace(c.Namespace))
+	}
+	if len(c.Host) > 0 {
+		opts = append(opts, WithHost(c.Host))
+	}
+	if len(c.Metadata) > 0 {
+		opts = append(opts, WithServerMetadata(c.Metadata))
+	}
+	switch c.RecordFormat {
+	case "", "json":
+	case "proto":
+		opts = append(opts, WithRecordFormat(RecordProto))
+	default:
+		return nil, fmt.Errorf("unknown record format %q", c.RecordFormat)
+	}
+	return opts, nil
+}
@@ -0,0 +1,153 @@
+package minirpc
+
+import (
+	"context"
+	"gamerouter/discover"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testYAMLConf = `
+etcd:
+  hosts: [10.0.0.1:2379, 10.0.0.2:2379]
+  user: player
+service: player
+lbPolicy: weight_random
+dstMetadata:
+  version: v2
+timeout: 500ms
+retryPolicies:
+  "*":
+    maxAttempts: 3
+    initialBackoff: 10ms
+    maxBackoff: 100ms
+    backoffMultiplier: 2
+    retryableStatusCodes: [UNAVAILABLE]
+circuitBreaker:
+  window: 10s
+  minCalls: 20
+  errorRate: 0.5
+  openDuration: 5s
+interceptors:
+  metrics: true
+`
+
+const testTOMLConf = `
+lbPolicy = "ketama_hash"
+zone = "eu-1a"
+
+[etcd]
+pass = "secret"
+
+[adaptiveLimit]
+maxLimit = 100
+`
+
+func writeConf(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoadConf(t *testing.T) {
+	t.Setenv("MINIRPC_NAMESPACE", "staging")
+	t.Setenv("MINIRPC_ETCD_HOSTS", "10.0.0.3:2379, 10.0.0.4:2379")
+	t.Setenv("MINIRPC_INTERCEPTORS_RECOVERY", "true")
+	t.Setenv("MINIRPC_RETRY_THROTTLING_MAX_TOKENS", "10")
+
+	var conf ClientConf
+	assert.Nil(t, LoadConf(&conf, writeConf(t, "client.yaml", testYAMLConf),
+		writeConf(t, "client.toml", testTOMLConf)))
+	assert.Equal(t, ClientConf{
+		Etcd: discover.EtcdConf{
+			Hosts: []string{"10.0.0.3:2379", "10.0.0.4:2379"},
+			User:  "player",
+			Pass:  "secret",
+		},
+		Service:     "player",
+		Namespace:   "staging",
+		LbPolicy:    KetamaWeightName,
+		DstMetadata: map[string]string{"version": "v2"},
+		Zone:        "eu-1a",
+		Timeout:     "500ms",
+		RetryPolicies: map[string]RetryPolicy{AnyMethod: {
+			MaxAttempts:          3,
+			InitialBackoff:       "10ms",
+			MaxBackoff:           "100ms",
+			BackoffMultiplier:    2,
+			RetryableStatusCodes: []string{"UNAVAILABLE"},
+		}},
+		RetryThrottling: &RetryThrottling{MaxTokens: 10},
+		CircuitBreaker: &CircuitBreakerConf{
+			Window: "10s", MinCalls: 20, ErrorRate: 0.5, OpenDuration: "5s"},
+		AdaptiveLimit: &AdaptiveLimitConfig{MaxLimit: 100},
+		Interceptors:  InterceptorConf{Metrics: true, Recovery: true},
+	}, conf)
+
+	opts, err := conf.dialOptions()
+	assert.Nil(t, err)
+	options := &dialOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	assert.Equal(t, 500*time.Millisecond, options.CallTimeout)
+	assert.Equal(t, 10*time.Second, options.CircuitBreaker.Window)
+	assert.Equal(t, 5*time.Second, options.CircuitBreaker.OpenDuration)
+	assert.Equal(t, KetamaWeightName, options.LbPolicy)
+	assert.True(t, options.interceptors.recovery)
+	assert.NotNil(t, options.interceptors.metrics)
+}
+
+func TestLoadConfErrors(t *testing.T) {
+	var conf ServerConf
+	assert.NotNil(t, LoadConf(&conf, writeConf(t, "server.yaml", "serverNmae: x\n")))
+	assert.NotNil(t, LoadConf(&conf, writeConf(t, "server.ini", "")))
+	assert.NotNil(t, LoadConf(conf))
+
+	t.Setenv("MINIRPC_WEIGHT", "heavy")
+	assert.NotNil(t, LoadConf(&conf))
+
+	_, err := ClientConf{Service: "player", Timeout: "soon"}.dialOptions()
+	assert.NotNil(t, err)
+	_, err = DialFromConf(context.Background(), ClientConf{})
+	assert.NotNil(t, err)
+	_, err = ServerConf{ServerName: "player", RecordFormat: "xml"}.serverOptions()
+	assert.NotNil(t, err)
+}
+
+func TestEnvName(t *testing.T) {
+	for name, env := range map[string]string{
+		"LbPolicy":   "LB_POLICY",
+		"InstanceId": "INSTANCE_ID",
+		"ShortRTT":   "SHORT_RTT",
+		"Etcd":       "ETCD",
+		"HTTPServer": "HTTP_SERVER",
+	} {
+		assert.Equal(t, env, envName(name))
+	}
+}
+
+func TestDialFromConf(t *testing.T) {
+	c := newBufCluster(t, retryInfos(2))
+	conf := ClientConf{
+		Target:   "static://test/10.0.0.1:8000,10.0.0.1:8001",
+		LbPolicy: WeightRandom,
+		Timeout:  "1s",
+		Insecure: true,
+	}
+	cc, err := DialFromConf(context.Background(), conf,
+		WithGRPCDialOptions(grpc.WithContextDialer(c.dial)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	t.Cleanup(func() { _ = cc.Close() })
+	assert.Len(t, addrCounts(t, echo.NewEchoServerClient(cc), 20), 2)
+	infos, err := Instances(cc)
+	assert.Nil(t, err)
+	assert.Len(t, infos, 2)
+}
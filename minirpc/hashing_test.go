@@ -0,0 +1,204 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"stathat.com/c/consistent"
+	"strconv"
+	"testing"
+)
+
+const hashTestKeys = 100000
+
+// hashBuilder builds a lookup function for a set of nodes, so that every
+// algorithm can be measured in the same way.
+type hashBuilder func(nodes []string, weights []int) func(key string) string
+
+var hashBuilders = []struct {
+	name  string
+	build hashBuilder
+}{
+	{KetamaWeightName, func(nodes []string, _ []int) func(string) string {
+		c := consistent.New()
+		c.Set(nodes)
+		return func(key string) string {
+			node, _ := c.Get(key)
+			return node
+		}
+	}},
+	{Maglev, func(nodes []string, weights []int) func(string) string {
+		m := newMaglevTable(nodes, weights, maglevTableSize)
+		return func(key string) string {
+			node, _ := m.Get(key)
+			return node
+		}
+	}},
+	{Rendezvous, func(nodes []string, weights []int) func(string) string {
+		r := newRendezvous(nodes, weights)
+		return func(key string) string {
+			node, _ := r.Get(key)
+			return node
+		}
+	}},
+}
+
+func makeNodes(n int) []string {
+	nodes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, fmt.Sprintf("10.0.0.%d:8080", i))
+	}
+	return nodes
+}
+
+// movedFraction returns the fraction of keys whose owner changed.
+func movedFraction(before, after func(string) string, keys int) float64 {
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		if before(key) != after(key) {
+			moved++
+		}
+	}
+	return float64(moved) / float64(keys)
+}
+
+func TestHashBalance(t *testing.T) {
+	nodes := makeNodes(10)
+	for _, hb := range hashBuilders[1:] {
+		get := hb.build(nodes, nil)
+		counts := make(map[string]int)
+		for i := 0; i < hashTestKeys; i++ {
+			counts[get(strconv.Itoa(i))]++
+		}
+		assert.Len(t, counts, len(nodes), hb.name)
+		for node, c := range counts {
+			share := float64(c) / hashTestKeys
+			assert.InDelta(t, 0.1, share, 0.02, "%s %s", hb.name, node)
+		}
+	}
+}
+
+func TestHashWeight(t *testing.T) {
+	nodes := makeNodes(2)
+	weights := []int{1, 3}
+	for _, hb := range hashBuilders[1:] {
+		get := hb.build(nodes, weights)
+		heavy := 0
+		for i := 0; i < hashTestKeys; i++ {
+			if get(strconv.Itoa(i)) == nodes[1] {
+				heavy++
+			}
+		}
+		assert.InDelta(t, 0.75, float64(heavy)/hashTestKeys, 0.02, hb.name)
+	}
+}
+
+func TestHashRemoveNode(t *testing.T) {
+	nodes := makeNodes(10)
+	for _, hb := range hashBuilders[1:] {
+		before := hb.build(nodes, nil)
+		after := hb.build(nodes[:9], nil)
+		// only keys owned by the removed node should move, maglev allows
+		// a little extra disruption.
+		moved := movedFraction(before, after, hashTestKeys)
+		assert.Less(t, moved, 0.13, hb.name)
+		for i := 0; i < hashTestKeys; i++ {
+			key := strconv.Itoa(i)
+			if before(key) != nodes[9] && hb.name == Rendezvous {
+				assert.Equal(t, before(key), after(key))
+			}
+		}
+	}
+}
+
+func TestHashEmpty(t *testing.T) {
+	_, ok := newMaglevTable(nil, nil, maglevTableSize).Get("key")
+	assert.False(t, ok)
+	_, ok = newRendezvous(nil, nil).Get("key")
+	assert.False(t, ok)
+}
+
+func TestPickerHashPolicies(t *testing.T) {
+	infos := make([]ServerInfo, 0, 5)
+	for i := 0; i < 5; i++ {
+		infos = append(infos, ServerInfo{Host: "10.0.0.1", Port: 8000 + i, Weight: 1})
+	}
+	for _, policy := range []string{KetamaWeightName, Maglev, Rendezvous} {
+		p := newTestPicker(t, infos, WithLoadBalancer(policy))
+		ctx := RequestScopeHashKey(context.Background(), "player-42")
+		first := pickAddr(t, p, ctx)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, first, pickAddr(t, p, ctx), policy)
+		}
+	}
+}
+
+func TestPickerZeroWeight(t *testing.T) {
+	infos := []ServerInfo{
+		{Host: "10.0.0.1", Port: 8000, Weight: 2},
+		{Host: "10.0.0.1", Port: 8001, Weight: 0},
+		{Host: "10.0.0.1", Port: 8002, Weight: 1},
+	}
+	allZero := []ServerInfo{
+		{Host: "10.0.0.1", Port: 8000},
+		{Host: "10.0.0.1", Port: 8001},
+	}
+	for _, policy := range []string{WeightRandom, Maglev, Rendezvous} {
+		// instances without a weight are skipped
+		p := newTestPicker(t, infos, WithLoadBalancer(policy))
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			ctx := RequestScopeHashKey(context.Background(), strconv.Itoa(i))
+			counts[pickAddr(t, p, ctx)]++
+		}
+		assert.Zero(t, counts["10.0.0.1:8001"], policy)
+		assert.InDelta(t, 2, float64(counts["10.0.0.1:8000"])/
+			float64(counts["10.0.0.1:8002"]), 0.5, policy)
+
+		// unless none has a weight
+		p = newTestPicker(t, allZero, WithLoadBalancer(policy))
+		counts = make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			ctx := RequestScopeHashKey(context.Background(), strconv.Itoa(i))
+			counts[pickAddr(t, p, ctx)]++
+		}
+		assert.Len(t, counts, 2, policy)
+	}
+}
+
+// BenchmarkKeyMovement reports the fraction of keys which move to another
+// node when a node is added to or removed from a ten node cluster.
+func BenchmarkKeyMovement(b *testing.B) {
+	nodes := makeNodes(11)
+	for _, hb := range hashBuilders {
+		b.Run(hb.name+"/add", func(b *testing.B) {
+			var moved float64
+			for i := 0; i < b.N; i++ {
+				moved = movedFraction(hb.build(nodes[:10], nil),
+					hb.build(nodes, nil), 10000)
+			}
+			b.ReportMetric(moved*100, "moved%")
+		})
+		b.Run(hb.name+"/remove", func(b *testing.B) {
+			var moved float64
+			for i := 0; i < b.N; i++ {
+				moved = movedFraction(hb.build(nodes[:10], nil),
+					hb.build(nodes[:9], nil), 10000)
+			}
+			b.ReportMetric(moved*100, "moved%")
+		})
+	}
+}
+
+func BenchmarkHashGet(b *testing.B) {
+	nodes := makeNodes(50)
+	for _, hb := range hashBuilders {
+		get := hb.build(nodes, nil)
+		b.Run(hb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				get(strconv.Itoa(i))
+			}
+		})
+	}
+}
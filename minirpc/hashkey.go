@@ -0,0 +1,176 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"gamerouter/logx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"strings"
+	"sync"
+)
+
+// AnyMethod matches all methods in WithHashKeyField.
+const AnyMethod = "*"
+
+// WithHashKeyField uses a field of the request message as hash key of
+// method, so calls get sticky routing without RequestScopeHashKey.
+// method is the full method name such as "/echo.EchoServer/Echo" or
+// AnyMethod, fieldPath is a dotted field path which may be qualified by the
+// message name, e.g. "EchoRequest.msg" or "player_id". The last field must
+// be a singular scalar, string, bytes or enum field.
+//
+// Fields without presence, such as proto3 scalars, have their zero value as
+// key when they are not set, so all these calls go to one instance. Use
+// WithHashKeySkipZero to route them like calls without a key.
+func WithHashKeyField(method, fieldPath string) DialOption {
+	return func(options *dialOptions) {
+		if options.HashKeyFields == nil {
+			options.HashKeyFields = make(map[string]string)
+		}
+		options.HashKeyFields[method] = fieldPath
+	}
+}
+
+// WithHashKeySkipZero makes the zero values of fields without presence
+// produce no hash key in WithHashKeyField, the calls are then routed by
+// the lb policy as if they had no key.
+func WithHashKeySkipZero() DialOption {
+	return func(options *dialOptions) {
+		options.HashKeySkipZero = true
+	}
+}
+
+type hashKeyExtractor struct {
+	fields map[string]string
+	// skipZero drops the zero values of fields without presence
+	skipZero bool
+	// svcConfig returns the current service config, may be nil
+	svcConfig func() *ServiceConfig
+	// message#fieldPath -> resolved field descriptors
+	cache sync.Map
+}
+
+func newHashKeyExtractor(fields map[string]string, svcConfig func() *ServiceConfig) *hashKeyExtractor {
+	return &hashKeyExtractor{fields: fields, svcConfig: svcConfig}
+}
+
+// serviceConfigOf returns the service config of the balancer of connID.
+func serviceConfigOf(connID string) func() *ServiceConfig {
+	return func() *ServiceConfig {
+		if n, ok := namingBalancers.Load(connID); ok {
+			return n.(*namingBalancer).svcConfig.Load()
+		}
+		return nil
+	}
+}
+
+// UnaryClientInterceptor puts the configured request field into the
+// outgoing metadata, a hash key set by the caller takes precedence.
+func (e *hashKeyExtractor) UnaryClientInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply any,
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok &&
+		len(md.Get(miniRequestLbHashKey)) > 0 {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if msg, ok := req.(proto.Message); ok {
+		if key, ok := e.extract(method, msg.ProtoReflect()); ok {
+			ctx = RequestScopeHashKey(ctx, key)
+		}
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (e *hashKeyExtractor) extract(method string, msg protoreflect.Message) (string, bool) {
+	path, ok := e.fieldPath(method, msg.Descriptor())
+	if !ok {
+		return "", false
+	}
+	for i, fd := range path {
+		// fields without presence, such as proto3 scalars, have their zero
+		// value as key unless skipZero is set
+		if (fd.HasPresence() || e.skipZero) && !msg.Has(fd) {
+			return "", false
+		}
+		v := msg.Get(fd)
+		if i == len(path)-1 {
+			return v.String(), true
+		}
+		msg = v.Message()
+	}
+	return "", false
+}
+
+func (e *hashKeyExtractor) fieldPath(
+	method string,
+	desc protoreflect.MessageDescriptor,
+) ([]protoreflect.FieldDescriptor, bool) {
+	// the service config in etcd overrides WithHashKeyField
+	var fieldPath string
+	if e.svcConfig != nil {
+		fieldPath = e.svcConfig().hashKeyField(method)
+	}
+	if len(fieldPath) == 0 {
+		var ok bool
+		if fieldPath, ok = e.fields[method]; !ok {
+			fieldPath = e.fields[AnyMethod]
+		}
+	}
+	if len(fieldPath) == 0 {
+		return nil, false
+	}
+	cacheKey := string(desc.FullName()) + "#" + fieldPath
+	if cached, ok := e.cache.Load(cacheKey); ok {
+		path := cached.([]protoreflect.FieldDescriptor)
+		return path, len(path) > 0
+	}
+	path, err := resolveFieldPath(desc, fieldPath)
+	if err != nil {
+		logger.Warn("invalid hash key field", logx.F("method", method),
+			logx.Err(err))
+	}
+	e.cache.Store(cacheKey, path)
+	return path, len(path) > 0
+}
+
+// resolveFieldPath resolves a dotted field path against desc. The path may
+// start with the full or short name of desc.
+func resolveFieldPath(desc protoreflect.MessageDescriptor, fieldPath string) ([]protoreflect.FieldDescriptor, error) {
+	fieldPath = strings.TrimPrefix(fieldPath, string(desc.FullName())+".")
+	fieldPath = strings.TrimPrefix(fieldPath, string(desc.Name())+".")
+	names := strings.Split(fieldPath, ".")
+	path := make([]protoreflect.FieldDescriptor, 0, len(names))
+	for i, name := range names {
+		fd := desc.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = desc.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("no field %s in %s", name, desc.FullName())
+		}
+		if fd.IsList() || fd.IsMap() {
+			return nil, fmt.Errorf("field %s is not a singular field", fd.FullName())
+		}
+		path = append(path, fd)
+		if i == len(names)-1 {
+			if fd.Message() != nil {
+				// the text of a message is not a stable key
+				return nil, fmt.Errorf("field %s is a message", fd.FullName())
+			}
+			break
+		}
+		if fd.Message() == nil {
+			return nil, fmt.Errorf("field %s is not a message", fd.FullName())
+		}
+		desc = fd.Message()
+	}
+	return path, nil
+}
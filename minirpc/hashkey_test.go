@@ -0,0 +1,122 @@
+package minirpc
+
+import (
+	"context"
+	echo "gamerouter/minirpc/benchmark/proto"
+	router "gamerouter/router/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/typepb"
+	"testing"
+)
+
+const echoMethod = "/echo.EchoServer/Echo"
+
+func invokeHashKey(t *testing.T, e *hashKeyExtractor, ctx context.Context, method string, req any) string {
+	var key string
+	err := e.UnaryClientInterceptor(ctx, method, req, nil, nil,
+		func(ctx context.Context, _ string, _, _ any, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			if vals := md.Get(miniRequestLbHashKey); len(vals) > 0 {
+				key = vals[0]
+			}
+			return nil
+		})
+	assert.Nil(t, err)
+	return key
+}
+
+func TestHashKeyExtractor(t *testing.T) {
+	e := newHashKeyExtractor(map[string]string{
+		echoMethod:       "EchoRequest.msg",
+		"/router/Nested": "instance.host",
+		AnyMethod:        "namespace",
+	}, nil)
+	ctx := context.Background()
+
+	assert.Equal(t, "hello", invokeHashKey(t, e, ctx, echoMethod,
+		&echo.EchoRequest{Msg: "hello"}))
+	// keys set by the caller win
+	assert.Equal(t, "explicit", invokeHashKey(t, e,
+		RequestScopeHashKey(ctx, "explicit"), echoMethod,
+		&echo.EchoRequest{Msg: "hello"}))
+
+	assert.Equal(t, "10.0.0.1", invokeHashKey(t, e, ctx, "/router/Nested",
+		&router.GetOneInstanceResponse{
+			Instance: &router.ServiceInfo{Host: "10.0.0.1"},
+		}))
+	// unset messages produce no key
+	assert.Equal(t, "", invokeHashKey(t, e, ctx, "/router/Nested",
+		&router.GetOneInstanceResponse{}))
+
+	assert.Equal(t, "ns", invokeHashKey(t, e, ctx, "/router/Other",
+		&router.GetEndpointWithPrefixRequest{Namespace: "ns"}))
+}
+
+func TestHashKeyZeroValue(t *testing.T) {
+	e := newHashKeyExtractor(map[string]string{
+		echoMethod:       "msg",
+		"/router/Weight": "instance.weight",
+		"/x/Kind":        "kind",
+		"/x/Number":      "number",
+	}, nil)
+	extract := func(method string, msg proto.Message) (string, bool) {
+		return e.extract(method, msg.ProtoReflect())
+	}
+
+	// proto3 zero values are keys like the other values
+	key, ok := extract(echoMethod, &echo.EchoRequest{})
+	assert.True(t, ok)
+	assert.Equal(t, "", key)
+	key, ok = extract("/router/Weight", &router.GetOneInstanceResponse{
+		Instance: &router.ServiceInfo{}})
+	assert.True(t, ok)
+	assert.Equal(t, "0", key)
+	key, ok = extract("/x/Kind", &typepb.Field{})
+	assert.True(t, ok)
+	assert.Equal(t, "0", key)
+
+	// fields with presence produce no key when unset
+	_, ok = extract("/x/Number", &descriptorpb.FieldDescriptorProto{})
+	assert.False(t, ok)
+	key, ok = extract("/x/Number", &descriptorpb.FieldDescriptorProto{
+		Number: proto.Int32(0)})
+	assert.True(t, ok)
+	assert.Equal(t, "0", key)
+
+	// WithHashKeySkipZero drops the zero values, the set ones are kept
+	e.skipZero = true
+	_, ok = extract(echoMethod, &echo.EchoRequest{})
+	assert.False(t, ok)
+	_, ok = extract("/router/Weight", &router.GetOneInstanceResponse{
+		Instance: &router.ServiceInfo{}})
+	assert.False(t, ok)
+	key, ok = extract("/router/Weight", &router.GetOneInstanceResponse{
+		Instance: &router.ServiceInfo{Weight: 2}})
+	assert.True(t, ok)
+	assert.Equal(t, "2", key)
+	key, ok = extract("/x/Number", &descriptorpb.FieldDescriptorProto{
+		Number: proto.Int32(0)})
+	assert.True(t, ok)
+	assert.Equal(t, "0", key)
+}
+
+func TestResolveFieldPath(t *testing.T) {
+	desc := (&router.GetOneInstanceResponse{}).ProtoReflect().Descriptor()
+	for _, path := range []string{
+		"instance.weight",
+		"GetOneInstanceResponse.instance.weight",
+		"router.GetOneInstanceResponse.instance.weight",
+	} {
+		fds, err := resolveFieldPath(desc, path)
+		assert.Nil(t, err, path)
+		assert.Len(t, fds, 2)
+	}
+	for _, path := range []string{"missing", "instance", "instance.metadata", "error.x"} {
+		_, err := resolveFieldPath(desc, path)
+		assert.NotNil(t, err, path)
+	}
+}
@@ -0,0 +1,115 @@
+package minirpc
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"time"
+)
+
+// instanceUnavailableReason marks pinned instance errors in the gRPC status.
+const instanceUnavailableReason = "INSTANCE_UNAVAILABLE"
+
+// InstanceUnavailableError is returned by calls pinned with
+// RequestScopeInstanceID when the instance cannot be reached. Its gRPC code
+// is Unavailable, use AsInstanceUnavailable to get it back from the status
+// of a call.
+type InstanceUnavailableError struct {
+	ServiceName string
+	InstanceID  string
+	// Known is false if the resolver does not know the instance at all.
+	Known bool
+}
+
+func (e *InstanceUnavailableError) Error() string {
+	if !e.Known {
+		return fmt.Sprintf("instance %s of %s not found", e.InstanceID,
+			e.ServiceName)
+	}
+	return fmt.Sprintf("instance %s of %s is not ready", e.InstanceID,
+		e.ServiceName)
+}
+
+func (e *InstanceUnavailableError) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, e.Error())
+	if ds, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: instanceUnavailableReason,
+		Domain: "minirpc",
+		Metadata: map[string]string{
+			"service":  e.ServiceName,
+			"instance": e.InstanceID,
+			"known":    strconv.FormatBool(e.Known),
+		},
+	}); err == nil {
+		return ds
+	}
+	return st
+}
+
+// AsInstanceUnavailable returns the InstanceUnavailableError of a call
+// pinned with RequestScopeInstanceID, from err itself or from the details
+// of its gRPC status.
+func AsInstanceUnavailable(err error) (*InstanceUnavailableError, bool) {
+	var insErr *InstanceUnavailableError
+	if errors.As(err, &insErr) {
+		return insErr, true
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == instanceUnavailableReason {
+			known, _ := strconv.ParseBool(info.Metadata["known"])
+			return &InstanceUnavailableError{
+				ServiceName: info.Metadata["service"],
+				InstanceID:  info.Metadata["instance"],
+				Known:       known,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// IsInstanceUnavailable tells whether a call pinned with
+// RequestScopeInstanceID failed because its instance cannot be reached.
+func IsInstanceUnavailable(err error) bool {
+	_, ok := AsInstanceUnavailable(err)
+	return ok
+}
+
+// pickInstance returns the SubConn of the instance with the given ID.
+func (p *namingPicker) pickInstance(id string) (balancer.PickResult, error) {
+	for _, info := range p.knownInstances {
+		if info.InstanceID != id {
+			continue
+		}
+		addr := instanceAddr(info)
+		if sc, ok := p.readySCs[addr]; ok {
+			if !p.breakers().allow(addr, time.Now()) {
+				return balancer.PickResult{}, &CircuitOpenError{
+					ServiceName: p.serviceName(), Instance: addr}
+			}
+			return balancer.PickResult{SubConn: sc}, nil
+		}
+		if p.connecting[addr] {
+			// wait for the next picker
+			return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+		}
+		return balancer.PickResult{}, &InstanceUnavailableError{
+			ServiceName: p.serviceName(), InstanceID: id, Known: true}
+	}
+	return balancer.PickResult{}, &InstanceUnavailableError{
+		ServiceName: p.serviceName(), InstanceID: id}
+}
+
+func (p *namingPicker) serviceName() string {
+	if p.balancer == nil {
+		return ""
+	}
+	return p.balancer.serviceName
+}
@@ -0,0 +1,63 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestRequestScopeInstanceID(t *testing.T) {
+	infos := []ServerInfo{
+		{Host: "room", Port: 0, InstanceID: "room-0", Weight: 1},
+		{Host: "room", Port: 1, InstanceID: "room-1", Weight: 1},
+		{Host: "room", Port: 2, InstanceID: "room-2", Weight: 1},
+	}
+	c := newBufCluster(t, infos)
+	cli := c.connect(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pinned := RequestScopeInstanceID(ctx, "room-1")
+	for i := 0; i < 20; i++ {
+		resp, err := cli.Echo(pinned, &echo.EchoRequest{})
+		assert.Nil(t, err)
+		assert.Equal(t, "room:1", resp.GetMsg())
+	}
+
+	var insErr *InstanceUnavailableError
+	_, err := cli.Echo(RequestScopeInstanceID(ctx, "room-9"), &echo.EchoRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.True(t, errors.As(err, &insErr))
+	assert.Equal(t, "room-9", insErr.InstanceID)
+	assert.False(t, insErr.Known)
+	assert.True(t, IsInstanceUnavailable(err))
+
+	c.stop("room:1")
+	assert.Eventually(t, func() bool {
+		_, err = cli.Echo(pinned, &echo.EchoRequest{})
+		return errors.As(err, &insErr) && insErr.Known
+	}, 5*time.Second, 20*time.Millisecond)
+	// the error of the last call in the closure
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestAsInstanceUnavailable(t *testing.T) {
+	// only the status is left, e.g. after a proxy or a server returning it
+	err := status.ErrorProto(status.Convert(&InstanceUnavailableError{
+		ServiceName: "room", InstanceID: "room-1", Known: true}).Proto())
+	insErr, ok := AsInstanceUnavailable(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, &InstanceUnavailableError{
+			ServiceName: "room", InstanceID: "room-1", Known: true}, insErr)
+	}
+	assert.True(t, IsInstanceUnavailable(err))
+
+	assert.False(t, IsInstanceUnavailable(status.Error(codes.Unavailable, "down")))
+	assert.False(t, IsInstanceUnavailable(errors.New("down")))
+	assert.False(t, IsInstanceUnavailable(&CircuitOpenError{ServiceName: "room"}))
+}
@@ -0,0 +1,368 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	"gamerouter/logx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	clientHandledTotal   = "minirpc_client_handled_total"
+	clientHandlingTime   = "minirpc_client_handling_seconds"
+	clientAttemptsTotal  = "minirpc_client_attempts_total"
+	clientAttemptTime    = "minirpc_client_attempt_seconds"
+	serverHandledTotal   = "minirpc_server_handled_total"
+	serverHandlingTime   = "minirpc_server_handling_seconds"
+	clientHandledHelp    = "Calls completed by the client."
+	clientHandlingHelp   = "Latency of calls, including retries."
+	clientAttemptsHelp   = "Attempts completed by the client, per instance."
+	clientAttemptHelp    = "Latency of attempts, per instance."
+	serverHandledHelp    = "Calls completed by the server."
+	serverHandlingHelp   = "Latency of calls handled by the server."
+	panicRecoveredFormat = "panic in %s"
+)
+
+type (
+	// InterceptorOption enables a built-in interceptor, on the client with
+	// WithInterceptors and on the server with ServerInterceptors.
+	InterceptorOption func(*interceptorOptions)
+
+	interceptorOptions struct {
+		metrics   *Metrics
+		accessLog logx.Logger
+		recovery  bool
+		tracer    *tracer
+	}
+)
+
+// WithMetrics counts calls and records their latency per method and status
+// code in m, or DefaultMetrics if m is nil. Clients also record each
+// attempt per instance. Serve the metrics with ServeMetrics.
+func WithMetrics(m *Metrics) InterceptorOption {
+	return func(o *interceptorOptions) {
+		if m == nil {
+			m = DefaultMetrics
+		}
+		o.metrics = m
+	}
+}
+
+// WithAccessLog logs every call to l, or the minirpc logger of logx if
+// nil. Use logx.NewSlog or logx.NewZap to log to slog or zap.
+func WithAccessLog(l logx.Logger) InterceptorOption {
+	return func(o *interceptorOptions) {
+		if l == nil {
+			l = logger
+		}
+		o.accessLog = l
+	}
+}
+
+// WithRecovery turns panics in handlers, or in the interceptors and
+// invoker of a client, into Internal errors.
+func WithRecovery() InterceptorOption {
+	return func(o *interceptorOptions) {
+		o.recovery = true
+	}
+}
+
+// WithInterceptors enables built-in interceptors on the client, e.g.
+//
+//	minirpc.DialContext(ctx, "etcd://player", minirpc.WithInterceptors(
+//		minirpc.WithMetrics(nil), minirpc.WithAccessLog(nil)))
+func WithInterceptors(opts ...InterceptorOption) DialOption {
+	return func(options *dialOptions) {
+		if options.interceptors == nil {
+			options.interceptors = &interceptorOptions{}
+		}
+		for _, opt := range opts {
+			opt(options.interceptors)
+		}
+	}
+}
+
+// ServerInterceptors returns the gRPC options enabling built-in
+// interceptors on a server, e.g.
+//
+//	minirpc.NewServer(info, minirpc.ServerInterceptors(
+//		minirpc.WithMetrics(nil), minirpc.WithRecovery())...)
+func ServerInterceptors(opts ...InterceptorOption) []grpc.ServerOption {
+	o := &interceptorOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(o.unaryServer),
+		grpc.ChainStreamInterceptor(o.streamServer),
+	}
+}
+
+// clientInterceptors returns the client interceptors of o, which go first
+// in the chain so that they see calls as the application does.
+func (o *interceptorOptions) clientInterceptors(serviceName string) (grpc.UnaryClientInterceptor, grpc.StreamClientInterceptor) {
+	c := &clientInterceptor{interceptorOptions: o, serviceName: serviceName}
+	return c.unary, c.stream
+}
+
+type clientInterceptor struct {
+	*interceptorOptions
+	serviceName string
+}
+
+func (c *clientInterceptor) unary(
+	ctx context.Context,
+	method string,
+	req, reply any,
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) (err error) {
+	start := time.Now()
+	var p peer.Peer
+	if c.accessLog != nil {
+		opts = append(opts, grpc.Peer(&p))
+	}
+	var span *Span
+	if c.tracer != nil {
+		ctx, span = c.tracer.startClient(ctx, c.serviceName, method)
+	}
+	// a panic which is not recovered is not a completed call
+	completed := false
+	defer func() {
+		if c.recovery {
+			if r := recover(); r != nil {
+				err, completed = recovered(c.accessLog, method, r), true
+			}
+		}
+		if completed {
+			span.Finish(err)
+			c.done(ctx, method, time.Since(start), &p, err)
+		}
+	}()
+	err = invoker(ctx, method, req, reply, cc, opts...)
+	completed = true
+	return err
+}
+
+func (c *clientInterceptor) stream(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	cc *grpc.ClientConn,
+	method string,
+	streamer grpc.Streamer,
+	opts ...grpc.CallOption,
+) (cs grpc.ClientStream, err error) {
+	start := time.Now()
+	p := &peer.Peer{}
+	if c.accessLog != nil {
+		opts = append(opts, grpc.Peer(p))
+	}
+	var span *Span
+	if c.tracer != nil {
+		ctx, span = c.tracer.startClient(ctx, c.serviceName, method)
+	}
+	completed := false
+	defer func() {
+		if c.recovery {
+			if r := recover(); r != nil {
+				err, completed = recovered(c.accessLog, method, r), true
+			}
+		}
+		if completed && err != nil {
+			span.Finish(err)
+			c.done(ctx, method, time.Since(start), p, err)
+		}
+	}()
+	cs, err = streamer(ctx, desc, cc, method, opts...)
+	completed = true
+	if err != nil {
+		return nil, err
+	}
+	return newDoneClientStream(ctx, cs, desc, func(err error) {
+		span.Finish(err)
+		c.done(ctx, method, time.Since(start), p, err)
+	}), nil
+}
+
+func (c *clientInterceptor) done(ctx context.Context, method string, d time.Duration, p *peer.Peer, err error) {
+	code := status.Code(err).String()
+	if c.metrics != nil {
+		c.metrics.inc(clientHandledTotal, clientHandledHelp,
+			"service", c.serviceName, "method", method, "code", code)
+		c.metrics.observe(clientHandlingTime, clientHandlingHelp, d,
+			"service", c.serviceName, "method", method)
+	}
+	if c.accessLog != nil {
+		fields := []logx.Field{logx.F("side", "client"),
+			logx.Service(c.serviceName), logx.F("method", method),
+			logx.F("code", code), logx.F("duration", d)}
+		if p.Addr != nil {
+			fields = append(fields, logx.F("peer", p.Addr.String()))
+		}
+		logCall(ctx, c.accessLog, err, fields)
+	}
+}
+
+// doneClientStream calls done once the stream ends: at the end of the
+// responses, at the response of a stream without server streaming, or when
+// the context is done, as callers may stop reading before the end.
+type doneClientStream struct {
+	grpc.ClientStream
+	desc *grpc.StreamDesc
+	once sync.Once
+	done func(err error)
+	stop func() bool
+}
+
+func newDoneClientStream(ctx context.Context, cs grpc.ClientStream, desc *grpc.StreamDesc,
+	done func(err error)) *doneClientStream {
+	s := &doneClientStream{ClientStream: cs, desc: desc, done: done}
+	s.stop = context.AfterFunc(ctx, func() {
+		s.finish(status.FromContextError(ctx.Err()).Err())
+	})
+	return s
+}
+
+func (s *doneClientStream) finish(err error) {
+	s.once.Do(func() { s.done(err) })
+}
+
+func (s *doneClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.finish(nil)
+	case err != nil:
+		s.finish(err)
+	case !s.desc.ServerStreams:
+		// the single response, e.g. of CloseAndRecv
+		s.finish(nil)
+	default:
+		return nil
+	}
+	s.stop()
+	return err
+}
+
+func (o *interceptorOptions) unaryServer(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (resp any, err error) {
+	start := time.Now()
+	var span *Span
+	if o.tracer != nil {
+		ctx, span = o.tracer.startServer(ctx, info.FullMethod)
+	}
+	completed := false
+	defer func() {
+		if o.recovery {
+			if r := recover(); r != nil {
+				err, completed = recovered(o.accessLog, info.FullMethod, r), true
+			}
+		}
+		if completed {
+			span.Finish(err)
+			o.serverDone(ctx, info.FullMethod, time.Since(start), err)
+		}
+	}()
+	resp, err = handler(ctx, req)
+	completed = true
+	return resp, err
+}
+
+func (o *interceptorOptions) streamServer(
+	srv any,
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) (err error) {
+	start := time.Now()
+	var span *Span
+	if o.tracer != nil {
+		var ctx context.Context
+		ctx, span = o.tracer.startServer(ss.Context(), info.FullMethod)
+		ss = &tracedServerStream{ServerStream: ss, ctx: ctx}
+	}
+	completed := false
+	defer func() {
+		if o.recovery {
+			if r := recover(); r != nil {
+				err, completed = recovered(o.accessLog, info.FullMethod, r), true
+			}
+		}
+		if completed {
+			span.Finish(err)
+			o.serverDone(ss.Context(), info.FullMethod, time.Since(start), err)
+		}
+	}()
+	err = handler(srv, ss)
+	completed = true
+	return err
+}
+
+func (o *interceptorOptions) serverDone(ctx context.Context, method string, d time.Duration, err error) {
+	code := status.Code(err).String()
+	if o.metrics != nil {
+		o.metrics.inc(serverHandledTotal, serverHandledHelp,
+			"method", method, "code", code)
+		o.metrics.observe(serverHandlingTime, serverHandlingHelp, d,
+			"method", method)
+	}
+	if o.accessLog != nil {
+		fields := []logx.Field{logx.F("side", "server"),
+			logx.F("method", method), logx.F("code", code),
+			logx.F("duration", d)}
+		if caller := callerOf(ctx); len(caller) > 0 {
+			fields = append(fields, logx.F("caller", caller))
+		}
+		logCall(ctx, o.accessLog, err, fields)
+	}
+}
+
+// logCall logs a finished call, failed calls at warning level.
+func logCall(ctx context.Context, l logx.Logger, err error, fields []logx.Field) {
+	if span := SpanFromContext(ctx); span != nil {
+		fields = append(fields, logx.F("trace", span.TraceID.String()))
+	}
+	if err == nil {
+		l.Info("rpc", fields...)
+		return
+	}
+	fields = append(fields, logx.F("error", status.Convert(err).Message()))
+	l.Warn("rpc", fields...)
+}
+
+// recovered logs a panic to the access log, or the package logger if nil,
+// and returns the error reported to the caller, which does not reveal the
+// panic.
+func recovered(accessLog logx.Logger, method string, r any) error {
+	l := accessLog
+	if l == nil {
+		l = logger
+	}
+	l.Error("rpc panic", logx.F("method", method), logx.F("panic", r),
+		logx.F("stack", string(debug.Stack())))
+	return status.Errorf(codes.Internal, panicRecoveredFormat, method)
+}
+
+// recordAttempt records an attempt of a call to an instance, it is called
+// by the picker when the attempt is done.
+func (m *Metrics) recordAttempt(serviceName, method, instance string, d time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		err = status.FromContextError(err).Err()
+	}
+	m.inc(clientAttemptsTotal, clientAttemptsHelp, "service", serviceName,
+		"method", method, "instance", instance, "code", status.Code(err).String())
+	m.observe(clientAttemptTime, clientAttemptHelp, d, "service", serviceName,
+		"method", method, "instance", instance)
+}
@@ -0,0 +1,186 @@
+package minirpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"gamerouter/logx"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func metricsText(m *Metrics) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	m.write(w)
+	_ = w.Flush()
+	return buf.String()
+}
+
+func TestMetricsText(t *testing.T) {
+	m := NewMetrics()
+	m.inc("calls_total", "Calls.", "method", `/a"b`, "code", "OK")
+	m.inc("calls_total", "Calls.", "method", `/a"b`, "code", "OK")
+	m.observe("latency_seconds", "Latency.", 20*time.Millisecond, "method", "/a")
+	m.observe("latency_seconds", "Latency.", 2*time.Second, "method", "/a")
+
+	text := metricsText(m)
+	for _, line := range []string{
+		"# TYPE calls_total counter",
+		`calls_total{method="/a\"b",code="OK"} 2`,
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{method="/a",le="0.01"} 0`,
+		`latency_seconds_bucket{method="/a",le="0.025"} 1`,
+		`latency_seconds_bucket{method="/a",le="2.5"} 2`,
+		`latency_seconds_bucket{method="/a",le="+Inf"} 2`,
+		`latency_seconds_sum{method="/a"} 2.02`,
+		`latency_seconds_count{method="/a"} 2`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, text, rec.Body.String())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+}
+
+func TestServerInterceptors(t *testing.T) {
+	m := NewMetrics()
+	var logs bytes.Buffer
+	o := &interceptorOptions{}
+	for _, opt := range []InterceptorOption{WithMetrics(m),
+		WithAccessLog(logx.NewSlog(slog.New(slog.NewJSONHandler(&logs, nil)))), WithRecovery()} {
+		opt(o)
+	}
+	ctx := callerCtx("lobby")
+	_, err := o.unaryServer(ctx, nil, unaryInfo(echoMethod), okHandler)
+	assert.Nil(t, err)
+	_, err = o.unaryServer(ctx, nil, unaryInfo(echoMethod),
+		func(context.Context, any) (any, error) { panic("boom") })
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, err.Error(), "boom")
+
+	text := metricsText(m)
+	assert.Contains(t, text, `minirpc_server_handled_total{method="/echo.EchoServer/Echo",code="OK"} 1`)
+	assert.Contains(t, text, `minirpc_server_handled_total{method="/echo.EchoServer/Echo",code="Internal"} 1`)
+	assert.Contains(t, text, `minirpc_server_handling_seconds_count{method="/echo.EchoServer/Echo"} 2`)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"level":"INFO"`)
+	assert.Contains(t, lines[0], `"caller":"lobby"`)
+	assert.Contains(t, lines[1], `"msg":"rpc panic"`)
+	assert.Contains(t, lines[1], `"panic":"boom"`)
+	assert.Contains(t, lines[2], `"level":"WARN"`)
+	assert.Contains(t, lines[2], `"code":"Internal"`)
+
+	// without recovery the panic goes on and nothing is recorded
+	o.recovery = false
+	assert.Panics(t, func() {
+		_, _ = o.unaryServer(ctx, nil, unaryInfo("/x/Panic"),
+			func(context.Context, any) (any, error) { panic("boom") })
+	})
+	assert.NotContains(t, metricsText(m), "/x/Panic")
+}
+
+func TestServerStreamRecovery(t *testing.T) {
+	sink := &memSink{}
+	opts := &interceptorOptions{recovery: true, accessLog: logx.New(sink)}
+	err := opts.streamServer(nil, &fakeServerStream{ctx: context.Background()},
+		&grpc.StreamServerInfo{FullMethod: "/x/Stream"},
+		func(any, grpc.ServerStream) error { panic("boom") })
+	assert.Equal(t, codes.Internal, status.Code(err))
+	if assert.Len(t, sink.entries, 2) {
+		assert.True(t, strings.HasPrefix(sink.entries[0],
+			"error rpc panic method=/x/Stream panic=boom stack="))
+		assert.Contains(t, sink.entries[1], "code=Internal")
+	}
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestClientInterceptors(t *testing.T) {
+	c := newBufCluster(t, retryInfos(2))
+	c.setHandler(func(_ context.Context, addr string) error {
+		if addr == "10.0.0.1:8000" {
+			return status.Error(codes.Unavailable, "down")
+		}
+		return nil
+	})
+	m := NewMetrics()
+	var logs bytes.Buffer
+	cli := c.connect(t, WithInterceptors(WithMetrics(m),
+		WithAccessLog(logx.NewSlog(slog.New(slog.NewJSONHandler(&logs, nil))))),
+		WithRetryPolicy(AnyMethod, testRetryPolicy), WithRetryThrottling(100, 1))
+	for i := 0; i < 10; i++ {
+		_, err := cli.Echo(context.Background(), &echo.EchoRequest{},
+			grpc.WaitForReady(true))
+		assert.Nil(t, err)
+	}
+
+	// calls are counted once, attempts per instance
+	text := metricsText(m)
+	assert.Contains(t, text, `minirpc_client_handled_total{service="test",method="/echo.EchoServer/Echo",code="OK"} 10`)
+	assert.Contains(t, text, `minirpc_client_attempts_total{service="",method="/echo.EchoServer/Echo",instance="10.0.0.1:8001",code="OK"} 10`)
+	assert.Contains(t, text, `instance="10.0.0.1:8000",code="Unavailable"}`)
+	assert.Equal(t, 10, strings.Count(logs.String(), `"side":"client"`))
+}
+
+type fakeClientStream struct {
+	grpc.ClientStream
+}
+
+func (s *fakeClientStream) RecvMsg(any) error {
+	return nil
+}
+
+func TestClientStreamDone(t *testing.T) {
+	m := NewMetrics()
+	_, stream := (&interceptorOptions{metrics: m}).clientInterceptors("test")
+	streamer := func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string,
+		...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeClientStream{}, nil
+	}
+
+	// a client streaming call ends with its single response
+	cs, err := stream(context.Background(), &grpc.StreamDesc{ClientStreams: true},
+		nil, "/x/Upload", streamer)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, cs.RecvMsg(nil))
+	assert.Contains(t, metricsText(m),
+		`minirpc_client_handled_total{service="test",method="/x/Upload",code="OK"} 1`)
+
+	// a server stream read partially ends with its context
+	ctx, cancel := context.WithCancel(context.Background())
+	cs, err = stream(ctx, &grpc.StreamDesc{ServerStreams: true}, nil, "/x/Watch", streamer)
+	if !assert.Nil(t, err) {
+		cancel()
+		return
+	}
+	assert.Nil(t, cs.RecvMsg(nil))
+	assert.NotContains(t, metricsText(m), `method="/x/Watch"`)
+	cancel()
+	assert.Eventually(t, func() bool {
+		return strings.Contains(metricsText(m),
+			`minirpc_client_handled_total{service="test",method="/x/Watch",code="Canceled"} 1`)
+	}, time.Second, 10*time.Millisecond)
+}
@@ -4,12 +4,30 @@ import (
 	"fmt"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"stathat.com/c/consistent"
 )
 
 const KetamaWeightName = "ketama_hash"
 
 func init() {
+	RegisterPickerPolicy(KetamaWeightName, PickerBuilderFunc(newKetamaPolicy))
+}
+
+type ketamaPolicy struct {
+	*addrPicker
+	cons *consistent.Consistent
+}
+
+func newKetamaPolicy(instances []PickerInstance) PolicyPicker {
+	ap, addrs, _ := newAddrPicker(instances)
+	p := &ketamaPolicy{addrPicker: ap, cons: consistent.New()}
+	p.cons.Set(addrs)
+	return p
+}
 
+func (p *ketamaPolicy) Pick(info PickInfo) (balancer.PickResult, error) {
+	addr, err := p.cons.Get(info.HashKey)
+	return p.pickByAddr(addr, err == nil)
 }
 
 type KetamaWeightHashPickerBuilder struct {
@@ -24,17 +42,17 @@ func (k KetamaWeightHashPickerBuilder) Build(info base.PickerBuildInfo) balancer
 	}
 	nodes := make([]*Node, 0, len(info.ReadySCs))
 	for subconn, subconninfo := range info.ReadySCs {
-		weight := 1
-		m := subconninfo.Address.Attributes.Value(NodeWeight)
-		if m != nil {
-			w, ok := m.(int)
-			if ok {
-				weight = w
-			}
-		}
 		addr := subconninfo.Address.Addr
-		nodes = append(nodes, NewNode(addr, uint(weight)))
 		picker.addr2subConns[addr] = subconn
+		if weight := addressWeight(subconninfo.Address); weight > 0 {
+			nodes = append(nodes, NewNode(addr, uint(weight)))
+		}
+	}
+	if len(nodes) == 0 {
+		// no instance has a weight, they get the same share
+		for addr := range picker.addr2subConns {
+			nodes = append(nodes, NewNode(addr, 1))
+		}
 	}
 	picker.ring = NewRing(nodes)
 	return picker
@@ -0,0 +1,192 @@
+package minirpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix prefixes the environment variables read by LoadConf.
+const EnvPrefix = "MINIRPC"
+
+// LoadConf loads v, a pointer to a conf such as ClientConf or ServerConf,
+// from files in order, each overriding the keys it sets, then from the
+// environment.
+//
+// Files are YAML (.yaml, .yml), TOML (.toml) or JSON (.json). Their keys
+// match the field names case-insensitively, unknown keys are errors.
+//
+// The variable of a field is EnvPrefix followed by the path of the field
+// in upper snake case, e.g. MINIRPC_ETCD_HOSTS or MINIRPC_LB_POLICY. Lists
+// are comma separated and maps are comma separated key=value pairs, maps
+// and lists of structs are only read from files.
+func LoadConf(v any, files ...string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("conf must be a pointer to a struct, not %T", v)
+	}
+	for _, file := range files {
+		if err := loadConfFile(v, file); err != nil {
+			return fmt.Errorf("load %s: %w", file, err)
+		}
+	}
+	return loadConfEnv(rv.Elem(), EnvPrefix)
+}
+
+func loadConfFile(v any, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	// decode to JSON, so that every format uses the JSON field names
+	var doc map[string]any
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		_, err = toml.Decode(string(data), &doc)
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	default:
+		return fmt.Errorf("unknown conf format %q", ext)
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func loadConfEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := prefix + "_" + envName(field.Name)
+		fv := v.Field(i)
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			if err := loadConfEnv(fv, name); err != nil {
+				return err
+			}
+		case field.Type.Kind() == reflect.Pointer && field.Type.Elem().Kind() == reflect.Struct:
+			if !hasEnvPrefix(name + "_") {
+				continue
+			}
+			if fv.IsNil() {
+				fv.Set(reflect.New(field.Type.Elem()))
+			}
+			if err := loadConfEnv(fv.Elem(), name); err != nil {
+				return err
+			}
+		default:
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setEnvValue(fv, val); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// envName converts a field name to upper snake case, e.g. LbPolicy to
+// LB_POLICY and ShortRTT to SHORT_RTT.
+func envName(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) ||
+			i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setEnvValue(v reflect.Value, val string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return nil
+		}
+		items := splitEnvList(val)
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setEnvValue(s.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		m := reflect.MakeMap(v.Type())
+		for _, item := range splitEnvList(val) {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("%q is not key=value", item)
+			}
+			m.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
+		}
+		v.Set(m)
+	}
+	return nil
+}
+
+func splitEnvList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, EndPointSep) {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
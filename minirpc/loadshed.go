@@ -0,0 +1,163 @@
+package minirpc
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// LoadShedConfig configures a LoadShedder. Zero fields take defaults.
+	LoadShedConfig struct {
+		// MaxInFlight is the number of calls handled at once, others wait.
+		// It is required.
+		MaxInFlight int
+		// MaxQueue is the number of calls waiting, further calls are
+		// rejected at once. It defaults to MaxInFlight.
+		MaxQueue int
+		// Target is the queueing delay considered healthy, 5ms by default.
+		Target time.Duration
+		// Interval is the time a standing queue is tolerated, and the
+		// longest a call waits while the server is not overloaded. It
+		// defaults to 100ms.
+		Interval time.Duration
+	}
+
+	// LoadShedStats is the state of a LoadShedder.
+	LoadShedStats struct {
+		InFlight   int    `json:"inFlight"`
+		Queued     int    `json:"queued"`
+		Overloaded bool   `json:"overloaded"`
+		Shed       uint64 `json:"shed"`
+	}
+
+	// LoadShedder limits the calls handled at once and sheds calls which
+	// queue too long. Like CoDel, it considers the server overloaded when
+	// no call got through without queueing for more than Target during an
+	// Interval, and then lets calls wait at most Target instead of
+	// Interval. Shed calls fail with ResourceExhausted and a retry
+	// pushback. It only applies to unary calls.
+	LoadShedder struct {
+		conf  LoadShedConfig
+		slots chan struct{}
+
+		mu            sync.Mutex
+		queued        int
+		intervalStart time.Time
+		minDelay      time.Duration
+		overloaded    bool
+		shed          atomic.Uint64
+	}
+)
+
+func NewLoadShedder(conf LoadShedConfig) *LoadShedder {
+	if conf.MaxInFlight < 1 {
+		conf.MaxInFlight = 1
+	}
+	if conf.MaxQueue <= 0 {
+		conf.MaxQueue = conf.MaxInFlight
+	}
+	if conf.Target <= 0 {
+		conf.Target = 5 * time.Millisecond
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = 100 * time.Millisecond
+	}
+	return &LoadShedder{
+		conf:          conf,
+		slots:         make(chan struct{}, conf.MaxInFlight),
+		intervalStart: time.Now(),
+	}
+}
+
+// observe records the queueing delay of a call which got a slot.
+func (s *LoadShedder) observe(now time.Time, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observeLocked(now, delay)
+}
+
+func (s *LoadShedder) observeLocked(now time.Time, delay time.Duration) {
+	if now.Sub(s.intervalStart) >= s.conf.Interval {
+		s.overloaded = s.minDelay > s.conf.Target
+		s.intervalStart = now
+		s.minDelay = delay
+		return
+	}
+	s.minDelay = min(s.minDelay, delay)
+}
+
+// acquire waits for a slot.
+func (s *LoadShedder) acquire(ctx context.Context, method string) error {
+	select {
+	case s.slots <- struct{}{}:
+		s.observe(time.Now(), 0)
+		return nil
+	default:
+	}
+
+	start := time.Now()
+	s.mu.Lock()
+	if s.queued >= s.conf.MaxQueue {
+		s.mu.Unlock()
+		s.shed.Add(1)
+		return rejectCall(ctx, s.conf.Interval, "%s is overloaded, queue full",
+			method)
+	}
+	s.queued++
+	timeout := s.conf.Interval
+	if s.overloaded {
+		timeout = s.conf.Target
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case s.slots <- struct{}{}:
+	case <-timer.C:
+		s.shed.Add(1)
+		err = rejectCall(ctx, s.conf.Interval, "%s is overloaded, queued for %v",
+			method, timeout)
+	case <-ctx.Done():
+		err = status.FromContextError(ctx.Err()).Err()
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.queued--
+	s.observeLocked(now, now.Sub(start))
+	s.mu.Unlock()
+	return err
+}
+
+func (s *LoadShedder) release() {
+	<-s.slots
+}
+
+func (s *LoadShedder) UnaryServerInterceptor(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	if err := s.acquire(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return handler(ctx, req)
+}
+
+func (s *LoadShedder) Stats() LoadShedStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return LoadShedStats{
+		InFlight:   len(s.slots),
+		Queued:     s.queued,
+		Overloaded: s.overloaded,
+		Shed:       s.shed.Load(),
+	}
+}
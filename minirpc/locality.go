@@ -0,0 +1,41 @@
+package minirpc
+
+const defaultLocalityThreshold = 0.7
+
+// preferLocal narrows the ready instances to the client's zone, or else its
+// region, as long as enough instances there are ready. known holds all the
+// resolved instances, ready or not.
+func preferLocal(options *dialOptions, ready, known []ServerInfo) []ServerInfo {
+	if options == nil || (len(options.Zone) == 0 && len(options.Region) == 0) {
+		return ready
+	}
+	threshold := options.LocalityThreshold
+	if threshold <= 0 {
+		threshold = defaultLocalityThreshold
+	}
+	sameZone := func(info ServerInfo) bool {
+		return len(options.Zone) > 0 && info.Zone == options.Zone &&
+			(len(options.Region) == 0 || info.Region == options.Region)
+	}
+	sameRegion := func(info ServerInfo) bool {
+		return len(options.Region) > 0 && info.Region == options.Region
+	}
+	for _, match := range []func(ServerInfo) bool{sameZone, sameRegion} {
+		local := filterBy(ready, match)
+		total := len(filterBy(known, match))
+		if len(local) > 0 && float64(len(local)) >= threshold*float64(total) {
+			return local
+		}
+	}
+	return ready
+}
+
+func filterBy(infos []ServerInfo, match func(ServerInfo) bool) []ServerInfo {
+	res := make([]ServerInfo, 0, len(infos))
+	for _, info := range infos {
+		if match(info) {
+			res = append(res, info)
+		}
+	}
+	return res
+}
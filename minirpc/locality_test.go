@@ -0,0 +1,218 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoServer answers with its instance address.
+type echoServer struct {
+	addr    string
+	cluster *bufCluster
+	echo.UnimplementedEchoServerServer
+}
+
+func (s *echoServer) Echo(ctx context.Context, _ *echo.EchoRequest) (*echo.EchoReply, error) {
+	s.cluster.mu.Lock()
+	handler := s.cluster.handler
+	s.cluster.mu.Unlock()
+	if handler != nil {
+		if err := handler(ctx, s.addr); err != nil {
+			return nil, err
+		}
+	}
+	return &echo.EchoReply{Msg: s.addr}, nil
+}
+
+// bufCluster runs in-memory echo servers, addressed by instanceAddr of
+// their ServerInfo.
+type bufCluster struct {
+	mu        sync.Mutex
+	listeners map[string]*bufconn.Listener
+	servers   map[string]*grpc.Server
+	infos     []ServerInfo
+	// handler runs before each Echo, an error fails the call
+	handler func(ctx context.Context, addr string) error
+	// the last ClientConn made by connect
+	cc *grpc.ClientConn
+}
+
+func newBufCluster(t *testing.T, infos []ServerInfo) *bufCluster {
+	c := &bufCluster{
+		listeners: make(map[string]*bufconn.Listener),
+		servers:   make(map[string]*grpc.Server),
+		infos:     infos,
+	}
+	for _, info := range infos {
+		c.start(instanceAddr(info))
+	}
+	t.Cleanup(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, srv := range c.servers {
+			srv.Stop()
+		}
+	})
+	return c
+}
+
+// start (re)starts the server of addr.
+func (c *bufCluster) start(addr string) {
+	lis := bufconn.Listen(1 << 16)
+	srv := grpc.NewServer()
+	echo.RegisterEchoServerServer(srv, &echoServer{addr: addr, cluster: c})
+	go func() { _ = srv.Serve(lis) }()
+	c.mu.Lock()
+	c.listeners[addr] = lis
+	c.servers[addr] = srv
+	c.mu.Unlock()
+}
+
+func (c *bufCluster) setHandler(handler func(ctx context.Context, addr string) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handler = handler
+}
+
+func (c *bufCluster) dial(ctx context.Context, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	lis, ok := c.listeners[addr]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown addr %s", addr)
+	}
+	return lis.DialContext(ctx)
+}
+
+func (c *bufCluster) stop(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.servers[addr].Stop()
+	delete(c.listeners, addr)
+}
+
+// state builds the resolver state namingResolver would produce.
+func (c *bufCluster) state(options *dialOptions) resolver.State {
+	state := resolver.State{
+		Attributes: attributes.New(keyDialOptions, options).
+			WithValue(keyServerInfo, c.infos),
+	}
+	for _, info := range c.infos {
+		state.Addresses = append(state.Addresses, newAddress(info))
+	}
+	return state
+}
+
+// connect dials the cluster through namingBalancer without etcd.
+func (c *bufCluster) connect(t *testing.T, opts ...DialOption) echo.EchoServerClient {
+	return c.connectBalancer(t, EtcdScheme, opts...)
+}
+
+// connectBalancer dials the cluster with the named gRPC balancer.
+func (c *bufCluster) connectBalancer(t *testing.T, name string, opts ...DialOption) echo.EchoServerClient {
+	options := &dialOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	r := manual.NewBuilderWithScheme("bufcluster")
+	r.InitialState(c.state(options))
+	assert.Nil(t, options.validateRetry())
+	target := buildTarget(r.Scheme()+":///test", options)
+	cc, err := grpc.NewClient(target, append([]grpc.DialOption{
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(c.dial),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay: 10 * time.Millisecond, Multiplier: 1.6,
+				MaxDelay: 100 * time.Millisecond,
+			},
+			MinConnectTimeout: time.Second,
+		}),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(lbConfig, name)),
+	}, append(options.gRPCDialOptions, options.chainOptions("test")...)...)...)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = cc.Close() })
+	c.cc = cc
+	return echo.NewEchoServerClient(cc)
+}
+
+// hostCounts calls the cluster n times and counts the answers per host.
+func hostCounts(t *testing.T, cli echo.EchoServerClient, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := cli.Echo(ctx, &echo.EchoRequest{}, grpc.WaitForReady(true))
+		cancel()
+		if !assert.Nil(t, err) {
+			continue
+		}
+		counts[strings.Split(resp.Msg, ":")[0]]++
+	}
+	return counts
+}
+
+func TestLocalityFailover(t *testing.T) {
+	var infos []ServerInfo
+	for _, zone := range []string{"a", "b", "c"} {
+		for i := 0; i < 3; i++ {
+			infos = append(infos, ServerInfo{
+				Host: "zone-" + zone, Port: i, Weight: 1,
+				Region: "eu", Zone: zone,
+			})
+		}
+	}
+	c := newBufCluster(t, infos)
+	cli := c.connect(t, WithLocality("eu", "a"), WithLocalityThreshold(0.5))
+
+	// wait until every SubConn is ready
+	assert.Eventually(t, func() bool {
+		return len(hostCounts(t, cli, 50)) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	counts := hostCounts(t, cli, 100)
+	assert.Equal(t, map[string]int{"zone-a": 100}, counts)
+
+	// 2/3 of zone a is ready, still above the threshold
+	c.stop("zone-a:0")
+	assert.Eventually(t, func() bool {
+		counts := hostCounts(t, cli, 50)
+		return counts["zone-a"] == 50
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// 1/3 of zone a is ready, spill to the whole region
+	c.stop("zone-a:1")
+	assert.Eventually(t, func() bool {
+		counts := hostCounts(t, cli, 100)
+		return counts["zone-b"] > 0 && counts["zone-c"] > 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPreferLocal(t *testing.T) {
+	infos := []ServerInfo{
+		{Host: "1", Region: "eu", Zone: "a"},
+		{Host: "2", Region: "eu", Zone: "b"},
+		{Host: "3", Region: "us", Zone: "c"},
+	}
+	options := &dialOptions{Region: "eu", Zone: "a", LocalityThreshold: 0.5}
+	assert.Equal(t, infos[:1], preferLocal(options, infos, infos))
+	// zone a is down, stay in region eu
+	assert.Equal(t, infos[1:2], preferLocal(options, infos[1:], infos))
+	// nothing in eu is ready
+	assert.Equal(t, infos[2:], preferLocal(options, infos[2:], infos))
+	// no locality configured
+	assert.Equal(t, infos, preferLocal(&dialOptions{}, infos, infos))
+}
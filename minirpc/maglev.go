@@ -0,0 +1,125 @@
+package minirpc
+
+import (
+	"google.golang.org/grpc/balancer"
+	"hash/fnv"
+)
+
+const (
+	Maglev = "maglev"
+
+	// maglevTableSize must be a prime much larger than the number of
+	// instances, otherwise the table gets unbalanced.
+	maglevTableSize = 65537
+)
+
+func init() {
+	RegisterPickerPolicy(Maglev, PickerBuilderFunc(newMaglevPolicy))
+}
+
+type maglevPolicy struct {
+	*addrPicker
+	table *maglevTable
+}
+
+func newMaglevPolicy(instances []PickerInstance) PolicyPicker {
+	ap, addrs, weights := newAddrPicker(weightedInstances(instances))
+	return &maglevPolicy{
+		addrPicker: ap,
+		table:      newMaglevTable(addrs, weights, maglevTableSize),
+	}
+}
+
+func (p *maglevPolicy) Pick(info PickInfo) (balancer.PickResult, error) {
+	return p.pickByAddr(p.table.Get(info.HashKey))
+}
+
+// maglevTable is the lookup table described in the Maglev paper, extended
+// so that each node fills slots in proportion to its weight.
+type maglevTable struct {
+	nodes   []string
+	entries []int
+}
+
+// newMaglevTable builds a lookup table of the given size. size must be prime.
+func newMaglevTable(nodes []string, weights []int, size uint64) *maglevTable {
+	m := &maglevTable{
+		nodes:   nodes,
+		entries: make([]int, size),
+	}
+	if len(nodes) == 0 {
+		return m
+	}
+	offsets := make([]uint64, len(nodes))
+	skips := make([]uint64, len(nodes))
+	next := make([]uint64, len(nodes))
+	credits := make([]float64, len(nodes))
+	ratios := make([]float64, len(nodes))
+	maxWeight := 1
+	for _, w := range weights {
+		if w > maxWeight {
+			maxWeight = w
+		}
+	}
+	for i, node := range nodes {
+		offsets[i] = hashString(0, node) % size
+		skips[i] = hashString(1, node)%(size-1) + 1
+		w := 1
+		if i < len(weights) && weights[i] > 0 {
+			w = weights[i]
+		}
+		ratios[i] = float64(w) / float64(maxWeight)
+	}
+	for i := range m.entries {
+		m.entries[i] = -1
+	}
+	filled := uint64(0)
+	for {
+		for i := range nodes {
+			credits[i] += ratios[i]
+			for credits[i] >= 1 {
+				credits[i]--
+				// find the next preferred slot which is still empty
+				c := (offsets[i] + next[i]*skips[i]) % size
+				for m.entries[c] >= 0 {
+					next[i]++
+					c = (offsets[i] + next[i]*skips[i]) % size
+				}
+				m.entries[c] = i
+				next[i]++
+				filled++
+				if filled == size {
+					return m
+				}
+			}
+		}
+	}
+}
+
+// Get returns the node owning key. It returns false if the table is empty.
+func (m *maglevTable) Get(key string) (string, bool) {
+	if len(m.nodes) == 0 {
+		return "", false
+	}
+	idx := m.entries[hashString(2, key)%uint64(len(m.entries))]
+	return m.nodes[idx], true
+}
+
+// hashString hashes s with fnv-1a, seed selects one of several independent
+// hash functions.
+func hashString(seed byte, s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte{seed})
+	_, _ = h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer, it spreads fnv output over all bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,192 @@
+package minirpc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricCounter   = "counter"
+	metricHistogram = "histogram"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms in seconds.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultMetrics is used by WithMetrics(nil).
+var DefaultMetrics = NewMetrics()
+
+type (
+	// Metrics collects the metrics of the minirpc interceptors, and writes
+	// them in the Prometheus text format when served over HTTP.
+	Metrics struct {
+		mu       sync.Mutex
+		families map[string]*metricFamily
+	}
+
+	metricFamily struct {
+		name   string
+		help   string
+		typ    string
+		series map[string]*metricSeries
+	}
+
+	metricSeries struct {
+		// rendered labels, e.g. `code="OK",method="/a/b"`
+		labels string
+		// the counter value, or the sum of a histogram
+		value   float64
+		count   uint64
+		buckets []uint64
+	}
+)
+
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+// inc increments a counter, labels are name value pairs.
+func (m *Metrics) inc(name, help string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series(name, help, metricCounter, labels).value++
+}
+
+// observe adds a latency to a histogram.
+func (m *Metrics) observe(name, help string, d time.Duration, labels ...string) {
+	v := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.series(name, help, metricHistogram, labels)
+	s.value += v
+	s.count++
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (m *Metrics) series(name, help, typ string, labels []string) *metricSeries {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, typ: typ,
+			series: make(map[string]*metricSeries)}
+		m.families[name] = f
+	}
+	key := renderLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: key}
+		if typ == metricHistogram {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func renderLabels(labels []string) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	_ = bw.Flush()
+}
+
+func (m *Metrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.typ)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.typ == metricCounter {
+				fmt.Fprintf(w, "%s%s %s\n", name, braces(s.labels), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+					braces(joinLabels(s.labels, `le="`+formatFloat(bound)+`"`)),
+					s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+				braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(s.labels), formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, braces(s.labels), s.count)
+		}
+	}
+}
+
+func braces(labels string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(labels, label string) string {
+	if len(labels) == 0 {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeMetrics serves m, or DefaultMetrics if m is nil, at /metrics on
+// addr, e.g. "127.0.0.1:9090". Close the returned server to stop.
+func ServeMetrics(addr string, m *Metrics) (*http.Server, error) {
+	if m == nil {
+		m = DefaultMetrics
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = srv.Serve(lis) }()
+	return srv, nil
+}
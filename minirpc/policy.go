@@ -0,0 +1,105 @@
+package minirpc
+
+import (
+	"google.golang.org/grpc/balancer"
+	"sync"
+)
+
+type (
+	// PickerInstance is a ready instance handed to a PickerBuilder.
+	PickerInstance struct {
+		Info    ServerInfo
+		SubConn balancer.SubConn
+	}
+
+	// PickInfo is the information of the call being picked.
+	PickInfo struct {
+		balancer.PickInfo
+		// HashKey is set by RequestScopeHashKey or WithHashKeyField.
+		HashKey string
+	}
+
+	// PolicyPicker picks one of the instances it was built with. It is
+	// called concurrently.
+	PolicyPicker interface {
+		Pick(info PickInfo) (balancer.PickResult, error)
+	}
+
+	// PickerBuilder builds a PolicyPicker each time the set of ready
+	// instances changes. instances has at least one element and must not be
+	// modified.
+	PickerBuilder interface {
+		Build(instances []PickerInstance) PolicyPicker
+	}
+
+	PickerBuilderFunc func(instances []PickerInstance) PolicyPicker
+)
+
+func (f PickerBuilderFunc) Build(instances []PickerInstance) PolicyPicker {
+	return f(instances)
+}
+
+var (
+	pickerPolicies = make(map[string]PickerBuilder)
+	policyLock     sync.RWMutex
+)
+
+// RegisterPickerPolicy makes a load balancing policy of the etcd balancer
+// available to WithLoadBalancer and RequestScopeLbPolicy. Registering a
+// name twice replaces the former builder, usually it is called in init.
+func RegisterPickerPolicy(name string, builder PickerBuilder) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	pickerPolicies[name] = builder
+}
+
+func getPickerPolicy(name string) (PickerBuilder, bool) {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	builder, ok := pickerPolicies[name]
+	return builder, ok
+}
+
+// addrPicker maps the node keys used by hashing policies to SubConns.
+type addrPicker struct {
+	subConns map[string]balancer.SubConn
+}
+
+func newAddrPicker(instances []PickerInstance) (*addrPicker, []string, []int) {
+	p := &addrPicker{subConns: make(map[string]balancer.SubConn, len(instances))}
+	addrs := make([]string, 0, len(instances))
+	weights := make([]int, 0, len(instances))
+	for _, ins := range instances {
+		addr := instanceAddr(ins.Info)
+		p.subConns[addr] = ins.SubConn
+		addrs = append(addrs, addr)
+		weights = append(weights, ins.Info.Weight)
+	}
+	return p, addrs, weights
+}
+
+// weightedInstances returns the instances picked by the weighted policies:
+// the ones with a positive weight, or all of them with the same share if
+// none has one.
+func weightedInstances(instances []PickerInstance) []PickerInstance {
+	res := make([]PickerInstance, 0, len(instances))
+	for _, ins := range instances {
+		if ins.Info.Weight > 0 {
+			res = append(res, ins)
+		}
+	}
+	if len(res) == 0 {
+		return instances
+	}
+	return res
+}
+
+func (p *addrPicker) pickByAddr(addr string, ok bool) (balancer.PickResult, error) {
+	if !ok {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+	if res, ok := p.subConns[addr]; ok {
+		return balancer.PickResult{SubConn: res}, nil
+	}
+	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+}
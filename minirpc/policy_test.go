@@ -0,0 +1,63 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/balancer"
+	"testing"
+)
+
+// shardPolicy routes "shard-N" hash keys to the instance with metadata
+// shard=N.
+type shardPolicy struct {
+	shards map[string]balancer.SubConn
+}
+
+func (p *shardPolicy) Pick(info PickInfo) (balancer.PickResult, error) {
+	var shard string
+	_, _ = fmt.Sscanf(info.HashKey, "shard-%s", &shard)
+	if sc, ok := p.shards[shard]; ok {
+		return balancer.PickResult{SubConn: sc}, nil
+	}
+	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+}
+
+func TestRegisterPickerPolicy(t *testing.T) {
+	RegisterPickerPolicy("test_shard", PickerBuilderFunc(func(instances []PickerInstance) PolicyPicker {
+		p := &shardPolicy{shards: make(map[string]balancer.SubConn)}
+		for _, ins := range instances {
+			p.shards[ins.Info.ServerMetadata["shard"]] = ins.SubConn
+		}
+		return p
+	}))
+	var infos []ServerInfo
+	for i := 0; i < 4; i++ {
+		infos = append(infos, ServerInfo{Host: "gs", Port: i,
+			ServerMetadata: map[string]string{"shard": fmt.Sprint(i)}})
+	}
+	p := newTestPicker(t, infos, WithLoadBalancer("test_shard"))
+	for i := 0; i < 4; i++ {
+		ctx := RequestScopeHashKey(context.Background(), fmt.Sprintf("shard-%d", i))
+		assert.Equal(t, fmt.Sprintf("gs:%d", i), pickAddr(t, p, ctx))
+	}
+
+	// per-request policies use the registry as well
+	ctx := RequestScopeLbPolicy(RequestScopeHashKey(context.Background(),
+		"shard-2"), "test_shard")
+	p = newTestPicker(t, infos)
+	assert.Equal(t, "gs:2", pickAddr(t, p, ctx))
+}
+
+func TestWeightRandomPolicy(t *testing.T) {
+	infos := []ServerInfo{
+		{Host: "a", Port: 1, Weight: 1},
+		{Host: "b", Port: 1, Weight: 3},
+	}
+	p := newTestPicker(t, infos, WithLoadBalancer(WeightRandom))
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[pickAddr(t, p, context.Background())]++
+	}
+	assert.InDelta(t, 0.25, float64(counts["a:1"])/10000, 0.03)
+}
@@ -0,0 +1,111 @@
+package minirpc
+
+import (
+	"google.golang.org/grpc/balancer"
+	"sort"
+	"time"
+)
+
+const (
+	defaultPriorityMinReady = 0.5
+	defaultPriorityFailback = 10 * time.Second
+)
+
+// priorityGate remembers the active priority level of a balancer, failing
+// over at once but only failing back after the better level has stayed
+// healthy for a while.
+type priorityGate struct {
+	active    int
+	hasActive bool
+	// when a better level than active became healthy
+	recoveredAt time.Time
+}
+
+// choose returns the level to route to given the best healthy level and
+// whether the active level is still healthy. wait is non-zero when a fail
+// back is pending and choose should be called again after it.
+func (g *priorityGate) choose(best int, activeHealthy bool, now time.Time, failback time.Duration) (level int, wait time.Duration) {
+	if !g.hasActive || !activeHealthy || best >= g.active {
+		g.active, g.hasActive = best, true
+		g.recoveredAt = time.Time{}
+		return best, 0
+	}
+	if g.recoveredAt.IsZero() {
+		g.recoveredAt = now
+	}
+	if elapsed := now.Sub(g.recoveredAt); elapsed < failback {
+		return g.active, failback - elapsed
+	}
+	g.active = best
+	g.recoveredAt = time.Time{}
+	return best, 0
+}
+
+// preferPriority narrows the ready instances to the active priority level.
+// known holds all the resolved instances, ready or not.
+func (n *namingBalancer) preferPriority(ready, known []ServerInfo) []ServerInfo {
+	levels := make([]int, 0, 2)
+	for _, info := range known {
+		if i := sort.SearchInts(levels, info.Priority); i == len(levels) ||
+			levels[i] != info.Priority {
+			levels = append(levels, 0)
+			copy(levels[i+1:], levels[i:])
+			levels[i] = info.Priority
+		}
+	}
+	if len(levels) < 2 {
+		return ready
+	}
+	minReady, failback := defaultPriorityMinReady, defaultPriorityFailback
+	if n.dialOptions != nil && n.dialOptions.PriorityMinReady > 0 {
+		minReady = n.dialOptions.PriorityMinReady
+	}
+	if n.dialOptions != nil && n.dialOptions.PriorityFailback > 0 {
+		failback = n.dialOptions.PriorityFailback
+	}
+	healthy := make(map[int]bool, len(levels))
+	best, found := 0, false
+	for _, level := range levels {
+		match := func(info ServerInfo) bool { return info.Priority == level }
+		readyNum := len(filterBy(ready, match))
+		if readyNum > 0 &&
+			float64(readyNum) >= minReady*float64(len(filterBy(known, match))) {
+			healthy[level] = true
+			if !found {
+				best, found = level, true
+			}
+		}
+	}
+	if !found {
+		// no level is healthy, use whatever is ready
+		return ready
+	}
+	active, wait := n.priority.choose(best, healthy[n.priority.active],
+		time.Now(), failback)
+	if wait > 0 {
+		n.scheduleRegenerate(wait)
+	}
+	return filterBy(ready, func(info ServerInfo) bool {
+		return info.Priority == active
+	})
+}
+
+// scheduleRegenerate rebuilds the picker after d, at most one rebuild is
+// pending at a time.
+func (n *namingBalancer) scheduleRegenerate(d time.Duration) {
+	if n.regenerateTimer != nil {
+		return
+	}
+	n.regenerateTimer = time.AfterFunc(d, func() {
+		n.rwMutex.Lock()
+		defer n.rwMutex.Unlock()
+		n.regenerateTimer = nil
+		if n.closed {
+			return
+		}
+		n.regeneratePicker(n.dialOptions)
+		n.cc.UpdateState(balancer.State{
+			ConnectivityState: n.state, Picker: n.picker,
+		})
+	})
+}
@@ -0,0 +1,72 @@
+package minirpc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPriorityGate(t *testing.T) {
+	g := &priorityGate{}
+	now := time.Now()
+	failback := 10 * time.Second
+
+	level, wait := g.choose(0, false, now, failback)
+	assert.Equal(t, 0, level)
+	assert.Zero(t, wait)
+
+	// the primaries are down, fail over at once
+	level, wait = g.choose(1, false, now, failback)
+	assert.Equal(t, 1, level)
+	assert.Zero(t, wait)
+
+	// the primaries are back, stay on the standby for a while
+	level, wait = g.choose(0, true, now.Add(time.Second), failback)
+	assert.Equal(t, 1, level)
+	assert.Equal(t, failback, wait)
+	level, wait = g.choose(0, true, now.Add(5*time.Second), failback)
+	assert.Equal(t, 1, level)
+	assert.Equal(t, 6*time.Second, wait)
+	level, wait = g.choose(0, true, now.Add(11*time.Second), failback)
+	assert.Equal(t, 0, level)
+	assert.Zero(t, wait)
+
+	// the standby goes down while a fail back is pending
+	g.choose(1, false, now, failback)
+	g.choose(0, true, now.Add(time.Second), failback)
+	level, wait = g.choose(0, false, now.Add(2*time.Second), failback)
+	assert.Equal(t, 0, level)
+	assert.Zero(t, wait)
+}
+
+func TestPriorityFailover(t *testing.T) {
+	infos := []ServerInfo{
+		{Host: "primary", Port: 0, Weight: 1},
+		{Host: "primary", Port: 1, Weight: 1},
+		{Host: "standby", Port: 0, Weight: 1, Priority: 1},
+	}
+	c := newBufCluster(t, infos)
+	failback := 300 * time.Millisecond
+	cli := c.connect(t, WithPriorityFailover(0.5, failback))
+
+	assert.Eventually(t, func() bool {
+		return hostCounts(t, cli, 20)["primary"] == 20
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// one primary left is still enough
+	c.stop("primary:0")
+	assert.Equal(t, 20, hostCounts(t, cli, 20)["primary"])
+
+	c.stop("primary:1")
+	assert.Eventually(t, func() bool {
+		return hostCounts(t, cli, 20)["standby"] == 20
+	}, 5*time.Second, 50*time.Millisecond)
+
+	c.start("primary:0")
+	c.start("primary:1")
+	start := time.Now()
+	assert.Eventually(t, func() bool {
+		return hostCounts(t, cli, 20)["primary"] == 20
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), failback)
+}
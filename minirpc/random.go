@@ -11,6 +11,7 @@ const Random = "random"
 
 func init() {
 	balancer.Register(newBuilder())
+	RegisterPickerPolicy(Random, PickerBuilderFunc(newRandomPolicy))
 }
 
 func newBuilder() balancer.Builder {
@@ -42,3 +43,16 @@ func (p *randPicker) Pick(_ balancer.PickInfo) (balancer.PickResult, error) {
 	sc := p.subConns[rand.Intn(scLen)]
 	return balancer.PickResult{SubConn: sc}, nil
 }
+
+type randomPolicy struct {
+	instances []PickerInstance
+}
+
+func newRandomPolicy(instances []PickerInstance) PolicyPicker {
+	return &randomPolicy{instances: instances}
+}
+
+func (p *randomPolicy) Pick(_ PickInfo) (balancer.PickResult, error) {
+	ins := p.instances[rand.Intn(len(p.instances))]
+	return balancer.PickResult{SubConn: ins.SubConn}, nil
+}
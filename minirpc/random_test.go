@@ -0,0 +1,84 @@
+package minirpc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStandaloneBalancersRegistered(t *testing.T) {
+	for _, name := range []string{Random, WeightRandom} {
+		b := balancer.Get(name)
+		if assert.NotNil(t, b, name) {
+			assert.Equal(t, name, b.Name())
+		}
+	}
+}
+
+func TestServerInfoFromAddress(t *testing.T) {
+	info := ServerInfo{Host: "10.0.0.1", Port: 80, Weight: 3,
+		ServerMetadata: map[string]string{"region": "eu"}}
+	addr := newAddress(info)
+	got, ok := ServerInfoFromAddress(addr)
+	assert.True(t, ok)
+	assert.Equal(t, info, got)
+	assert.Equal(t, 3, addressWeight(addr))
+	assert.Equal(t, 0, addressWeight(newAddress(ServerInfo{Host: "10.0.0.2"})))
+	// equal infos produce equal addresses, so SubConns are kept
+	assert.True(t, addr.Equal(newAddress(info)))
+}
+
+func TestRandomBalancer(t *testing.T) {
+	c := newBufCluster(t, []ServerInfo{
+		{Host: "a", Port: 0, Weight: 1},
+		{Host: "b", Port: 0, Weight: 1},
+	})
+	cli := c.connectBalancer(t, Random)
+	assert.Eventually(t, func() bool {
+		counts := hostCounts(t, cli, 50)
+		return counts["a"] > 0 && counts["b"] > 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestWeightRandomBalancer(t *testing.T) {
+	c := newBufCluster(t, []ServerInfo{
+		{Host: "light", Port: 0, Weight: 1},
+		{Host: "heavy", Port: 0, Weight: 4},
+	})
+	cli := c.connectBalancer(t, WeightRandom)
+	// wait for both SubConns
+	assert.Eventually(t, func() bool {
+		return len(hostCounts(t, cli, 50)) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	counts := hostCounts(t, cli, 2000)
+	assert.InDelta(t, 0.8, float64(counts["heavy"])/2000, 0.05)
+}
+
+func TestWeightRandomZeroWeight(t *testing.T) {
+	build := func(weights ...int) balancer.Picker {
+		info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+		for i, w := range weights {
+			sc := &fakeSubConn{addr: strconv.Itoa(i)}
+			info.ReadySCs[sc] = base.SubConnInfo{
+				Address: newAddress(ServerInfo{Host: "10.0.0.1", Port: i, Weight: w})}
+		}
+		return (&weightRandomBuilder{}).Build(info)
+	}
+	picked := func(p balancer.Picker) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 200; i++ {
+			res, err := p.Pick(balancer.PickInfo{})
+			assert.Nil(t, err)
+			counts[res.SubConn.(*fakeSubConn).addr]++
+		}
+		return counts
+	}
+
+	counts := picked(build(1, 0, 1))
+	assert.Len(t, counts, 2)
+	assert.Zero(t, counts["1"])
+	assert.Len(t, picked(build(0, 0)), 2)
+}
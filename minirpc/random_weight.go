@@ -3,17 +3,20 @@ package minirpc
 import (
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"math/rand"
+	"sort"
 )
 
 const WeightRandom = "weight_random"
 
-func newBulider() balancer.Builder {
+func newWeightRandomBuilder() balancer.Builder {
 	return base.NewBalancerBuilder(WeightRandom, &weightRandomBuilder{},
 		base.Config{HealthCheck: true})
 }
 
 func init() {
-	balancer.Register(newBuilder())
+	balancer.Register(newWeightRandomBuilder())
+	RegisterPickerPolicy(WeightRandom, PickerBuilderFunc(newWeightRandomPolicy))
 }
 
 type weightRandomBuilder struct {
@@ -26,17 +29,49 @@ func (*weightRandomBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
 	var scs []balancer.SubConn
 
 	for subconn, sc := range info.ReadySCs {
-		weight := 1
-		w := sc.Address.Attributes.Value("weight")
-		if w != nil {
-			if i, ok := w.(int); ok {
-				weight = i
-			}
-		}
+		weight := addressWeight(sc.Address)
 		for i := 0; i < weight; i++ {
 			scs = append(scs, subconn)
 		}
 	}
+	if len(scs) == 0 {
+		// no instance has a weight, they get the same share
+		for subconn := range info.ReadySCs {
+			scs = append(scs, subconn)
+		}
+	}
 
 	return &randPicker{subConns: scs}
 }
+
+type weightRandomPolicy struct {
+	instances []PickerInstance
+	// 权重的前缀和，用于带权重的随机算法
+	preWeight []int
+}
+
+func newWeightRandomPolicy(instances []PickerInstance) PolicyPicker {
+	p := &weightRandomPolicy{
+		instances: instances,
+		preWeight: make([]int, 0, len(instances)),
+	}
+	totalWeight := 0
+	for _, ins := range instances {
+		if ins.Info.Weight > 0 {
+			totalWeight += ins.Info.Weight
+		}
+		p.preWeight = append(p.preWeight, totalWeight)
+	}
+	return p
+}
+
+func (p *weightRandomPolicy) Pick(_ PickInfo) (balancer.PickResult, error) {
+	bound := p.preWeight[len(p.preWeight)-1]
+	if bound <= 0 {
+		ins := p.instances[rand.Intn(len(p.instances))]
+		return balancer.PickResult{SubConn: ins.SubConn}, nil
+	}
+	x := rand.Intn(bound) + 1
+	index := sort.SearchInts(p.preWeight, x)
+	return balancer.PickResult{SubConn: p.instances[index].SubConn}, nil
+}
@@ -0,0 +1,231 @@
+package minirpc
+
+import (
+	"context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPushbackKey is the trailer telling clients how many milliseconds to
+// wait before retrying a rejected call, as defined by gRPC retries.
+const RetryPushbackKey = "grpc-retry-pushback-ms"
+
+// callers idle for this long lose their bucket
+const callerIdleTimeout = time.Minute
+
+type (
+	// RateLimit allows Rate calls per second to Method, with bursts of up
+	// to Burst calls.
+	RateLimit struct {
+		// Method is a full method name such as "/echo.EchoServer/Echo" or
+		// AnyMethod.
+		Method string
+		Rate   float64
+		Burst  int
+		// PerCaller gives each caller its own bucket. Callers are named by
+		// RequestScopeCaller, or by their IP address.
+		PerCaller bool
+	}
+
+	// RateLimiter rejects calls over their RateLimit with ResourceExhausted
+	// and a retry pushback, e.g.
+	//
+	//	limiter := minirpc.NewRateLimiter(minirpc.RateLimit{
+	//		Method: minirpc.AnyMethod, Rate: 100, Burst: 20, PerCaller: true})
+	//	srv, err := minirpc.NewServer(info,
+	//		grpc.ChainUnaryInterceptor(limiter.UnaryServerInterceptor),
+	//		grpc.ChainStreamInterceptor(limiter.StreamServerInterceptor))
+	RateLimiter struct {
+		limits map[string][]*limitBuckets
+	}
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token, or returns how long it takes to get one.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// refund gives back a token taken by take.
+func (b *tokenBucket) refund(burst int) {
+	b.tokens = math.Min(float64(burst), b.tokens+1)
+}
+
+// limitBuckets holds the buckets of a RateLimit.
+type limitBuckets struct {
+	limit RateLimit
+	mu    sync.Mutex
+	// caller -> bucket, "" without PerCaller
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func (l *limitBuckets) take(caller string, now time.Time) (bool, time.Duration) {
+	if !l.limit.PerCaller {
+		caller = ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= callerIdleTimeout {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) >= callerIdleTimeout {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[caller]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[caller] = b
+	}
+	return b.take(now, l.limit.Rate, l.limit.Burst)
+}
+
+// refund gives back the token of a call rejected by another limit.
+func (l *limitBuckets) refund(caller string) {
+	if !l.limit.PerCaller {
+		caller = ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[caller]; ok {
+		b.refund(l.limit.Burst)
+	}
+}
+
+// NewRateLimiter makes a limiter applying all limits whose Method matches a
+// call. Limits with a non-positive Rate are ignored, Burst defaults to 1.
+func NewRateLimiter(limits ...RateLimit) *RateLimiter {
+	l := &RateLimiter{limits: make(map[string][]*limitBuckets)}
+	now := time.Now()
+	for _, limit := range limits {
+		if limit.Rate <= 0 {
+			continue
+		}
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+		l.limits[limit.Method] = append(l.limits[limit.Method], &limitBuckets{
+			limit:     limit,
+			buckets:   make(map[string]*tokenBucket),
+			lastSweep: now,
+		})
+	}
+	return l
+}
+
+// allow checks all limits of method, the error tells the caller when to
+// retry. A rejected call gives back the tokens it took from the other
+// limits.
+func (l *RateLimiter) allow(ctx context.Context, method string) error {
+	now := time.Now()
+	caller := callerOf(ctx)
+	var taken []*limitBuckets
+	for _, key := range []string{method, AnyMethod} {
+		for _, limit := range l.limits[key] {
+			if ok, wait := limit.take(caller, now); !ok {
+				for _, t := range taken {
+					t.refund(caller)
+				}
+				return rejectCall(ctx, wait, "rate limit of %s exceeded", method)
+			}
+			taken = append(taken, limit)
+		}
+	}
+	return nil
+}
+
+func (l *RateLimiter) UnaryServerInterceptor(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	if err := l.allow(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor limits the rate at which streams are opened.
+func (l *RateLimiter) StreamServerInterceptor(
+	srv any,
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := l.allow(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// callerOf names the caller of a call for per caller limits.
+func callerOf(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(miniRequestCaller); len(vals) > 0 {
+			return vals[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// rejectCall returns a ResourceExhausted error asking the client to retry
+// after wait, both as trailer and as RetryInfo.
+func rejectCall(ctx context.Context, wait time.Duration, format string, args ...any) error {
+	ms := wait.Milliseconds()
+	if wait > 0 && ms == 0 {
+		ms = 1
+	}
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(RetryPushbackKey,
+		strconv.FormatInt(ms, 10)))
+	st := status.Newf(codes.ResourceExhausted, format, args...)
+	if ds, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(time.Duration(ms) * time.Millisecond),
+	}); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
+
+// RetryAfter returns how long the server asked to wait before retrying a
+// call which failed with err.
+func RetryAfter(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,183 @@
+package minirpc
+
+import (
+	"context"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+	"time"
+)
+
+func unaryInfo(method string) *grpc.UnaryServerInfo {
+	return &grpc.UnaryServerInfo{FullMethod: method}
+}
+
+func okHandler(context.Context, any) (any, error) {
+	return "ok", nil
+}
+
+func callerCtx(caller string) context.Context {
+	return metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(miniRequestCaller, caller))
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+	ok, _ := b.take(now, 10, 2)
+	assert.True(t, ok)
+	ok, _ = b.take(now, 10, 2)
+	assert.True(t, ok)
+	ok, wait := b.take(now, 10, 2)
+	assert.False(t, ok)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(wait),
+		float64(time.Millisecond))
+	ok, _ = b.take(now.Add(100*time.Millisecond), 10, 2)
+	assert.True(t, ok)
+	// refills stop at the burst
+	b.take(now.Add(time.Hour), 10, 2)
+	assert.Equal(t, 1.0, b.tokens)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(
+		RateLimit{Method: echoMethod, Rate: 1, Burst: 2},
+		RateLimit{Method: AnyMethod, Rate: 1, Burst: 1, PerCaller: true},
+	)
+	// the per caller limit applies to every method
+	_, err := l.UnaryServerInterceptor(callerCtx("a"), nil,
+		unaryInfo("/router/Other"), okHandler)
+	assert.Nil(t, err)
+	_, err = l.UnaryServerInterceptor(callerCtx("a"), nil,
+		unaryInfo("/router/Other"), okHandler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	wait, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Second), float64(wait), float64(10*time.Millisecond))
+
+	// callers are limited separately, the method limit is shared
+	_, err = l.UnaryServerInterceptor(callerCtx("b"), nil,
+		unaryInfo(echoMethod), okHandler)
+	assert.Nil(t, err)
+	_, err = l.UnaryServerInterceptor(callerCtx("c"), nil,
+		unaryInfo(echoMethod), okHandler)
+	assert.Nil(t, err)
+	_, err = l.UnaryServerInterceptor(callerCtx("d"), nil,
+		unaryInfo(echoMethod), okHandler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	l := NewRateLimiter(
+		RateLimit{Method: echoMethod, Rate: 1, Burst: 2},
+		RateLimit{Method: AnyMethod, Rate: 1, Burst: 1, PerCaller: true},
+	)
+	// the calls rejected by the per caller limit leave the method limit
+	for i := 0; i < 5; i++ {
+		_, err := l.UnaryServerInterceptor(callerCtx("a"), nil,
+			unaryInfo(echoMethod), okHandler)
+		if i > 0 {
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		}
+	}
+	_, err := l.UnaryServerInterceptor(callerCtx("b"), nil,
+		unaryInfo(echoMethod), okHandler)
+	assert.Nil(t, err)
+	_, err = l.UnaryServerInterceptor(callerCtx("c"), nil,
+		unaryInfo(echoMethod), okHandler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestLoadShedder(t *testing.T) {
+	s := NewLoadShedder(LoadShedConfig{
+		MaxInFlight: 1,
+		MaxQueue:    1,
+		Target:      5 * time.Millisecond,
+		Interval:    50 * time.Millisecond,
+	})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := s.UnaryServerInterceptor(context.Background(), nil,
+			unaryInfo(echoMethod), func(context.Context, any) (any, error) {
+				close(started)
+				<-release
+				return nil, nil
+			})
+		assert.Nil(t, err)
+	}()
+	<-started
+
+	// call waits in the queue and returns how long it waited
+	call := func() (time.Duration, error) {
+		start := time.Now()
+		_, err := s.UnaryServerInterceptor(context.Background(), nil,
+			unaryInfo(echoMethod), okHandler)
+		return time.Since(start), err
+	}
+
+	// a queued call waits for Interval before it is shed
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		waited, err := call()
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.GreaterOrEqual(t, waited, 50*time.Millisecond)
+	}()
+	assert.Eventually(t, func() bool { return s.Stats().Queued == 1 },
+		time.Second, time.Millisecond)
+
+	// the queue is full
+	_, err := call()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, ok := RetryAfter(err)
+	assert.True(t, ok)
+	wg.Wait()
+
+	// after an interval with a standing queue only Target is tolerated
+	waited, err := call()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.GreaterOrEqual(t, waited, 50*time.Millisecond)
+	assert.True(t, s.Stats().Overloaded)
+	waited, err = call()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Less(t, waited, 40*time.Millisecond)
+	assert.Equal(t, uint64(4), s.Stats().Shed)
+
+	close(release)
+	<-done
+	_, err = call()
+	assert.Nil(t, err)
+}
+
+// rejected calls are retried after the pushback of the server
+func TestRetryPushback(t *testing.T) {
+	c := newBufCluster(t, retryInfos(1))
+	var mu sync.Mutex
+	var times []time.Time
+	c.setHandler(func(ctx context.Context, _ string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			return rejectCall(ctx, 50*time.Millisecond, "busy")
+		}
+		return nil
+	})
+	policy := testRetryPolicy
+	cli := c.connect(t, WithRetryPolicy(AnyMethod, policy))
+	_, err := cli.Echo(context.Background(), &echo.EchoRequest{})
+	assert.Nil(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, times, 2)
+	assert.GreaterOrEqual(t, times[1].Sub(times[0]), 50*time.Millisecond)
+}
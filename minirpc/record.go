@@ -0,0 +1,154 @@
+package minirpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gamerouter/minirpc/registrypb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// RecordFormat is the encoding of the instance records servers publish in
+// etcd. Clients decode every format, whatever format they publish with.
+type RecordFormat int
+
+const (
+	// RecordJSON is the JSON encoding of registrypb.ServerInfo. Its field
+	// names match ServerInfo, so clients predating the schema decode it.
+	RecordJSON RecordFormat = iota
+	// RecordProto is the binary encoding of registrypb.ServerInfo behind a
+	// recordProtoPrefix byte. Only clients knowing the schema decode it.
+	RecordProto
+)
+
+// recordProtoPrefix starts the binary records, JSON never starts with it.
+const recordProtoPrefix = 0x00
+
+const (
+	resolverRejectedTotal = "minirpc_resolver_rejected_records_total"
+	resolverRejectedHelp  = "Instance records the resolver rejected as malformed."
+)
+
+// ErrInvalidRecord is wrapped by the errors of DecodeServerInfo and
+// ServerInfo.Validate.
+var ErrInvalidRecord = errors.New("invalid instance record")
+
+var (
+	recordMarshal   = protojson.MarshalOptions{}
+	recordUnmarshal = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+// EncodeServerInfo validates info and encodes it as an instance record.
+func EncodeServerInfo(info ServerInfo, format RecordFormat) ([]byte, error) {
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	pb := info.Proto()
+	switch format {
+	case RecordJSON:
+		return recordMarshal.Marshal(pb)
+	case RecordProto:
+		data, err := proto.Marshal(pb)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{recordProtoPrefix}, data...), nil
+	default:
+		return nil, fmt.Errorf("unknown record format %d", format)
+	}
+}
+
+// DecodeServerInfo decodes and validates an instance record of any format,
+// including the plain JSON of ServerInfo written before the schema. The
+// fields added by newer schema versions are ignored.
+func DecodeServerInfo(data []byte) (ServerInfo, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return ServerInfo{}, fmt.Errorf("%w: empty", ErrInvalidRecord)
+	}
+	var (
+		info ServerInfo
+		err  error
+	)
+	switch {
+	case data[0] == recordProtoPrefix:
+		pb := &registrypb.ServerInfo{}
+		if err = proto.Unmarshal(data[1:], pb); err == nil {
+			info = ServerInfoFromProto(pb)
+		}
+	case isLegacyRecord(data):
+		err = json.Unmarshal(data, &info)
+	default:
+		pb := &registrypb.ServerInfo{}
+		if err = recordUnmarshal.Unmarshal(data, pb); err == nil {
+			info = ServerInfoFromProto(pb)
+		}
+	}
+	if err != nil {
+		return ServerInfo{}, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	return info, info.Validate()
+}
+
+// isLegacyRecord reports whether data is a JSON record without a schema
+// version, encoding/json matches its keys case-insensitively.
+func isLegacyRecord(data []byte) bool {
+	var version struct {
+		SchemaVersion *json.RawMessage `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		// reported by protojson
+		return false
+	}
+	return version.SchemaVersion == nil
+}
+
+// Validate checks the fields clients need to connect to the instance.
+func (info ServerInfo) Validate() error {
+	switch {
+	case len(info.Host) == 0:
+		return fmt.Errorf("%w: empty host", ErrInvalidRecord)
+	case info.Port <= 0 || info.Port > 65535:
+		return fmt.Errorf("%w: port %d out of range", ErrInvalidRecord, info.Port)
+	case info.Weight < 0:
+		return fmt.Errorf("%w: negative weight %d", ErrInvalidRecord, info.Weight)
+	case info.Priority < 0:
+		return fmt.Errorf("%w: negative priority %d", ErrInvalidRecord, info.Priority)
+	}
+	return nil
+}
+
+// Proto converts info to the current schema version.
+func (info ServerInfo) Proto() *registrypb.ServerInfo {
+	return &registrypb.ServerInfo{
+		SchemaVersion:  uint32(registrypb.SchemaVersion_SCHEMA_VERSION_CURRENT),
+		Namespace:      info.Namespace,
+		ServiceName:    info.ServiceName,
+		InstanceId:     info.InstanceID,
+		Weight:         int32(info.Weight),
+		Host:           info.Host,
+		Port:           int32(info.Port),
+		ServerMetadata: info.ServerMetadata,
+		Region:         info.Region,
+		Zone:           info.Zone,
+		Priority:       int32(info.Priority),
+	}
+}
+
+// ServerInfoFromProto converts a record of any schema version.
+func ServerInfoFromProto(pb *registrypb.ServerInfo) ServerInfo {
+	return ServerInfo{
+		Namespace:      pb.GetNamespace(),
+		ServiceName:    pb.GetServiceName(),
+		InstanceID:     pb.GetInstanceId(),
+		Weight:         int(pb.GetWeight()),
+		Host:           pb.GetHost(),
+		Port:           int(pb.GetPort()),
+		ServerMetadata: pb.GetServerMetadata(),
+		Region:         pb.GetRegion(),
+		Zone:           pb.GetZone(),
+		Priority:       int(pb.GetPriority()),
+	}
+}
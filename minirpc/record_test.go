@@ -0,0 +1,104 @@
+package minirpc
+
+import (
+	"encoding/json"
+	"gamerouter/minirpc/registrypb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"testing"
+)
+
+var testRecordInfo = ServerInfo{
+	Namespace:      DefaultNamespace,
+	ServiceName:    "player",
+	InstanceID:     "p-1",
+	Weight:         3,
+	Host:           "10.0.0.1",
+	Port:           8000,
+	ServerMetadata: map[string]string{"version": "v2"},
+	Region:         "eu",
+	Zone:           "eu-1a",
+	Priority:       1,
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	for _, format := range []RecordFormat{RecordJSON, RecordProto} {
+		data, err := EncodeServerInfo(testRecordInfo, format)
+		assert.Nil(t, err)
+		info, err := DecodeServerInfo(data)
+		assert.Nil(t, err)
+		assert.Equal(t, testRecordInfo, info)
+	}
+}
+
+func TestRecordLegacyJSON(t *testing.T) {
+	// records published before the schema
+	legacy, err := json.Marshal(testRecordInfo)
+	assert.Nil(t, err)
+	info, err := DecodeServerInfo(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, testRecordInfo, info)
+
+	// and clients predating the schema read the new records
+	data, err := EncodeServerInfo(testRecordInfo, RecordJSON)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "schemaVersion")
+	var old ServerInfo
+	assert.Nil(t, json.Unmarshal(data, &old))
+	assert.Equal(t, testRecordInfo, old)
+}
+
+func TestRecordNewerSchema(t *testing.T) {
+	// a field added by a later schema version is ignored
+	data := `{"schemaVersion":2,"host":"10.0.0.1","port":8000,"weight":1,"drain":true}`
+	info, err := DecodeServerInfo([]byte(data))
+	assert.Nil(t, err)
+	assert.Equal(t, ServerInfo{Host: "10.0.0.1", Port: 8000, Weight: 1}, info)
+
+	bin, err := proto.Marshal(&registrypb.ServerInfo{
+		SchemaVersion: 2, Host: "10.0.0.1", Port: 8000, Weight: 1})
+	assert.Nil(t, err)
+	bin = protowire.AppendTag(bin, 100, protowire.VarintType)
+	bin = protowire.AppendVarint(bin, 1)
+	info, err = DecodeServerInfo(append([]byte{recordProtoPrefix}, bin...))
+	assert.Nil(t, err)
+	assert.Equal(t, ServerInfo{Host: "10.0.0.1", Port: 8000, Weight: 1}, info)
+}
+
+func TestRecordMalformed(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"not json",
+		`{"schemaVersion":1,"host":"10.0.0.1","port":"http"}`,
+		`{"Host":"10.0.0.1","Port":"8000"}`,
+		`{"schemaVersion":1,"port":8000}`,
+		`{"Host":"10.0.0.1","Port":70000}`,
+		`{"Host":"10.0.0.1","Port":8000,"Weight":-1}`,
+		"\x00\xff\xff",
+	} {
+		_, err := DecodeServerInfo([]byte(data))
+		assert.ErrorIs(t, err, ErrInvalidRecord, data)
+	}
+	_, err := EncodeServerInfo(ServerInfo{Port: 8000}, RecordJSON)
+	assert.ErrorIs(t, err, ErrInvalidRecord)
+}
+
+func TestResolverRejectsRecords(t *testing.T) {
+	r := &namingResolver{serviceName: "reject-test"}
+	count := func() string {
+		var b strings.Builder
+		for _, line := range strings.Split(metricsText(DefaultMetrics), "\n") {
+			if strings.HasPrefix(line, resolverRejectedTotal+`{service="reject-test"}`) {
+				b.WriteString(line)
+			}
+		}
+		return b.String()
+	}
+	r.reject("/k/1", "bad", ErrInvalidRecord)
+	r.reject("/k/1", "bad", ErrInvalidRecord)
+	assert.Equal(t, resolverRejectedTotal+`{service="reject-test"} 1`, count())
+	r.reject("/k/1", "worse", ErrInvalidRecord)
+	assert.Equal(t, resolverRejectedTotal+`{service="reject-test"} 2`, count())
+}
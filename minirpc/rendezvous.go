@@ -0,0 +1,76 @@
+package minirpc
+
+import (
+	"google.golang.org/grpc/balancer"
+	"math"
+)
+
+const Rendezvous = "rendezvous"
+
+func init() {
+	RegisterPickerPolicy(Rendezvous, PickerBuilderFunc(newRendezvousPolicy))
+}
+
+type rendezvousPolicy struct {
+	*addrPicker
+	hrw *rendezvous
+}
+
+func newRendezvousPolicy(instances []PickerInstance) PolicyPicker {
+	ap, addrs, weights := newAddrPicker(weightedInstances(instances))
+	return &rendezvousPolicy{addrPicker: ap, hrw: newRendezvous(addrs, weights)}
+}
+
+func (p *rendezvousPolicy) Pick(info PickInfo) (balancer.PickResult, error) {
+	return p.pickByAddr(p.hrw.Get(info.HashKey))
+}
+
+type rendezvousNode struct {
+	key    string
+	hash   uint64
+	weight float64
+}
+
+// rendezvous implements weighted highest random weight hashing. Every key
+// scores all nodes and goes to the best one, so removing a node only moves
+// the keys it owned.
+type rendezvous struct {
+	nodes []rendezvousNode
+}
+
+func newRendezvous(nodes []string, weights []int) *rendezvous {
+	r := &rendezvous{nodes: make([]rendezvousNode, 0, len(nodes))}
+	for i, node := range nodes {
+		w := 1
+		if i < len(weights) && weights[i] > 0 {
+			w = weights[i]
+		}
+		r.nodes = append(r.nodes, rendezvousNode{
+			key:    node,
+			hash:   hashString(0, node),
+			weight: float64(w),
+		})
+	}
+	return r
+}
+
+// Get returns the node owning key. It returns false if there is no node.
+func (r *rendezvous) Get(key string) (string, bool) {
+	if len(r.nodes) == 0 {
+		return "", false
+	}
+	keyHash := hashString(0, key)
+	best := -1
+	bestScore := math.Inf(-1)
+	for i := range r.nodes {
+		// -w/ln(u) with u uniform in (0,1) gives each node a share
+		// proportional to its weight.
+		u := (float64(mix64(keyHash^r.nodes[i].hash)>>11) + 0.5) / (1 << 53)
+		score := -r.nodes[i].weight / math.Log(u)
+		if score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return r.nodes[best].key, true
+}
@@ -2,54 +2,89 @@ package minirpc
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"gamerouter/discover"
+	"gamerouter/logx"
 	router "gamerouter/router/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/resolver"
-	"log"
+	"path"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	EtcdScheme     = "etcd"
 	keyServerInfo  = "server_info"
 	keyDialOptions = "options"
+	// the error of a state without addresses
+	keyResolverError = "resolver_error"
 )
 
+// The errors reported by the resolvers to the ClientConn, RPCs failing
+// before any instance is resolved wrap one of them.
+var (
+	// ErrServiceNotFound means no instance of the service is registered.
+	ErrServiceNotFound = errors.New("service not found")
+	// ErrRegistryUnavailable means etcd cannot be loaded.
+	ErrRegistryUnavailable = errors.New("registry unavailable")
+	// ErrAllInstancesDraining means every instance of the service is
+	// draining, see ServerInfo.Draining.
+	ErrAllInstancesDraining = errors.New("all instances draining")
+)
+
+// reportedError keeps the error a resolver last reported to its
+// ClientConn, until it resolves instances again.
+type reportedError struct {
+	err atomic.Pointer[error]
+}
+
+func (r *reportedError) report(cc resolver.ClientConn, err error) {
+	r.set(err)
+	cc.ReportError(err)
+}
+
+// set keeps err without reporting it, before sending a state whose calls
+// fail with err.
+func (r *reportedError) set(err error) {
+	r.err.Store(&err)
+}
+
+func (r *reportedError) clear() {
+	r.err.Store(nil)
+}
+
+func (r *reportedError) lastError() error {
+	if err := r.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// etcdResolverBuilder builds the resolvers of a ClientConn dialled by
+// DialContext, the one registered globally serves grpc.Dial with the
+// default options.
 type etcdResolverBuilder struct {
+	options *dialOptions
+	// the context of DialContext without its cancellation, it carries the
+	// trace of the dial
+	ctx context.Context
 }
 
-func getDialOptions(target resolver.Target) (*dialOptions, error) {
-	options := &dialOptions{}
-	if len(target.URL.RawQuery) > 0 {
-		var optionsStr string
-		values := target.URL.Query()
-		if len(values) > 0 {
-			optionValues := values[optionsKey]
-			if len(optionValues) > 0 {
-				optionsStr = optionValues[0]
-			}
-		}
-		if len(optionsStr) > 0 {
-			value, err := base64.URLEncoding.DecodeString(optionsStr)
-			if err != nil {
-				return nil, fmt.Errorf("fail to decode %s, options %s: %w",
-					target.URL.Opaque, optionsStr, err)
-			}
-			if err = json.Unmarshal(value, options); nil != err {
-				return nil, fmt.Errorf("fail to unmarshal options %s: %w",
-					string(value), err)
-			}
-		}
+// builderOptions returns the options of the ClientConn of a builder.
+func builderOptions(options *dialOptions) *dialOptions {
+	if options == nil {
+		return &dialOptions{}
 	}
-	return options, nil
+	return options
 }
 
 func parseHost(target string) (string, int, error) {
@@ -80,44 +115,57 @@ func (b *etcdResolverBuilder) Build(
 	cc resolver.ClientConn,
 	_ resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	options, err := getDialOptions(target)
-	if err != nil {
-		return nil, err
-	}
+	options := builderOptions(b.options)
 	host, _, err := parseHost(target.URL.Host)
 	if err != nil {
 		return nil, err
 	}
 	if len(options.RouteKey) > 0 {
-		conn, err := DialContext(context.Background(),
+		ctx := b.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		conn, err := DialContext(ctx,
 			"etcd://MiniRouter",
 			WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())),
 			WithEtcdHosts(options.Endpoints))
 		if err != nil {
-			fmt.Printf("[Resolver Builder] dial error in %v", err)
+			logger.Error("resolver failed to dial the router",
+				logx.Service(host), logx.Err(err))
 		}
-		cli := router.NewRouterClient(conn)
 		resolv := &dynamicPrefixResolver{
-			routercli: cli, serviceName: host, namespace: options.Namespace,
+			ctx: ctx, cancel: cancel,
+			cc: cc, conn: conn, routercli: router.NewRouterClient(conn),
+			serviceName: host, namespace: options.Namespace,
 		}
 		resolv.update()
 		return resolv, nil
 	}
-	sub := discover.NewSubscriber(options.Endpoints,
-		MakeEtcdServiceKey(getNamespace(options), host))
 	resolv := &namingResolver{
-		cc:      cc,
-		sub:     sub,
-		options: options,
+		cc:          cc,
+		options:     options,
+		serviceName: host,
+		key:         MakeEtcdServiceKey(getNamespace(options), host),
+		done:        make(chan struct{}),
+	}
+	if len(options.ConnID) > 0 {
+		namingResolvers.Store(options.ConnID, resolv)
 	}
-	sub.AddListener(resolv.update)
-	resolv.update()
+	// the registry retries until etcd is reachable or the resolver is
+	// closed, meanwhile the resolver reports the failures to the ClientConn
+	go resolv.subscribe()
 
 	return resolv, nil
 }
 
 type dynamicPrefixResolver struct {
-	cc          resolver.ClientConn
+	// cancelled by Close, carries the trace of the dial to the router
+	ctx    context.Context
+	cancel context.CancelFunc
+	cc     resolver.ClientConn
+	// the connection to the router, owned by the resolver
+	conn        *grpc.ClientConn
 	routercli   router.RouterClient
 	routeKey    string
 	serviceName string
@@ -125,13 +173,20 @@ type dynamicPrefixResolver struct {
 }
 
 func (d *dynamicPrefixResolver) update() {
-	resp, err := d.routercli.GetOneInstanceWithPrefix(context.Background(),
+	ctx := d.ctx
+	// the router conn has no tracing interceptor
+	if span := SpanFromContext(ctx); span != nil {
+		ctx = withTraceparent(ctx, span.SpanContext)
+	}
+	resp, err := d.routercli.GetOneInstanceWithPrefix(ctx,
 		&router.GetEndpointWithPrefixRequest{
 			ServiceName: d.serviceName,
 			Namespace:   d.namespace, Key: d.routeKey,
 		})
 	if err != nil {
-		fmt.Printf("dynamic prefix resolver err: %v", err)
+		logger.Warn("dynamic prefix resolver failed to get an instance",
+			logx.Service(d.serviceName), logx.Prefix(d.routeKey), logx.Err(err))
+		return
 	}
 	addr := fmt.Sprintf("%s:%s", resp.Instance.Host, resp.Instance.Port)
 	state := resolver.State{
@@ -141,7 +196,8 @@ func (d *dynamicPrefixResolver) update() {
 		Addr: addr,
 	})
 	if err := d.cc.UpdateState(state); err != nil {
-		fmt.Printf("dynamic resolver err %v", err)
+		logger.Warn("dynamic prefix resolver failed to update state",
+			logx.Service(d.serviceName), logx.Err(err))
 	}
 }
 
@@ -150,6 +206,10 @@ func (d *dynamicPrefixResolver) ResolveNow(_ resolver.ResolveNowOptions) {
 }
 
 func (d *dynamicPrefixResolver) Close() {
+	d.cancel()
+	if d.conn != nil {
+		_ = d.conn.Close()
+	}
 }
 
 func (b *etcdResolverBuilder) Scheme() string {
@@ -157,40 +217,295 @@ func (b *etcdResolverBuilder) Scheme() string {
 }
 
 type namingResolver struct {
-	cc      resolver.ClientConn
-	sub     *discover.Subscriber
-	options *dialOptions
+	cc          resolver.ClientConn
+	options     *dialOptions
+	serviceName string
+	// key is the prefix of the instance records
+	key string
+
+	// closed by Close, stops the retries of subscribe
+	done chan struct{}
+	// set by subscribe once etcd is loaded
+	mu     sync.Mutex
+	closed bool
+	sub    *discover.Subscriber
+	// config documents of the service
+	split     *etcdDoc
+	svcConfig *etcdDoc
+	// the instances and the config documents notify updates from their
+	// own goroutines, the last state sent to cc must be the latest one
+	updateMu sync.Mutex
+	// the last update, for the admin endpoint
+	last atomic.Pointer[resolverState]
+	// the malformed records by key, counted once per value
+	rejected sync.Map
+	reportedError
+}
+
+// etcdDoc watches a single etcd key holding a config document.
+type etcdDoc struct {
+	sub *discover.Subscriber
+	key string
+}
+
+func newEtcdDoc(endpoints []string, key string, opts ...discover.SubOption) *etcdDoc {
+	// the registry watches the children of a prefix
+	return &etcdDoc{
+		sub: discover.NewSubscriber(endpoints, path.Dir(key), opts...),
+		key: key,
+	}
+}
+
+func (d *etcdDoc) value() (string, bool) {
+	val, ok := d.sub.KeyValues()[d.key]
+	return val, ok
+}
+
+// subscribe watches the instances and config documents of the service,
+// it blocks until etcd is loaded or the resolver is closed.
+func (n *namingResolver) subscribe() {
+	opts := []discover.SubOption{discover.WithErrorHandler(n.loadFailed),
+		discover.WithDone(n.done)}
+	endpoints, namespace := n.options.Endpoints, getNamespace(n.options)
+	sub := discover.NewSubscriber(endpoints, n.key, opts...)
+	split := newEtcdDoc(endpoints,
+		MakeEtcdTrafficSplitKey(namespace, n.serviceName), opts...)
+	svcConfig := newEtcdDoc(endpoints,
+		MakeEtcdServiceConfigKey(namespace, n.serviceName), opts...)
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		sub.Close()
+		split.sub.Close()
+		svcConfig.sub.Close()
+		return
+	}
+	n.sub, n.split, n.svcConfig = sub, split, svcConfig
+	n.mu.Unlock()
+
+	sub.AddListener(n.update)
+	split.sub.AddListener(n.update)
+	svcConfig.sub.AddListener(n.update)
+	n.update()
 }
 
+// loadFailed reports that etcd cannot be loaded, unless the resolver
+// already has instances to keep.
+func (n *namingResolver) loadFailed(err error) {
+	if n.last.Load() != nil || n.isClosed() {
+		return
+	}
+	n.report(n.cc, fmt.Errorf("%w: %s: %v", ErrRegistryUnavailable, n.key, err))
+}
+
+// update sends the instances and config documents to cc, it is the
+// listener of the three subscribers.
 func (n *namingResolver) update() {
-	vals := n.sub.Values()
-	serverInfos := make([]ServerInfo, 0, len(vals))
-	for _, val := range vals {
-		info := &ServerInfo{}
-		if err := json.Unmarshal([]byte(val), info); err != nil {
-			fmt.Sprintf("error in %v", err)
+	n.updateMu.Lock()
+	defer n.updateMu.Unlock()
+	if n.isClosed() {
+		return
+	}
+	kvs := n.sub.KeyValues()
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	serverInfos := make([]ServerInfo, 0, len(kvs))
+	var rejected, draining []string
+	for _, key := range keys {
+		info, err := DecodeServerInfo([]byte(kvs[key]))
+		if err != nil {
+			n.reject(key, kvs[key], err)
+			rejected = append(rejected, key)
+			continue
+		}
+		n.rejected.Delete(key)
+		if info.Draining() {
+			draining = append(draining, key)
+			continue
 		}
-		serverInfos = append(serverInfos, *info)
+		serverInfos = append(serverInfos, info)
 	}
+	n.rejected.Range(func(key, _ any) bool {
+		if _, ok := kvs[key.(string)]; !ok {
+			n.rejected.Delete(key)
+		}
+		return true
+	})
 
 	// resolver state definition, pass it to balancer
+	split := n.trafficSplit()
 	state := resolver.State{
 		Attributes: attributes.New(keyDialOptions,
-			n.options).WithValue(keyServerInfo, serverInfos),
+			n.options).WithValue(keyServerInfo, serverInfos).
+			WithValue(keyTrafficSplit, split),
+	}
+	// the interceptors and the picker apply conf, the gRPC service config
+	// stays the one given at dial time
+	conf := n.serviceConfig()
+	if conf != nil {
+		state.Attributes = state.Attributes.WithValue(keyServiceConfig, conf)
+	}
+	last := &resolverState{
+		ConnID:        n.options.ConnID,
+		Namespace:     getNamespace(n.options),
+		Service:       n.serviceName,
+		Instances:     serverInfos,
+		TrafficSplit:  split,
+		ServiceConfig: conf,
+		Rejected:      rejected,
+		Draining:      draining,
+		Updated:       time.Now(),
 	}
+	if len(serverInfos) == 0 {
+		err := n.noInstanceError(len(kvs), len(draining))
+		last.Error = err.Error()
+		n.last.Store(last)
+		// the balancer drops the instances and fails the calls with err
+		state.Attributes = state.Attributes.WithValue(keyResolverError, err)
+		n.set(err)
+		_ = n.cc.UpdateState(state)
+		n.report(n.cc, err)
+		return
+	}
+	n.last.Store(last)
+	n.clear()
 	for _, info := range serverInfos {
-		state.Addresses = append(state.Addresses, resolver.Address{
-			Addr: fmt.Sprintf("%s:%d", info.Host, info.Port),
-		})
+		state.Addresses = append(state.Addresses, newAddress(info))
 	}
 
 	if err := n.cc.UpdateState(state); err != nil {
-		log.Print(err)
+		n.options.hotLog().Warn("resolver failed to update state",
+			logx.Service(n.serviceName), logx.Err(err))
+	}
+}
+
+// noInstanceError explains why none of the records of the service is
+// usable.
+func (n *namingResolver) noInstanceError(records, draining int) error {
+	switch {
+	case records == 0:
+		return fmt.Errorf("%w: no instance registered under %s", ErrServiceNotFound, n.key)
+	case draining > 0:
+		return fmt.Errorf("%w: %d instances under %s", ErrAllInstancesDraining, draining, n.key)
+	default:
+		return fmt.Errorf("%w: all %d records under %s", ErrInvalidRecord, records, n.key)
+	}
+}
+
+// reject logs and counts a malformed record, unless the same value was
+// already rejected.
+func (n *namingResolver) reject(key, val string, err error) {
+	if old, loaded := n.rejected.Swap(key, val); loaded && old == val {
+		return
+	}
+	n.options.hotLog().Warn("resolver rejected an instance record",
+		logx.Service(n.serviceName), logx.F("key", key), logx.Err(err))
+	DefaultMetrics.inc(resolverRejectedTotal, resolverRejectedHelp,
+		"service", n.serviceName)
+}
+
+// addressInfo wraps ServerInfo so that it can be compared as an address
+// attribute.
+type addressInfo struct {
+	info ServerInfo
+}
+
+func (a addressInfo) Equal(o any) bool {
+	oa, ok := o.(addressInfo)
+	return ok && reflect.DeepEqual(a.info, oa.info)
+}
+
+// newAddress returns the address of an instance, its weight and ServerInfo
+// are attached as attributes for the balancers.
+func newAddress(info ServerInfo) resolver.Address {
+	return resolver.Address{
+		Addr: instanceAddr(info),
+		Attributes: attributes.New(NodeWeight, info.Weight).
+			WithValue(keyServerInfo, addressInfo{info: info}),
+	}
+}
+
+// ServerInfoFromAddress returns the ServerInfo attached to an address
+// resolved from etcd.
+func ServerInfoFromAddress(addr resolver.Address) (ServerInfo, bool) {
+	ai, ok := addr.Attributes.Value(keyServerInfo).(addressInfo)
+	return ai.info, ok
+}
+
+// addressWeight returns the weight attribute of addr, 1 if it is not set
+// and 0 if it is not positive.
+func addressWeight(addr resolver.Address) int {
+	w, ok := addr.Attributes.Value(NodeWeight).(int)
+	if !ok {
+		return 1
+	}
+	return max(w, 0)
+}
+
+func (n *namingResolver) trafficSplit() *TrafficSplit {
+	val, ok := n.split.value()
+	if !ok {
+		return nil
+	}
+	split, err := decodeTrafficSplit(val)
+	if err != nil {
+		n.options.hotLog().Warn("resolver ignores invalid traffic split",
+			logx.F("key", n.split.key), logx.Err(err))
+		return nil
+	}
+	return split
+}
+
+// serviceConfig returns the config document of the service, or nil if
+// there is no valid document.
+func (n *namingResolver) serviceConfig() *ServiceConfig {
+	val, ok := n.svcConfig.value()
+	if !ok {
+		return nil
+	}
+	conf, err := decodeServiceConfig(val)
+	if err != nil {
+		n.options.hotLog().Warn("resolver ignores invalid service config",
+			logx.F("key", n.svcConfig.key), logx.Err(err))
+		return nil
 	}
+	return conf
 }
 
 func (n *namingResolver) ResolveNow(_ resolver.ResolveNowOptions) {
 }
 
 func (n *namingResolver) Close() {
+	n.mu.Lock()
+	if !n.closed {
+		close(n.done)
+	}
+	n.closed = true
+	// nil until subscribe loads etcd
+	if n.sub != nil {
+		n.sub.Close()
+		n.split.sub.Close()
+		n.svcConfig.sub.Close()
+	}
+	n.mu.Unlock()
+	if len(n.options.ConnID) > 0 {
+		namingResolvers.CompareAndDelete(n.options.ConnID, n)
+	}
+}
+
+func (n *namingResolver) isClosed() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *namingResolver) adminState() *resolverState {
+	return n.last.Load()
 }
@@ -0,0 +1,177 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"gamerouter/discover"
+	router "gamerouter/router/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClientConn records the states and errors reported by a resolver.
+type fakeClientConn struct {
+	resolver.ClientConn
+	// delay of UpdateState, so that concurrent updates interleave
+	delay  time.Duration
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (c *fakeClientConn) UpdateState(state resolver.State) error {
+	time.Sleep(c.delay)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, state)
+	return nil
+}
+
+func (c *fakeClientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func (c *fakeClientConn) errors() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.errs)
+}
+
+func TestResolverCloseDuringOutage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the etcd dial timeout")
+	}
+	cc := &fakeClientConn{}
+	r := &namingResolver{
+		cc:          cc,
+		options:     &dialOptions{Endpoints: []string{"127.0.0.1:1"}},
+		serviceName: "outage",
+		key:         MakeEtcdServiceKey(DefaultNamespace, "outage"),
+		done:        make(chan struct{}),
+	}
+	subscribed := make(chan struct{})
+	go func() {
+		r.subscribe()
+		close(subscribed)
+	}()
+	assert.Eventually(t, func() bool { return cc.errors() > 0 },
+		10*time.Second, 10*time.Millisecond)
+
+	// the retries stop with the resolver, nothing is reported anymore
+	r.Close()
+	select {
+	case <-subscribed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscribe still retrying after Close")
+	}
+	errs := cc.errors()
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, errs, cc.errors())
+	assert.Nil(t, r.sub)
+}
+
+func TestResolverConcurrentUpdates(t *testing.T) {
+	// subscribers which are not monitored, their values are set by the test
+	done := make(chan struct{})
+	close(done)
+	newSub := func(key string) *discover.Subscriber {
+		return discover.NewSubscriber(nil, key, discover.WithDone(done))
+	}
+	cc := &fakeClientConn{delay: 100 * time.Microsecond}
+	key := MakeEtcdServiceKey(DefaultNamespace, "concurrent")
+	splitKey := MakeEtcdTrafficSplitKey(DefaultNamespace, "concurrent")
+	confKey := MakeEtcdServiceConfigKey(DefaultNamespace, "concurrent")
+	r := &namingResolver{
+		cc:          cc,
+		options:     &dialOptions{},
+		serviceName: "concurrent",
+		key:         key,
+		done:        make(chan struct{}),
+		sub:         newSub(key),
+		split:       &etcdDoc{sub: newSub(path.Dir(splitKey)), key: splitKey},
+		svcConfig:   &etcdDoc{sub: newSub(path.Dir(confKey)), key: confKey},
+	}
+	r.sub.AddListener(r.update)
+	r.split.sub.AddListener(r.update)
+	r.svcConfig.sub.AddListener(r.update)
+
+	const updates = 100
+	var wg sync.WaitGroup
+	run := func(set func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= updates; i++ {
+				set(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		val, _ := EncodeServerInfo(ServerInfo{Host: "10.0.0.1", Port: 8000,
+			Weight: i}, RecordJSON)
+		r.sub.OnAdd(discover.KV{Key: key + "/10.0.0.1:8000", Val: string(val)})
+	})
+	run(func(i int) {
+		r.split.sub.OnAdd(discover.KV{Key: splitKey,
+			Val: fmt.Sprintf(`{"splits":[{"value":"canary","percent":%d}]}`, i)})
+	})
+	run(func(i int) {
+		r.svcConfig.sub.OnAdd(discover.KV{Key: confKey,
+			Val: fmt.Sprintf(`{"lbPolicy":"policy-%d"}`, i)})
+	})
+	wg.Wait()
+
+	// the last state has the last values of the three subscribers
+	cc.mu.Lock()
+	state := cc.states[len(cc.states)-1]
+	cc.mu.Unlock()
+	infos := state.Attributes.Value(keyServerInfo).([]ServerInfo)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, updates, infos[0].Weight)
+	}
+	split := state.Attributes.Value(keyTrafficSplit).(*TrafficSplit)
+	assert.Equal(t, float64(updates), split.Splits[0].Percent)
+	conf := state.Attributes.Value(keyServiceConfig).(*ServiceConfig)
+	assert.Equal(t, fmt.Sprintf("policy-%d", updates), conf.LbPolicy)
+}
+
+// fakeRouterClient answers GetOneInstanceWithPrefix with one instance.
+type fakeRouterClient struct {
+	router.RouterClient
+	md metadata.MD
+}
+
+func (c *fakeRouterClient) GetOneInstanceWithPrefix(ctx context.Context, _ *router.GetEndpointWithPrefixRequest, _ ...grpc.CallOption) (*router.GetOneInstanceResponse, error) {
+	c.md, _ = metadata.FromOutgoingContext(ctx)
+	return &router.GetOneInstanceResponse{
+		Instance: &router.ServiceInfo{Host: "10.0.0.1", Port: "8000"},
+	}, nil
+}
+
+func TestDynamicPrefixResolverTrace(t *testing.T) {
+	ctx, span := (&tracer{}).start(context.Background(), "dial",
+		SpanKindInternal, SpanContext{})
+	ctx, cancel := context.WithCancel(ctx)
+	cc := &fakeClientConn{}
+	routercli := &fakeRouterClient{}
+	d := &dynamicPrefixResolver{ctx: ctx, cancel: cancel, cc: cc,
+		routercli: routercli, serviceName: "room"}
+	d.update()
+	d.Close()
+
+	// the trace of the dial reaches the router
+	assert.Equal(t, []string{span.SpanContext.String()},
+		routercli.md.Get(TraceparentKey))
+	if assert.Len(t, cc.states, 1) {
+		assert.Equal(t, "10.0.0.1:8000", cc.states[0].Addresses[0].Addr)
+	}
+	assert.NotNil(t, ctx.Err())
+}
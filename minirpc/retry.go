@@ -0,0 +1,485 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the retry budget used if none is configured
+	defaultRetryMaxTokens  = 10
+	defaultRetryTokenRatio = 0.1
+)
+
+type (
+	// RetryPolicy retries failed calls on another instance. The JSON names
+	// follow the gRPC service config, durations are written as "0.1s".
+	RetryPolicy struct {
+		MaxAttempts          int      `json:"maxAttempts"`
+		InitialBackoff       string   `json:"initialBackoff"`
+		MaxBackoff           string   `json:"maxBackoff"`
+		BackoffMultiplier    float64  `json:"backoffMultiplier"`
+		RetryableStatusCodes []string `json:"retryableStatusCodes"`
+		// Idempotent methods are retried on all RetryableStatusCodes, others
+		// only on UNAVAILABLE.
+		Idempotent bool `json:"idempotent,omitempty"`
+
+		initialBackoff time.Duration
+		maxBackoff     time.Duration
+		codes          map[codes.Code]bool
+	}
+
+	// HedgingPolicy sends up to MaxAttempts copies of a call, one every
+	// HedgingDelay, each to another instance, and takes the first answer.
+	// Only use it for idempotent methods.
+	HedgingPolicy struct {
+		MaxAttempts         int      `json:"maxAttempts"`
+		HedgingDelay        string   `json:"hedgingDelay"`
+		NonFatalStatusCodes []string `json:"nonFatalStatusCodes,omitempty"`
+
+		hedgingDelay time.Duration
+		codes        map[codes.Code]bool
+	}
+
+	// RetryThrottling is a token bucket shared by the calls of a
+	// ClientConn. A retryable failure takes a token, a success gives back
+	// TokenRatio, retries and hedges stop while less than half of
+	// MaxTokens are left.
+	RetryThrottling struct {
+		MaxTokens  float64 `json:"maxTokens"`
+		TokenRatio float64 `json:"tokenRatio"`
+	}
+)
+
+// WithRetryPolicy retries method, which is a full method name or AnyMethod.
+// A policy in the service config in etcd takes precedence.
+func WithRetryPolicy(method string, policy RetryPolicy) DialOption {
+	return func(options *dialOptions) {
+		if options.RetryPolicies == nil {
+			options.RetryPolicies = make(map[string]*RetryPolicy)
+		}
+		options.RetryPolicies[method] = &policy
+	}
+}
+
+// WithHedgingPolicy hedges method, which is a full method name or
+// AnyMethod. A policy in the service config in etcd takes precedence.
+func WithHedgingPolicy(method string, policy HedgingPolicy) DialOption {
+	return func(options *dialOptions) {
+		if options.HedgingPolicies == nil {
+			options.HedgingPolicies = make(map[string]*HedgingPolicy)
+		}
+		options.HedgingPolicies[method] = &policy
+	}
+}
+
+// WithRetryThrottling sets the retry budget of the ClientConn, it defaults
+// to 10 tokens and a ratio of 0.1.
+func WithRetryThrottling(maxTokens, tokenRatio float64) DialOption {
+	return func(options *dialOptions) {
+		options.RetryThrottling = &RetryThrottling{
+			MaxTokens:  maxTokens,
+			TokenRatio: tokenRatio,
+		}
+	}
+}
+
+func (p *RetryPolicy) init() error {
+	if p.MaxAttempts < 2 {
+		return fmt.Errorf("retry maxAttempts %d is less than 2", p.MaxAttempts)
+	}
+	var err error
+	if p.initialBackoff, err = parsePositiveDuration(p.InitialBackoff); err != nil {
+		return fmt.Errorf("retry initialBackoff: %v", err)
+	}
+	if p.maxBackoff, err = parsePositiveDuration(p.MaxBackoff); err != nil {
+		return fmt.Errorf("retry maxBackoff: %v", err)
+	}
+	if p.BackoffMultiplier <= 0 {
+		return fmt.Errorf("retry backoffMultiplier %v is not positive",
+			p.BackoffMultiplier)
+	}
+	if len(p.RetryableStatusCodes) == 0 {
+		return fmt.Errorf("retry without retryableStatusCodes")
+	}
+	p.codes, err = parseCodes(p.RetryableStatusCodes)
+	return err
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	if !p.Idempotent && code != codes.Unavailable {
+		return false
+	}
+	return p.codes[code]
+}
+
+// backoff returns the random delay before the given retry, starting at 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := float64(p.initialBackoff)
+	for i := 1; i < retry && d < float64(p.maxBackoff); i++ {
+		d *= p.BackoffMultiplier
+	}
+	d = min(d, float64(p.maxBackoff))
+	return time.Duration(rand.Float64() * d)
+}
+
+func (p *HedgingPolicy) init() error {
+	if p.MaxAttempts < 2 {
+		return fmt.Errorf("hedging maxAttempts %d is less than 2", p.MaxAttempts)
+	}
+	var err error
+	if len(p.HedgingDelay) > 0 {
+		if p.hedgingDelay, err = time.ParseDuration(p.HedgingDelay); err != nil {
+			return fmt.Errorf("hedgingDelay: %v", err)
+		}
+	}
+	p.codes, err = parseCodes(p.NonFatalStatusCodes)
+	return err
+}
+
+func (t *RetryThrottling) validate() error {
+	if t.MaxTokens <= 0 || t.TokenRatio <= 0 {
+		return fmt.Errorf("retry throttling needs positive maxTokens and tokenRatio")
+	}
+	return nil
+}
+
+func parsePositiveDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s is not positive", s)
+	}
+	return d, nil
+}
+
+func parseCodes(names []string) (map[codes.Code]bool, error) {
+	res := make(map[codes.Code]bool, len(names))
+	for _, name := range names {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(`"` + name + `"`)); err != nil {
+			return nil, err
+		}
+		res[code] = true
+	}
+	return res, nil
+}
+
+// validateRetry checks the retry options given to DialContext.
+func (o *dialOptions) validateRetry() error {
+	for method, p := range o.RetryPolicies {
+		if err := p.init(); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+	}
+	for method, p := range o.HedgingPolicies {
+		if err := p.init(); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+	}
+	if o.RetryThrottling != nil {
+		return o.RetryThrottling.validate()
+	}
+	return nil
+}
+
+// retryBudget implements RetryThrottling.
+type retryBudget struct {
+	mu     sync.Mutex
+	conf   RetryThrottling
+	tokens float64
+}
+
+// configure resets the budget if conf changed.
+func (b *retryBudget) configure(conf RetryThrottling) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conf != conf {
+		b.conf = conf
+		b.tokens = conf.MaxTokens
+	}
+}
+
+func (b *retryBudget) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.conf.MaxTokens, b.tokens+b.conf.TokenRatio)
+}
+
+// fail takes a token and tells whether a retry is allowed.
+func (b *retryBudget) fail() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = max(0, b.tokens-1)
+	return b.tokens > b.conf.MaxTokens/2
+}
+
+func (b *retryBudget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens > b.conf.MaxTokens/2
+}
+
+// retryCall remembers the SubConns tried by the attempts of a call, so that
+// namingPicker sends the next attempt elsewhere.
+type retryCall struct {
+	mu    sync.Mutex
+	tried map[balancer.SubConn]bool
+}
+
+type retryCallKey struct{}
+
+func getRetryCall(ctx context.Context) *retryCall {
+	call, _ := ctx.Value(retryCallKey{}).(*retryCall)
+	return call
+}
+
+func (c *retryCall) add(sc balancer.SubConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tried[sc] = true
+}
+
+func (c *retryCall) isTried(sc balancer.SubConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tried[sc]
+}
+
+type retryInterceptor struct {
+	policies   map[string]*RetryPolicy
+	hedging    map[string]*HedgingPolicy
+	throttling *RetryThrottling
+	// svcConfig returns the current service config, may be nil
+	svcConfig func() *ServiceConfig
+	budget    retryBudget
+	// the service config the budget is configured with
+	budgetConf atomic.Pointer[ServiceConfig]
+}
+
+func newRetryInterceptor(options *dialOptions, svcConfig func() *ServiceConfig) *retryInterceptor {
+	r := &retryInterceptor{
+		policies:   options.RetryPolicies,
+		hedging:    options.HedgingPolicies,
+		throttling: options.RetryThrottling,
+		svcConfig:  svcConfig,
+	}
+	r.budget.configure(r.throttlingOf(nil))
+	return r
+}
+
+// throttlingOf returns the retry budget of conf, the service config in etcd
+// overrides the dial options.
+func (r *retryInterceptor) throttlingOf(conf *ServiceConfig) RetryThrottling {
+	if conf != nil && conf.RetryThrottling != nil {
+		return *conf.RetryThrottling
+	}
+	if r.throttling != nil {
+		return *r.throttling
+	}
+	return RetryThrottling{
+		MaxTokens:  defaultRetryMaxTokens,
+		TokenRatio: defaultRetryTokenRatio,
+	}
+}
+
+// policy returns the retry or hedging policy of method, the service config
+// in etcd overrides the dial options.
+func (r *retryInterceptor) policy(method string) (*RetryPolicy, *HedgingPolicy) {
+	var conf *ServiceConfig
+	if r.svcConfig != nil {
+		conf = r.svcConfig()
+	}
+	// the budget is configured once per service config
+	if r.budgetConf.Load() != conf && r.budgetConf.Swap(conf) != conf {
+		r.budget.configure(r.throttlingOf(conf))
+	}
+
+	if mc := conf.methodConfig(method); mc != nil &&
+		(mc.RetryPolicy != nil || mc.HedgingPolicy != nil) {
+		return mc.RetryPolicy, mc.HedgingPolicy
+	}
+	retry, ok := r.policies[method]
+	if !ok {
+		retry = r.policies[AnyMethod]
+	}
+	hedge, ok := r.hedging[method]
+	if !ok {
+		hedge = r.hedging[AnyMethod]
+	}
+	return retry, hedge
+}
+
+// UnaryClientInterceptor retries or hedges calls according to the policy of
+// the method. Hedging needs a proto reply and takes precedence over
+// retries.
+func (r *retryInterceptor) UnaryClientInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply any,
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	retry, hedge := r.policy(method)
+	if retry == nil && hedge == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	ctx = context.WithValue(ctx, retryCallKey{},
+		&retryCall{tried: make(map[balancer.SubConn]bool)})
+	if msg, ok := reply.(proto.Message); ok && hedge != nil {
+		return r.hedge(ctx, hedge, method, req, msg, cc, invoker, opts...)
+	}
+	if retry == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	for attempt := 1; ; attempt++ {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			r.budget.success()
+			return nil
+		}
+		if !retry.retryable(err) {
+			return err
+		}
+		if !r.budget.fail() || attempt >= retry.MaxAttempts {
+			return err
+		}
+		// the server may ask to wait longer, see RetryAfter
+		delay := retry.backoff(attempt)
+		if pushback, ok := RetryAfter(err); ok && pushback > delay {
+			delay = pushback
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *retryInterceptor) hedge(
+	ctx context.Context,
+	policy *HedgingPolicy,
+	method string,
+	req any,
+	reply proto.Message,
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	// the losing attempts are cancelled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		reply proto.Message
+		err   error
+		// copies the outputs of the attempt to the options of the caller
+		outputs func()
+	}
+	results := make(chan result, policy.MaxAttempts)
+	sent, pending := 0, 0
+	send := func() {
+		sent++
+		pending++
+		// every attempt needs its own reply and outputs
+		attemptReply := reply.ProtoReflect().New().Interface()
+		attemptOpts, outputs := attemptOptions(opts)
+		go func() {
+			err := invoker(ctx, method, req, attemptReply, cc, attemptOpts...)
+			results <- result{reply: attemptReply, err: err, outputs: outputs}
+		}()
+	}
+	send()
+	timer := time.NewTimer(policy.hedgingDelay)
+	defer timer.Stop()
+	var last result
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				r.budget.success()
+				proto.Reset(reply)
+				proto.Merge(reply, res.reply)
+				res.outputs()
+				return nil
+			}
+			last = res
+			if !policy.codes[status.Code(res.err)] {
+				res.outputs()
+				return res.err
+			}
+			// a non-fatal failure sends the next attempt at once
+			if r.budget.fail() && sent < policy.MaxAttempts {
+				send()
+				resetTimer(timer, policy.hedgingDelay)
+			}
+		case <-timer.C:
+			if sent < policy.MaxAttempts && r.budget.allow() {
+				send()
+				timer.Reset(policy.hedgingDelay)
+			}
+		}
+	}
+	last.outputs()
+	return last.err
+}
+
+// attemptOptions returns opts with the header, trailer and peer outputs
+// replaced by ones of a hedged attempt, since the attempts run
+// concurrently, and the function copying them to the outputs of opts.
+func attemptOptions(opts []grpc.CallOption) ([]grpc.CallOption, func()) {
+	res := make([]grpc.CallOption, 0, len(opts))
+	var copies []func()
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.HeaderCallOption:
+			md := new(metadata.MD)
+			res = append(res, grpc.Header(md))
+			copies = append(copies, func() { *o.HeaderAddr = *md })
+		case grpc.TrailerCallOption:
+			md := new(metadata.MD)
+			res = append(res, grpc.Trailer(md))
+			copies = append(copies, func() { *o.TrailerAddr = *md })
+		case grpc.PeerCallOption:
+			p := new(peer.Peer)
+			res = append(res, grpc.Peer(p))
+			copies = append(copies, func() { *o.PeerAddr = *p })
+		default:
+			res = append(res, opt)
+		}
+	}
+	return res, func() {
+		for _, c := range copies {
+			c()
+		}
+	}
+}
+
+// resetTimer resets a timer whose channel may not be drained.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,149 @@
+package minirpc
+
+import (
+	"context"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func retryInfos(n int) []ServerInfo {
+	infos := make([]ServerInfo, 0, n)
+	for i := 0; i < n; i++ {
+		infos = append(infos, ServerInfo{Host: "10.0.0.1", Port: 8000 + i, Weight: 1})
+	}
+	return infos
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:          3,
+	InitialBackoff:       "1ms",
+	MaxBackoff:           "5ms",
+	BackoffMultiplier:    2,
+	RetryableStatusCodes: []string{"UNAVAILABLE", "RESOURCE_EXHAUSTED"},
+	Idempotent:           true,
+}
+
+func TestRetryOtherInstance(t *testing.T) {
+	c := newBufCluster(t, retryInfos(3))
+	var mu sync.Mutex
+	var tried []string
+	c.setHandler(func(_ context.Context, addr string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		tried = append(tried, addr)
+		if len(tried) < 3 {
+			return status.Error(codes.Unavailable, "down")
+		}
+		return nil
+	})
+	cli := c.connect(t, WithRetryPolicy(AnyMethod, testRetryPolicy),
+		WithRetryThrottling(100, 1))
+	resp, err := cli.Echo(context.Background(), &echo.EchoRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, tried, 3)
+	// every attempt went to another instance
+	assert.ElementsMatch(t, []string{"10.0.0.1:8000", "10.0.0.1:8001",
+		"10.0.0.1:8002"}, tried)
+	assert.Equal(t, tried[2], resp.Msg)
+}
+
+func TestRetryNotIdempotent(t *testing.T) {
+	c := newBufCluster(t, retryInfos(2))
+	var calls atomic.Int32
+	c.setHandler(func(context.Context, string) error {
+		calls.Add(1)
+		return status.Error(codes.ResourceExhausted, "busy")
+	})
+	policy := testRetryPolicy
+	policy.Idempotent = false
+	cli := c.connect(t, WithRetryPolicy(echoMethod, policy))
+	_, err := cli.Echo(context.Background(), &echo.EchoRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestRetryBudget(t *testing.T) {
+	c := newBufCluster(t, retryInfos(3))
+	var calls atomic.Int32
+	c.setHandler(func(context.Context, string) error {
+		calls.Add(1)
+		return status.Error(codes.Unavailable, "down")
+	})
+	cli := c.connect(t, WithRetryPolicy(AnyMethod, testRetryPolicy),
+		WithRetryThrottling(4, 0.1))
+	for i := 0; i < 5; i++ {
+		_, err := cli.Echo(context.Background(), &echo.EchoRequest{})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+	// 4 tokens allow one retry, then each call is tried once
+	assert.Equal(t, int32(6), calls.Load())
+}
+
+func TestHedging(t *testing.T) {
+	c := newBufCluster(t, retryInfos(3))
+	var mu sync.Mutex
+	var tried []string
+	c.setHandler(func(ctx context.Context, addr string) error {
+		mu.Lock()
+		first := len(tried) == 0
+		tried = append(tried, addr)
+		mu.Unlock()
+		_ = grpc.SetTrailer(ctx, metadata.Pairs("instance", addr))
+		if first {
+			// the slow instance is cancelled by the winner
+			_ = grpc.SendHeader(ctx, metadata.Pairs("instance", addr))
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		_ = grpc.SetHeader(ctx, metadata.Pairs("instance", addr))
+		return nil
+	})
+	cli := c.connect(t, WithHedgingPolicy(echoMethod, HedgingPolicy{
+		MaxAttempts: 3, HedgingDelay: "20ms",
+	}))
+	start := time.Now()
+	var header, trailer metadata.MD
+	resp, err := cli.Echo(context.Background(), &echo.EchoRequest{},
+		grpc.Header(&header), grpc.Trailer(&trailer))
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, tried, 2)
+	assert.NotEqual(t, tried[0], tried[1])
+	assert.Equal(t, tried[1], resp.Msg)
+	// the caller gets the metadata of the winner only
+	assert.Equal(t, []string{tried[1]}, header.Get("instance"))
+	assert.Equal(t, []string{tried[1]}, trailer.Get("instance"))
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	for _, p := range []RetryPolicy{
+		{MaxAttempts: 1},
+		{MaxAttempts: 2, InitialBackoff: "x"},
+		{MaxAttempts: 2, InitialBackoff: "1s", MaxBackoff: "1s"},
+		{MaxAttempts: 2, InitialBackoff: "1s", MaxBackoff: "1s",
+			BackoffMultiplier: 1, RetryableStatusCodes: []string{"NOPE"}},
+	} {
+		assert.NotNil(t, p.init())
+	}
+	p := testRetryPolicy
+	assert.Nil(t, p.init())
+	for i := 1; i < 10; i++ {
+		assert.LessOrEqual(t, p.backoff(i), 5*time.Millisecond)
+	}
+
+	_, err := decodeServiceConfig(`{"methods": [{"name": [{"service": "a"}],
+		"hedgingPolicy": {"maxAttempts": 1}}]}`)
+	assert.NotNil(t, err)
+	_, err = decodeServiceConfig(`{"retryThrottling": {"maxTokens": 0}}`)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,223 @@
+package minirpc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opNotExists
+)
+
+type requirement struct {
+	key    string
+	op     selectorOp
+	values []string
+}
+
+func (r requirement) matches(md map[string]string) bool {
+	val, ok := md[r.key]
+	switch r.op {
+	case opEquals:
+		return ok && val == r.values[0]
+	case opNotEquals:
+		return !ok || val != r.values[0]
+	case opIn:
+		return ok && contains(r.values, val)
+	case opNotIn:
+		return !ok || !contains(r.values, val)
+	case opExists:
+		return ok
+	case opNotExists:
+		return !ok
+	}
+	return false
+}
+
+func (r requirement) String() string {
+	switch r.op {
+	case opEquals:
+		return r.key + "=" + r.values[0]
+	case opNotEquals:
+		return r.key + "!=" + r.values[0]
+	case opIn:
+		return r.key + " in (" + strings.Join(r.values, ",") + ")"
+	case opNotIn:
+		return r.key + " notin (" + strings.Join(r.values, ",") + ")"
+	case opNotExists:
+		return "!" + r.key
+	}
+	return r.key
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Selector selects instances by their ServerMetadata. All requirements
+// must match.
+type Selector struct {
+	reqs []requirement
+}
+
+// ParseSelector parses a comma separated list of requirements:
+//
+//	region=eu          equality, "==" works as well
+//	region!=eu         inequality, also matches a missing key
+//	build in (1.4.2,1.4.3)
+//	build notin (1.4.0)
+//	canary             key exists
+//	!draining          key does not exist
+func ParseSelector(expr string) (Selector, error) {
+	var s Selector
+	for _, part := range splitSelector(expr) {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		req, err := parseRequirement(part)
+		if err != nil {
+			return Selector{}, fmt.Errorf("invalid selector %q: %w", expr, err)
+		}
+		s.reqs = append(s.reqs, req)
+	}
+	return s, nil
+}
+
+// SelectorFromMap returns a Selector requiring every key to equal its value.
+func SelectorFromMap(m map[string]string) Selector {
+	var s Selector
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.reqs = append(s.reqs, requirement{key: k, op: opEquals,
+			values: []string{m[k]}})
+	}
+	return s
+}
+
+// And returns a Selector requiring both s and o.
+func (s Selector) And(o Selector) Selector {
+	reqs := make([]requirement, 0, len(s.reqs)+len(o.reqs))
+	reqs = append(reqs, s.reqs...)
+	reqs = append(reqs, o.reqs...)
+	return Selector{reqs: reqs}
+}
+
+// Empty reports whether s selects everything.
+func (s Selector) Empty() bool {
+	return len(s.reqs) == 0
+}
+
+// Matches reports whether md satisfies all requirements.
+func (s Selector) Matches(md map[string]string) bool {
+	for _, r := range s.reqs {
+		if !r.matches(md) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, 0, len(s.reqs))
+	for _, r := range s.reqs {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitSelector splits expr on the commas which are not inside parentheses.
+func splitSelector(expr string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range expr {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+func parseRequirement(part string) (requirement, error) {
+	if strings.HasPrefix(part, "!") && !strings.ContainsAny(part, "=() ") {
+		return requirement{key: strings.TrimSpace(part[1:]), op: opNotExists}, nil
+	}
+	if idx := strings.Index(part, "!="); idx > 0 {
+		return newRequirement(part[:idx], opNotEquals, part[idx+2:])
+	}
+	if idx := strings.Index(part, "=="); idx > 0 {
+		return newRequirement(part[:idx], opEquals, part[idx+2:])
+	}
+	if idx := strings.Index(part, "="); idx > 0 {
+		return newRequirement(part[:idx], opEquals, part[idx+1:])
+	}
+	fields := strings.Fields(part)
+	if len(fields) == 1 {
+		if strings.ContainsAny(part, "()=!") {
+			return requirement{}, fmt.Errorf("unexpected %q", part)
+		}
+		return requirement{key: fields[0], op: opExists}, nil
+	}
+	if len(fields) < 2 {
+		return requirement{}, fmt.Errorf("unexpected %q", part)
+	}
+	key := fields[0]
+	rest := strings.TrimSpace(strings.TrimPrefix(part, key))
+	var op selectorOp
+	switch {
+	case strings.HasPrefix(rest, "notin"):
+		op, rest = opNotIn, rest[len("notin"):]
+	case strings.HasPrefix(rest, "in"):
+		op, rest = opIn, rest[len("in"):]
+	default:
+		return requirement{}, fmt.Errorf("unknown operator in %q", part)
+	}
+	rest = strings.TrimSpace(rest)
+	if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+		return requirement{}, fmt.Errorf("expect a parenthesized set in %q", part)
+	}
+	var values []string
+	for _, v := range strings.Split(rest[1:len(rest)-1], ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return requirement{}, fmt.Errorf("empty set in %q", part)
+	}
+	return requirement{key: key, op: op, values: values}, nil
+}
+
+func newRequirement(key string, op selectorOp, value string) (requirement, error) {
+	key = strings.TrimSpace(key)
+	if len(key) == 0 || strings.ContainsAny(key, " ()") {
+		return requirement{}, fmt.Errorf("invalid key %q", key)
+	}
+	return requirement{key: key, op: op,
+		values: []string{strings.TrimSpace(value)}}, nil
+}
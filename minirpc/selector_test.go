@@ -0,0 +1,160 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	md := map[string]string{"region": "eu", "build": "1.4.2", "canary": ""}
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{"", true},
+		{"region=eu", true},
+		{"region==eu", true},
+		{"region=us", false},
+		{"region!=us", true},
+		{"zone!=a", true},
+		{"build in (1.4.2, 1.4.3)", true},
+		{"build in (1.4.3)", false},
+		{"build notin (1.4.0,1.4.1)", true},
+		{"zone notin (a)", true},
+		{"canary", true},
+		{"!canary", false},
+		{"!draining", true},
+		{"region=eu,build in (1.4.2),!draining", true},
+		{"region=eu, build=1.4.1", false},
+	}
+	for _, c := range cases {
+		s, err := ParseSelector(c.expr)
+		assert.Nil(t, err, c.expr)
+		assert.Equal(t, c.match, s.Matches(md), c.expr)
+	}
+
+	for _, expr := range []string{"=eu", "build in 1.4.2", "build in ()",
+		"build like (a)", "a b"} {
+		_, err := ParseSelector(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestSelectorString(t *testing.T) {
+	expr := "region=eu,build in (1.4.2,1.4.3),!draining,canary"
+	s, err := ParseSelector(expr)
+	assert.Nil(t, err)
+	assert.Equal(t, expr, s.String())
+
+	s = SelectorFromMap(map[string]string{"b": "2", "a": "1"})
+	assert.Equal(t, "a=1,b=2", s.String())
+}
+
+type fakeSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+// newTestPicker builds a picker as namingBalancer does, with every
+// instance ready.
+func newTestPicker(t *testing.T, infos []ServerInfo, opts ...DialOption) *namingPicker {
+	options := &dialOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	selector, err := options.selector()
+	assert.Nil(t, err)
+	n := &namingBalancer{
+		serviceName: "test",
+		serverInfos: infos,
+		selector:    selector,
+		dialOptions: options,
+		subConns:    make(map[string]balancer.SubConn),
+	}
+	readySCs := make(map[string]balancer.SubConn)
+	for _, info := range infos {
+		addr := instanceAddr(info)
+		readySCs[addr] = &fakeSubConn{addr: addr}
+		n.subConns[addr] = readySCs[addr]
+	}
+	p := newNamingPicker(n, readySCs, options, filterInstances(infos, selector))
+	p.readyInstances = infos
+	p.knownInstances = infos
+	p.selector = selector
+	return p
+}
+
+func pickAddr(t *testing.T, p *namingPicker, ctx context.Context) string {
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+	assert.Nil(t, err)
+	if err != nil {
+		return ""
+	}
+	return res.SubConn.(*fakeSubConn).addr
+}
+
+func TestPickerSelector(t *testing.T) {
+	infos := []ServerInfo{
+		{Host: "10.0.0.1", Port: 1, Weight: 1,
+			ServerMetadata: map[string]string{"region": "eu", "build": "1.4.2"}},
+		{Host: "10.0.0.2", Port: 1, Weight: 1,
+			ServerMetadata: map[string]string{"region": "eu", "build": "1.4.1"}},
+		{Host: "10.0.0.3", Port: 1, Weight: 1,
+			ServerMetadata: map[string]string{"region": "us", "build": "1.4.2"}},
+	}
+	p := newTestPicker(t, infos, WithDstMetadata(map[string]string{"region": "eu"}),
+		WithDstSelector("build=1.4.2"))
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "10.0.0.1:1", pickAddr(t, p, ctx))
+	}
+
+	// per-request selectors replace the dial time one
+	rctx := RequestScopeDstSelector(ctx, "region=us")
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "10.0.0.3:1", pickAddr(t, p, rctx))
+	}
+
+	_, err := p.Pick(balancer.PickInfo{
+		Ctx: RequestScopeDstSelector(ctx, "region=cn")})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = p.Pick(balancer.PickInfo{
+		Ctx: RequestScopeDstSelector(ctx, "region in cn")})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestPickerSelectorCache(t *testing.T) {
+	infos := []ServerInfo{
+		{Host: "10.0.0.1", Port: 1, Weight: 1,
+			ServerMetadata: map[string]string{"region": "eu"}},
+		{Host: "10.0.0.2", Port: 1, Weight: 1,
+			ServerMetadata: map[string]string{"region": "us"}},
+	}
+	p := newTestPicker(t, infos)
+	ctx := context.Background()
+	eu := RequestScopeDstSelector(ctx, "region=eu")
+	assert.Equal(t, "10.0.0.1:1", pickAddr(t, p, eu))
+	first, _ := p.subPickers.get("region=eu")
+
+	// selectors built per request, e.g. with a player ID, do not pile up
+	for i := 0; i < 10*maxSubPickers; i++ {
+		sctx := RequestScopeDstSelector(ctx, fmt.Sprintf("region=us,player!=%d", i))
+		assert.Equal(t, "10.0.0.2:1", pickAddr(t, p, sctx))
+		if i%(maxSubPickers/2) == 0 {
+			// keeps the selector in use
+			assert.Equal(t, "10.0.0.1:1", pickAddr(t, p, eu))
+		}
+	}
+	assert.Equal(t, maxSubPickers, p.subPickers.len())
+	sub, ok := p.subPickers.get("region=eu")
+	assert.True(t, ok)
+	assert.Same(t, first, sub)
+	_, ok = p.subPickers.get("region=us,player!=0")
+	assert.False(t, ok)
+}
@@ -1,7 +1,6 @@
 package minirpc
 
 import (
-	"encoding/json"
 	"fmt"
 	"gamerouter/discover"
 	"google.golang.org/grpc"
@@ -21,18 +20,31 @@ type (
 		Host           string
 		Port           int
 		ServerMetadata map[string]string
+		Region         string
+		Zone           string
+		// Priority is the failover level, clients only route to the lowest
+		// level with enough ready instances. 0 is the primary.
+		Priority int
 	}
 
 	Server struct {
 		*grpc.Server
 		endpoints []string
 		info      ServerInfo
+		format    RecordFormat
 		publisher *discover.Publisher
 	}
 )
 
 type ServerOption func(option *Server)
 
+// Draining reports whether the instance takes no new calls, i.e. its
+// metadata has the DrainingMetadata key.
+func (s ServerInfo) Draining() bool {
+	_, ok := s.ServerMetadata[DrainingMetadata]
+	return ok
+}
+
 func WithServiceName(name string) ServerOption {
 	return func(s *Server) {
 		s.info.ServiceName = name
@@ -51,18 +63,51 @@ func WithServerNamespace(name string) ServerOption {
 	}
 }
 
+// WithHost sets the host published to clients, the host of the listener by
+// default.
+func WithHost(host string) ServerOption {
+	return func(s *Server) {
+		s.info.Host = host
+	}
+}
+
 func WithServerMetadata(metadata map[string]string) ServerOption {
 	return func(s *Server) {
 		s.info.ServerMetadata = metadata
 	}
 }
 
+// WithServerLocality advertises where the instance runs, clients dialled
+// with WithLocality prefer instances in their own zone.
+func WithServerLocality(region, zone string) ServerOption {
+	return func(s *Server) {
+		s.info.Region = region
+		s.info.Zone = zone
+	}
+}
+
+// WithPriority sets the failover level of the instance, e.g. 1 for a hot
+// standby of primaries with priority 0.
+func WithPriority(priority int) ServerOption {
+	return func(s *Server) {
+		s.info.Priority = priority
+	}
+}
+
 func WithEtcdEndPoints(endpoints []string) ServerOption {
 	return func(s *Server) {
 		s.endpoints = endpoints
 	}
 }
 
+// WithRecordFormat sets the encoding of the published instance record,
+// RecordJSON by default. Use RecordProto once no client predates it.
+func WithRecordFormat(format RecordFormat) ServerOption {
+	return func(s *Server) {
+		s.format = format
+	}
+}
+
 func WithWeight(weight int) ServerOption {
 	return func(s *Server) {
 		s.info.Weight = weight
@@ -146,8 +191,7 @@ func parsePort(addr string) (int, error) {
 func (s *Server) pubToEtcd(endpoints []string, conf ServerInfo) error {
 	key := MakeEtcdInstanceKey(conf.Namespace, conf.ServiceName,
 		conf.InstanceID)
-	val, err := json.Marshal(conf)
-
+	val, err := EncodeServerInfo(conf, s.format)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,335 @@
+package minirpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gamerouter/logx"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// StaticScheme resolves the instances listed in the target, e.g.
+	//
+	//	static://echo/127.0.0.1:8000;weight=3;zone=eu-1a,127.0.0.1:8001
+	//
+	// Each instance is an address followed by ;key=value attributes: weight,
+	// priority, region, zone and id set the ServerInfo fields, the other
+	// keys are server metadata.
+	StaticScheme = "static"
+	// FileScheme resolves the instances of a JSON file and reloads it when
+	// it changes, e.g. file://echo/etc/instances.json, or
+	// file://echo/./instances.json for a path relative to the working
+	// directory. The file is an array of instance records as published in
+	// etcd, the records of other services are skipped.
+	FileScheme = "file"
+)
+
+// fileResolverInterval is how often file resolvers check their file.
+var fileResolverInterval = time.Second
+
+type (
+	staticResolverBuilder struct {
+		options *dialOptions
+	}
+	fileResolverBuilder struct {
+		options *dialOptions
+	}
+
+	// directResolver resolves a fixed or file-backed list of instances,
+	// without a registry.
+	directResolver struct {
+		cc          resolver.ClientConn
+		options     *dialOptions
+		serviceName string
+		// the last update, for the admin endpoint
+		last atomic.Pointer[resolverState]
+
+		// file resolvers only
+		path       string
+		interval   time.Duration
+		content    []byte
+		resolveNow chan struct{}
+		done       chan struct{}
+
+		reportedError
+	}
+)
+
+func (b *staticResolverBuilder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	_ resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	d, err := newDirectResolver(target, cc, builderOptions(b.options))
+	if err != nil {
+		return nil, err
+	}
+	infos, err := parseStaticInstances(strings.TrimPrefix(target.URL.Path, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid static target %s: %w", target.URL.Path, err)
+	}
+	d.register()
+	d.update(d.withDefaults(infos))
+	return d, nil
+}
+
+func (b *staticResolverBuilder) Scheme() string {
+	return StaticScheme
+}
+
+func (b *fileResolverBuilder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	_ resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	d, err := newDirectResolver(target, cc, builderOptions(b.options))
+	if err != nil {
+		return nil, err
+	}
+	d.path = target.URL.Path
+	if strings.HasPrefix(d.path, "/./") || strings.HasPrefix(d.path, "/../") {
+		d.path = d.path[1:]
+	}
+	if len(d.path) == 0 || d.path == "/" {
+		return nil, fmt.Errorf("no file in target %s", target.URL.String())
+	}
+	d.interval = fileResolverInterval
+	d.resolveNow = make(chan struct{}, 1)
+	d.done = make(chan struct{})
+	d.register()
+	d.reload()
+	go d.watch()
+	return d, nil
+}
+
+func (b *fileResolverBuilder) Scheme() string {
+	return FileScheme
+}
+
+func newDirectResolver(target resolver.Target, cc resolver.ClientConn, options *dialOptions) (*directResolver, error) {
+	if len(target.URL.Host) == 0 {
+		return nil, fmt.Errorf("no service name in target %s", target.URL.String())
+	}
+	return &directResolver{
+		cc:          cc,
+		options:     options,
+		serviceName: target.URL.Host,
+	}, nil
+}
+
+func (d *directResolver) register() {
+	if len(d.options.ConnID) > 0 {
+		namingResolvers.Store(d.options.ConnID, d)
+	}
+}
+
+// parseStaticInstances parses the instances of a static target.
+func parseStaticInstances(spec string) ([]ServerInfo, error) {
+	var infos []ServerInfo
+	for _, entry := range strings.Split(spec, EndPointSep) {
+		if len(entry) == 0 {
+			continue
+		}
+		attrs := strings.Split(entry, ";")
+		host, port, err := parseHost(attrs[0])
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", attrs[0], err)
+		}
+		info := ServerInfo{Host: host, Port: port}
+		for _, attr := range attrs[1:] {
+			key, val, _ := strings.Cut(attr, "=")
+			switch key {
+			case "weight":
+				info.Weight, err = strconv.Atoi(val)
+			case "priority":
+				info.Priority, err = strconv.Atoi(val)
+			case "region":
+				info.Region = val
+			case "zone":
+				info.Zone = val
+			case "id":
+				info.InstanceID = val
+			default:
+				if info.ServerMetadata == nil {
+					info.ServerMetadata = make(map[string]string)
+				}
+				info.ServerMetadata[key] = val
+			}
+			if err != nil {
+				return nil, fmt.Errorf("instance %s: %s: %w", attrs[0], key, err)
+			}
+		}
+		if err = info.Validate(); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", attrs[0], err)
+		}
+		infos = append(infos, info)
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("no instance")
+	}
+	return infos, nil
+}
+
+// parseInstanceFile parses the records of a file, skipping the records of
+// other services.
+func parseInstanceFile(serviceName string, content []byte) ([]ServerInfo, error) {
+	var records []json.RawMessage
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, err
+	}
+	infos := make([]ServerInfo, 0, len(records))
+	for i, record := range records {
+		info, err := DecodeServerInfo(record)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if len(info.ServiceName) == 0 || info.ServiceName == serviceName {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// withDefaults fills in the fields servers set when they register.
+func (d *directResolver) withDefaults(infos []ServerInfo) []ServerInfo {
+	for i := range infos {
+		info := &infos[i]
+		if len(info.Namespace) == 0 {
+			info.Namespace = getNamespace(d.options)
+		}
+		if len(info.ServiceName) == 0 {
+			info.ServiceName = d.serviceName
+		}
+		if len(info.InstanceID) == 0 {
+			info.InstanceID = instanceAddr(*info)
+		}
+		if info.Weight == 0 {
+			info.Weight = 1
+		}
+	}
+	return infos
+}
+
+func (d *directResolver) update(infos []ServerInfo) {
+	ready := make([]ServerInfo, 0, len(infos))
+	var draining []string
+	for _, info := range infos {
+		if info.Draining() {
+			draining = append(draining, instanceAddr(info))
+			continue
+		}
+		ready = append(ready, info)
+	}
+	last := &resolverState{
+		ConnID:    d.options.ConnID,
+		Namespace: getNamespace(d.options),
+		Service:   d.serviceName,
+		Instances: ready,
+		Draining:  draining,
+		Updated:   time.Now(),
+	}
+	state := resolver.State{
+		Attributes: attributes.New(keyDialOptions, d.options).
+			WithValue(keyServerInfo, ready),
+	}
+	if len(ready) == 0 {
+		err := d.noInstanceError(len(draining))
+		last.Error = err.Error()
+		d.last.Store(last)
+		// the balancer drops the instances and fails the calls with err
+		state.Attributes = state.Attributes.WithValue(keyResolverError, err)
+		d.set(err)
+		_ = d.cc.UpdateState(state)
+		d.report(d.cc, err)
+		return
+	}
+	d.last.Store(last)
+	d.clear()
+	for _, info := range ready {
+		state.Addresses = append(state.Addresses, newAddress(info))
+	}
+	if err := d.cc.UpdateState(state); err != nil {
+		d.options.hotLog().Warn("resolver failed to update state",
+			logx.Service(d.serviceName), logx.Err(err))
+	}
+}
+
+// noInstanceError explains why the resolver has no instance to update.
+func (d *directResolver) noInstanceError(draining int) error {
+	if draining > 0 {
+		return fmt.Errorf("%w: %d instances of %s", ErrAllInstancesDraining,
+			draining, d.serviceName)
+	}
+	if len(d.path) > 0 {
+		return fmt.Errorf("%w: no instance of %s in %s", ErrServiceNotFound,
+			d.serviceName, d.path)
+	}
+	return fmt.Errorf("%w: no instance of %s", ErrServiceNotFound, d.serviceName)
+}
+
+// reload updates the instances if the file changed. A file which cannot be
+// read or parsed keeps the last instances.
+func (d *directResolver) reload() {
+	content, err := os.ReadFile(d.path)
+	if err == nil && bytes.Equal(content, d.content) {
+		return
+	}
+	var infos []ServerInfo
+	if err == nil {
+		infos, err = parseInstanceFile(d.serviceName, content)
+	}
+	if err != nil {
+		err = fmt.Errorf("instance file %s: %w", d.path, err)
+		d.options.hotLog().Warn("file resolver failed to load instances",
+			logx.Service(d.serviceName), logx.Err(err))
+		if d.last.Load() == nil {
+			d.report(d.cc, err)
+		}
+		return
+	}
+	d.content = content
+	d.update(d.withDefaults(infos))
+}
+
+func (d *directResolver) watch() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		case <-d.resolveNow:
+		}
+		d.reload()
+	}
+}
+
+func (d *directResolver) ResolveNow(_ resolver.ResolveNowOptions) {
+	if d.resolveNow != nil {
+		select {
+		case d.resolveNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *directResolver) Close() {
+	if d.done != nil {
+		close(d.done)
+	}
+	if len(d.options.ConnID) > 0 {
+		namingResolvers.CompareAndDelete(d.options.ConnID, d)
+	}
+}
+
+func (d *directResolver) adminState() *resolverState {
+	return d.last.Load()
+}
@@ -0,0 +1,213 @@
+package minirpc
+
+import (
+	"context"
+	"encoding/json"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStaticInstances(t *testing.T) {
+	infos, err := parseStaticInstances(
+		"10.0.0.1:8000;weight=3;zone=eu-1a;version=v2,10.0.0.1:8001;priority=1;id=b")
+	assert.Nil(t, err)
+	assert.Equal(t, []ServerInfo{
+		{Host: "10.0.0.1", Port: 8000, Weight: 3, Zone: "eu-1a",
+			ServerMetadata: map[string]string{"version": "v2"}},
+		{Host: "10.0.0.1", Port: 8001, Priority: 1, InstanceID: "b"},
+	}, infos)
+
+	for _, spec := range []string{"", "10.0.0.1", "10.0.0.1:x", "10.0.0.1:8000;weight=x",
+		"10.0.0.1:8000;weight=-1"} {
+		_, err = parseStaticInstances(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+// dialDirect dials target through DialContext, connecting to the servers
+// of c.
+func (c *bufCluster) dialDirect(t *testing.T, target string, opts ...DialOption) echo.EchoServerClient {
+	cc, err := DialContext(context.Background(), target, append([]DialOption{
+		WithGRPCDialOptions(
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(c.dial)),
+	}, opts...)...)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = cc.Close() })
+	c.cc = cc
+	return echo.NewEchoServerClient(cc)
+}
+
+func TestStaticResolver(t *testing.T) {
+	c := newBufCluster(t, retryInfos(3))
+	target := "static://test/10.0.0.1:8000;weight=2;version=v1," +
+		"10.0.0.1:8001;version=v2,10.0.0.1:8002;version=v2"
+	cli := c.dialDirect(t, target, WithLoadBalancer(WeightRandom),
+		WithDstMetadata(map[string]string{"version": "v2"}))
+	counts := addrCounts(t, cli, 60)
+	assert.Zero(t, counts["10.0.0.1:8000"])
+	assert.Len(t, counts, 2)
+
+	infos, err := Instances(c.cc)
+	assert.Nil(t, err)
+	assert.Len(t, infos, 3)
+	assert.Equal(t, ServerInfo{Namespace: DefaultNamespace, ServiceName: "test",
+		InstanceID: "10.0.0.1:8000", Host: "10.0.0.1", Port: 8000, Weight: 2,
+		ServerMetadata: map[string]string{"version": "v1"}}, infos[0])
+
+	// hash routing sticks to an instance
+	cli = c.dialDirect(t, target, WithLoadBalancer(KetamaWeightName))
+	addrCounts(t, cli, 1)
+	for i := 0; i < 100 && len(connBalancerState(t, c).Picking) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	hosts := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(
+			RequestScopeHashKey(context.Background(), "player-1"), time.Second)
+		resp, err := cli.Echo(ctx, &echo.EchoRequest{}, grpc.WaitForReady(true))
+		cancel()
+		assert.Nil(t, err)
+		hosts[resp.GetMsg()] = true
+	}
+	assert.Len(t, hosts, 1)
+
+	_, err = DialContext(context.Background(), "static://test/10.0.0.1",
+		WithGRPCDialOptions(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	assert.NotNil(t, err)
+}
+
+// addrCounts calls the cluster n times and counts the answers per address.
+func addrCounts(t *testing.T, cli echo.EchoServerClient, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := cli.Echo(ctx, &echo.EchoRequest{}, grpc.WaitForReady(true))
+		cancel()
+		if assert.Nil(t, err) {
+			counts[resp.GetMsg()]++
+		}
+	}
+	return counts
+}
+
+func writeInstanceFile(t *testing.T, path string, infos []ServerInfo) {
+	records := make([]json.RawMessage, 0, len(infos))
+	for _, info := range infos {
+		record, err := EncodeServerInfo(info, RecordJSON)
+		assert.Nil(t, err)
+		records = append(records, record)
+	}
+	data, err := json.Marshal(records)
+	assert.Nil(t, err)
+	replaceFile(t, path, data)
+}
+
+// replaceFile writes path atomically, so that the resolver never reads a
+// partial file.
+func replaceFile(t *testing.T, path string, data []byte) {
+	tmp := path + ".tmp"
+	assert.Nil(t, os.WriteFile(tmp, data, 0o644))
+	assert.Nil(t, os.Rename(tmp, path))
+}
+
+func TestFileResolver(t *testing.T) {
+	old := fileResolverInterval
+	fileResolverInterval = 10 * time.Millisecond
+	t.Cleanup(func() { fileResolverInterval = old })
+
+	infos := retryInfos(2)
+	c := newBufCluster(t, infos)
+	path := filepath.Join(t.TempDir(), "instances.json")
+	other := ServerInfo{ServiceName: "other", Host: "10.0.0.2", Port: 8000}
+	writeInstanceFile(t, path, []ServerInfo{infos[0], other})
+
+	cli := c.dialDirect(t, "file://test"+path)
+	assert.Equal(t, map[string]int{"10.0.0.1:8000": 10}, addrCounts(t, cli, 10))
+
+	waitInstances := func(n int) []ServerInfo {
+		var res []ServerInfo
+		for i := 0; i < 100; i++ {
+			var err error
+			res, err = Instances(c.cc)
+			assert.Nil(t, err)
+			if len(res) == n {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return res
+	}
+	writeInstanceFile(t, path, infos)
+	assert.Len(t, waitInstances(2), 2)
+	assert.Len(t, addrCounts(t, cli, 40), 2)
+
+	// a malformed file keeps the last instances
+	replaceFile(t, path, []byte(`[{"Host":""}]`))
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, waitInstances(2), 2)
+
+	var states []resolverState
+	getAdmin(t, "/resolvers", &states)
+	connID, err := connIDOf(c.cc)
+	assert.Nil(t, err)
+	found := false
+	for _, state := range states {
+		if state.ConnID == connID {
+			found = true
+			assert.Equal(t, "test", state.Service)
+			assert.Len(t, state.Instances, 2)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestFileResolverDrain(t *testing.T) {
+	old := fileResolverInterval
+	fileResolverInterval = 10 * time.Millisecond
+	t.Cleanup(func() { fileResolverInterval = old })
+
+	infos := retryInfos(2)
+	c := newBufCluster(t, infos)
+	path := filepath.Join(t.TempDir(), "instances.json")
+	writeInstanceFile(t, path, infos)
+	cli := c.dialDirect(t, "file://test"+path)
+	assert.Len(t, addrCounts(t, cli, 20), 2)
+
+	draining := retryInfos(2)
+	for i := range draining {
+		draining[i].ServerMetadata = map[string]string{DrainingMetadata: ""}
+	}
+	writeInstanceFile(t, path, draining)
+	var err error
+	assert.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = cli.Echo(ctx, &echo.EchoRequest{})
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), ErrAllInstancesDraining.Error())
+	assert.ErrorIs(t, resolverError(c.cc), ErrAllInstancesDraining)
+
+	// the instances are dialled again once they stop draining
+	writeInstanceFile(t, path, infos)
+	assert.Len(t, addrCounts(t, cli, 20), 2)
+}
+
+func TestDirectResolverNoInstanceError(t *testing.T) {
+	d := &directResolver{serviceName: "test"}
+	assert.Equal(t, "service not found: no instance of test", d.noInstanceError(0).Error())
+	d.path = "/etc/instances.json"
+	assert.Equal(t, "service not found: no instance of test in /etc/instances.json",
+		d.noInstanceError(0).Error())
+	assert.ErrorIs(t, d.noInstanceError(2), ErrAllInstancesDraining)
+}
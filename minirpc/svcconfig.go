@@ -0,0 +1,170 @@
+package minirpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gamerouter/discover"
+	"strings"
+	"time"
+)
+
+const (
+	ServiceConfigRoot = "/svcconfig"
+
+	keyServiceConfig = "service_config"
+)
+
+type (
+	// ServiceConfig is the per-service config document stored in etcd under
+	// MakeEtcdServiceConfigKey. Running clients apply changes without a
+	// redeploy.
+	ServiceConfig struct {
+		// LbPolicy replaces the policy of WithLoadBalancer for all methods.
+		LbPolicy        string           `json:"lbPolicy,omitempty"`
+		Methods         []MethodConfig   `json:"methods,omitempty"`
+		RetryThrottling *RetryThrottling `json:"retryThrottling,omitempty"`
+	}
+
+	// MethodConfig configures the methods matching Name, the other fields
+	// follow the gRPC service config. Retries and hedging are done by
+	// minirpc, so that they go to other instances.
+	MethodConfig struct {
+		Name         []MethodName `json:"name"`
+		LbPolicy     string       `json:"lbPolicy,omitempty"`
+		HashKeyField string       `json:"hashKeyField,omitempty"`
+		// Timeout is a duration such as "1.5s", it shortens the deadline
+		// of the caller.
+		Timeout       string         `json:"timeout,omitempty"`
+		RetryPolicy   *RetryPolicy   `json:"retryPolicy,omitempty"`
+		HedgingPolicy *HedgingPolicy `json:"hedgingPolicy,omitempty"`
+	}
+
+	// MethodName matches a method, an empty Method matches every method of
+	// Service.
+	MethodName struct {
+		Service string `json:"service"`
+		Method  string `json:"method,omitempty"`
+	}
+)
+
+// MakeEtcdServiceConfigKey returns the etcd key of the config document.
+func MakeEtcdServiceConfigKey(namespace, servicename string) string {
+	return fmt.Sprintf("%s/%s/%s/config", ServiceConfigRoot, namespace,
+		servicename)
+}
+
+// SetServiceConfig stores conf in etcd, a nil conf removes the current one.
+func SetServiceConfig(ctx context.Context, endpoints []string, namespace, servicename string, conf *ServiceConfig) error {
+	registry, err := discover.OpenRegistry(endpoints)
+	if err != nil {
+		return fmt.Errorf("etcd %v: %w", endpoints, err)
+	}
+	cli := registry.GetConn()
+	key := MakeEtcdServiceConfigKey(namespace, servicename)
+	if conf == nil {
+		_, err := cli.Delete(ctx, key)
+		return err
+	}
+	val, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	_, err = cli.Put(ctx, key, string(val))
+	return err
+}
+
+// methodConfig returns the config of a full method name such as
+// "/echo.EchoServer/Echo", an exact match wins over a service match.
+func (c *ServiceConfig) methodConfig(fullMethod string) *MethodConfig {
+	if c == nil {
+		return nil
+	}
+	service, method := splitMethod(fullMethod)
+	var res *MethodConfig
+	for i := range c.Methods {
+		for _, name := range c.Methods[i].Name {
+			if name.Service != service {
+				continue
+			}
+			if name.Method == method {
+				return &c.Methods[i]
+			}
+			if len(name.Method) == 0 && res == nil {
+				res = &c.Methods[i]
+			}
+		}
+	}
+	return res
+}
+
+// lbPolicy returns the policy configured for fullMethod, or "" if none.
+func (c *ServiceConfig) lbPolicy(fullMethod string) string {
+	if c == nil {
+		return ""
+	}
+	if mc := c.methodConfig(fullMethod); mc != nil && len(mc.LbPolicy) > 0 {
+		return mc.LbPolicy
+	}
+	return c.LbPolicy
+}
+
+// hashKeyField returns the hash key field configured for fullMethod.
+func (c *ServiceConfig) hashKeyField(fullMethod string) string {
+	if mc := c.methodConfig(fullMethod); mc != nil {
+		return mc.HashKeyField
+	}
+	return ""
+}
+
+// timeout returns the timeout configured for fullMethod, 0 if none.
+func (c *ServiceConfig) timeout(fullMethod string) time.Duration {
+	if mc := c.methodConfig(fullMethod); mc != nil && len(mc.Timeout) > 0 {
+		// checked by decodeServiceConfig
+		timeout, _ := time.ParseDuration(mc.Timeout)
+		return timeout
+	}
+	return 0
+}
+
+func decodeServiceConfig(val string) (*ServiceConfig, error) {
+	conf := &ServiceConfig{}
+	if err := json.Unmarshal([]byte(val), conf); err != nil {
+		return nil, err
+	}
+	for _, mc := range conf.Methods {
+		if len(mc.Name) == 0 {
+			return nil, fmt.Errorf("method config without name")
+		}
+		if len(mc.Timeout) > 0 {
+			if _, err := time.ParseDuration(mc.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout: %w", err)
+			}
+		}
+		if mc.RetryPolicy != nil {
+			if err := mc.RetryPolicy.init(); err != nil {
+				return nil, err
+			}
+		}
+		if mc.HedgingPolicy != nil {
+			if err := mc.HedgingPolicy.init(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if conf.RetryThrottling != nil {
+		if err := conf.RetryThrottling.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+// splitMethod splits "/package.Service/Method" into its service and method.
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if idx := strings.LastIndex(fullMethod, "/"); idx >= 0 {
+		return fullMethod[:idx], fullMethod[idx+1:]
+	}
+	return fullMethod, ""
+}
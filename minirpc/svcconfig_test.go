@@ -0,0 +1,127 @@
+package minirpc
+
+import (
+	"context"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestServiceConfigMethod(t *testing.T) {
+	conf, err := decodeServiceConfig(`{
+		"lbPolicy": "random",
+		"methods": [
+			{"name": [{"service": "echo.EchoServer"}], "lbPolicy": "maglev"},
+			{"name": [{"service": "echo.EchoServer", "method": "Echo"}],
+			 "lbPolicy": "rendezvous", "hashKeyField": "msg"}
+		]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, Rendezvous, conf.lbPolicy(echoMethod))
+	assert.Equal(t, "msg", conf.hashKeyField(echoMethod))
+	assert.Equal(t, Maglev, conf.lbPolicy("/echo.EchoServer/Other"))
+	assert.Equal(t, "", conf.hashKeyField("/echo.EchoServer/Other"))
+	assert.Equal(t, Random, conf.lbPolicy("/router/Other"))
+
+	var nilConf *ServiceConfig
+	assert.Equal(t, "", nilConf.lbPolicy(echoMethod))
+	assert.Equal(t, "", nilConf.hashKeyField(echoMethod))
+
+	_, err = decodeServiceConfig(`{"methods": [{"lbPolicy": "maglev"}]}`)
+	assert.NotNil(t, err)
+	_, err = decodeServiceConfig(`{"methods": 1}`)
+	assert.NotNil(t, err)
+}
+
+func TestServiceConfigTimeout(t *testing.T) {
+	conf, err := decodeServiceConfig(`{"methods":[
+		{"name":[{"service":"echo.EchoServer","method":"Echo"}],"timeout":"50ms"}]}`)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 50*time.Millisecond, conf.timeout(echoMethod))
+	assert.Zero(t, conf.timeout("/echo.EchoServer/Other"))
+	assert.Zero(t, (*ServiceConfig)(nil).timeout(echoMethod))
+	_, err = decodeServiceConfig(`{"methods":[
+		{"name":[{"service":"echo.EchoServer"}],"timeout":"soon"}]}`)
+	assert.NotNil(t, err)
+
+	c := newBufCluster(t, retryInfos(1))
+	c.handler = func(ctx context.Context, _ string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	cli := c.dialDirect(t, "static://test/10.0.0.1:8000", WithCallTimeout(5*time.Second))
+	n, err := getNamingBalancer(c.cc)
+	if !assert.Nil(t, err) {
+		return
+	}
+	n.svcConfig.Store(conf)
+	// the method timeout shortens the deadline of the caller
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err = cli.Echo(ctx, &echo.EchoRequest{})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestPickerServiceConfig(t *testing.T) {
+	infos := make([]ServerInfo, 0, 5)
+	for i := 0; i < 5; i++ {
+		infos = append(infos, ServerInfo{Host: "10.0.0.1", Port: 8000 + i, Weight: 1})
+	}
+	p := newTestPicker(t, infos)
+	p.svcConfig = &ServiceConfig{Methods: []MethodConfig{{
+		Name:     []MethodName{{Service: "echo.EchoServer", Method: "Echo"}},
+		LbPolicy: Rendezvous,
+	}}}
+	ctx := RequestScopeHashKey(context.Background(), "player-42")
+	first := pickMethod(t, p, ctx, echoMethod)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, pickMethod(t, p, ctx, echoMethod))
+	}
+	// other methods keep the random dial time policy
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[pickMethod(t, p, ctx, "/echo.EchoServer/Other")] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func pickMethod(t *testing.T, p *namingPicker, ctx context.Context, method string) string {
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx, FullMethodName: method})
+	assert.Nil(t, err)
+	if err != nil {
+		return ""
+	}
+	return res.SubConn.(*fakeSubConn).addr
+}
+
+func TestHashKeyFromServiceConfig(t *testing.T) {
+	conf := &ServiceConfig{Methods: []MethodConfig{{
+		Name:         []MethodName{{Service: "echo.EchoServer"}},
+		HashKeyField: "msg",
+	}}}
+	e := newHashKeyExtractor(nil, func() *ServiceConfig { return conf })
+	ctx := context.Background()
+	assert.Equal(t, "hello", invokeHashKey(t, e, ctx, echoMethod,
+		&echo.EchoRequest{Msg: "hello"}))
+
+	// a config change takes effect at once
+	conf = nil
+	assert.Equal(t, "", invokeHashKey(t, e, ctx, echoMethod,
+		&echo.EchoRequest{Msg: "hello"}))
+}
+
+func TestSetServiceConfigUnreachable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the etcd dial timeout")
+	}
+	err := SetServiceConfig(context.Background(), []string{"127.0.0.1:1"},
+		DefaultNamespace, "test", nil)
+	assert.NotNil(t, err)
+}
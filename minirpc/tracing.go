@@ -0,0 +1,359 @@
+package minirpc
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"gamerouter/logx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentKey is the metadata key of the W3C trace context.
+const TraceparentKey = "traceparent"
+
+// attributes set on spans
+const (
+	SpanAttrService  = "rpc.service"
+	SpanAttrMethod   = "rpc.method"
+	SpanAttrCaller   = "rpc.caller"
+	SpanAttrInstance = "minirpc.instance"
+	SpanAttrLbPolicy = "minirpc.lb_policy"
+	SpanAttrHashKey  = "minirpc.hash_key"
+	SpanAttrAttempts = "minirpc.attempts"
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+
+	// SpanContext is the part of a span propagated to other processes.
+	SpanContext struct {
+		TraceID TraceID
+		SpanID  SpanID
+		Sampled bool
+	}
+
+	SpanKind int
+
+	// Span is an operation of a trace. The fields are set once the span
+	// ended, when it is passed to the SpanExporter.
+	Span struct {
+		SpanContext
+		Name     string
+		Kind     SpanKind
+		ParentID SpanID
+		Start    time.Time
+		End      time.Time
+		Code     codes.Code
+		Message  string
+
+		tracer   *tracer
+		mu       sync.Mutex
+		attrs    map[string]string
+		attempts int
+		ended    bool
+	}
+
+	// SpanExporter receives the sampled spans once they end, it must not
+	// block.
+	SpanExporter interface {
+		ExportSpan(span *Span)
+	}
+)
+
+const (
+	SpanKindInternal SpanKind = iota
+	SpanKindClient
+	SpanKindServer
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindClient:
+		return "client"
+	case SpanKindServer:
+		return "server"
+	default:
+		return "internal"
+	}
+}
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// String formats sc as a traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func (sc SpanContext) String() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header. Versions above 00 are
+// accepted as long as they start with the fields of version 00.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 ||
+		len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent version in %q", s)
+	}
+	if _, err = hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil ||
+		!sc.TraceID.IsValid() {
+		return sc, fmt.Errorf("invalid trace id in %q", s)
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil ||
+		!sc.SpanID.IsValid() {
+		return sc, fmt.Errorf("invalid parent id in %q", s)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("invalid trace flags in %q", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// WithTracing starts a span for every call, continuing the trace received
+// in the traceparent metadata on servers and the trace of the span in the
+// context on clients. Client spans carry the chosen instance, LB policy and
+// hash key. Sampled spans are passed to exporter once they end, a nil
+// exporter only propagates the trace context.
+func WithTracing(exporter SpanExporter) InterceptorOption {
+	return func(o *interceptorOptions) {
+		o.tracer = &tracer{exporter: exporter}
+	}
+}
+
+type tracer struct {
+	exporter SpanExporter
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span of ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child of the current span of ctx, e.g. around a step
+// of a handler. It returns nil, on which Span methods do nothing, if ctx
+// carries no span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, name, SpanKindInternal, parent.SpanContext)
+}
+
+// start starts a span, parent is the zero SpanContext for a new trace.
+func (t *tracer) start(ctx context.Context, name string, kind SpanKind, parent SpanContext) (context.Context, *Span) {
+	span := &Span{
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if parent.TraceID.IsValid() {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+		span.Sampled = parent.Sampled
+	} else {
+		putRandom(span.TraceID[:])
+		span.Sampled = true
+	}
+	putRandom(span.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func putRandom(b []byte) {
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+	if b[0] == 0 {
+		b[0] = 1
+	}
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+// Attributes returns a copy of the attributes of the span.
+func (s *Span) Attributes() map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := make(map[string]string, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// incAttempts counts the attempts of a client call.
+func (s *Span) incAttempts() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attempts++
+	s.attrs[SpanAttrAttempts] = strconv.Itoa(s.attempts)
+}
+
+// Finish ends the span with the outcome err and exports it, later calls do
+// nothing.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	st := status.Convert(err)
+	s.Code, s.Message = st.Code(), st.Message()
+	s.mu.Unlock()
+	if s.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(s)
+	}
+}
+
+// MemoryExporter keeps the exported spans in memory, for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (e *MemoryExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the exported spans in the order they ended.
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// LogExporter logs the exported spans at debug level.
+type LogExporter struct {
+	logger logx.Logger
+}
+
+// NewLogExporter logs to l, or the minirpc logger of logx if nil.
+func NewLogExporter(l logx.Logger) *LogExporter {
+	if l == nil {
+		l = logger
+	}
+	return &LogExporter{logger: l}
+}
+
+func (e *LogExporter) ExportSpan(span *Span) {
+	fields := []logx.Field{logx.F("trace", span.TraceID.String()),
+		logx.F("span", span.SpanID.String()), logx.F("kind", span.Kind.String()),
+		logx.F("code", span.Code.String()),
+		logx.F("duration", span.End.Sub(span.Start))}
+	if span.ParentID.IsValid() {
+		fields = append(fields, logx.F("parent", span.ParentID.String()))
+	}
+	for k, v := range span.Attributes() {
+		fields = append(fields, logx.F(k, v))
+	}
+	e.logger.Debug(span.Name, fields...)
+}
+
+// startClient starts the span of a client call and sends its context in
+// the outgoing metadata.
+func (t *tracer) startClient(ctx context.Context, serviceName, method string) (context.Context, *Span) {
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.SpanContext
+	}
+	ctx, span := t.start(ctx, method, SpanKindClient, parent)
+	span.SetAttribute(SpanAttrService, serviceName)
+	span.SetAttribute(SpanAttrMethod, method)
+	return withTraceparent(ctx, span.SpanContext), span
+}
+
+// withTraceparent sends sc in the outgoing metadata of ctx.
+func withTraceparent(ctx context.Context, sc SpanContext) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Set(TraceparentKey, sc.String())
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// startServer starts the span of a server call, continuing the trace of
+// the client if any.
+func (t *tracer) startServer(ctx context.Context, method string) (context.Context, *Span) {
+	var parent SpanContext
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(TraceparentKey); len(values) > 0 {
+			// an invalid header starts a new trace
+			parent, _ = ParseTraceparent(values[0])
+		}
+	}
+	ctx, span := t.start(ctx, method, SpanKindServer, parent)
+	span.SetAttribute(SpanAttrMethod, method)
+	if caller := callerOf(ctx); len(caller) > 0 {
+		span.SetAttribute(SpanAttrCaller, caller)
+	}
+	return ctx, span
+}
+
+// tracedServerStream passes the context of the span to stream handlers.
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,133 @@
+package minirpc
+
+import (
+	"context"
+	echo "gamerouter/minirpc/benchmark/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	assert.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, header, sc.String())
+
+	sc, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	assert.Nil(t, err)
+	assert.False(t, sc.Sampled)
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err = ParseTraceparent(header)
+		assert.NotNil(t, err, header)
+	}
+}
+
+func TestServerTracing(t *testing.T) {
+	exporter := NewMemoryExporter()
+	o := &interceptorOptions{}
+	WithTracing(exporter)(o)
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(TraceparentKey, parent, miniRequestCaller, "lobby"))
+
+	_, err := o.unaryServer(ctx, nil, unaryInfo("/player.Player/Get"),
+		func(ctx context.Context, _ any) (any, error) {
+			_, span := StartSpan(ctx, "load")
+			span.SetAttribute("player", "42")
+			span.Finish(nil)
+			return nil, status.Error(codes.NotFound, "no such player")
+		})
+	assert.NotNil(t, err)
+
+	spans := exporter.Spans()
+	assert.Len(t, spans, 2)
+	child, server := spans[0], spans[1]
+	assert.Equal(t, "/player.Player/Get", server.Name)
+	assert.Equal(t, SpanKindServer, server.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", server.ParentID.String())
+	assert.Equal(t, codes.NotFound, server.Code)
+	assert.Equal(t, "lobby", server.Attributes()[SpanAttrCaller])
+	assert.Equal(t, server.TraceID, child.TraceID)
+	assert.Equal(t, server.SpanID, child.ParentID)
+	assert.Equal(t, "42", child.Attributes()["player"])
+
+	// unsampled traces propagate but are not exported
+	exporter.Reset()
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		TraceparentKey, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+	_, err = o.unaryServer(ctx, nil, unaryInfo("/player.Player/Get"), okHandler)
+	assert.Nil(t, err)
+	assert.Empty(t, exporter.Spans())
+
+	// no span to continue
+	_, span := StartSpan(context.Background(), "load")
+	assert.Nil(t, span)
+	span.SetAttribute("player", "42")
+	span.Finish(nil)
+}
+
+func TestClientTracing(t *testing.T) {
+	c := newBufCluster(t, retryInfos(2))
+	var traceparents []string
+	c.setHandler(func(ctx context.Context, addr string) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		traceparents = append(traceparents, md.Get(TraceparentKey)...)
+		if addr == "10.0.0.1:8000" {
+			return status.Error(codes.Unavailable, "down")
+		}
+		return nil
+	})
+	exporter := NewMemoryExporter()
+	cli := c.connect(t, WithInterceptors(WithTracing(exporter)),
+		WithLoadBalancer(WeightRandom), WithHashKeyField(AnyMethod, "msg"),
+		WithRetryPolicy(AnyMethod, testRetryPolicy), WithRetryThrottling(100, 1))
+
+	// the trace of the handler calling the service is continued
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := (&tracer{}).start(context.Background(), "handler",
+		SpanKindServer, parent)
+	for i := 0; i < 100 && (len(exporter.Spans()) == 0 ||
+		exporter.Spans()[0].Attributes()[SpanAttrAttempts] == "1"); i++ {
+		// until a call is retried
+		exporter.Reset()
+		traceparents = nil
+		_, err := cli.Echo(ctx, &echo.EchoRequest{Msg: "player-42"},
+			grpc.WaitForReady(true))
+		assert.Nil(t, err)
+	}
+
+	spans := exporter.Spans()
+	assert.Len(t, spans, 1)
+	span := spans[0]
+	assert.Equal(t, "/echo.EchoServer/Echo", span.Name)
+	assert.Equal(t, SpanKindClient, span.Kind)
+	assert.Equal(t, server.TraceID, span.TraceID)
+	assert.Equal(t, server.SpanID, span.ParentID)
+	assert.Equal(t, codes.OK, span.Code)
+	attrs := span.Attributes()
+	assert.Equal(t, "test", attrs[SpanAttrService])
+	assert.Equal(t, "10.0.0.1:8001", attrs[SpanAttrInstance])
+	assert.Equal(t, WeightRandom, attrs[SpanAttrLbPolicy])
+	assert.Equal(t, "player-42", attrs[SpanAttrHashKey])
+	assert.Equal(t, "2", attrs[SpanAttrAttempts])
+	// every attempt carries the client span
+	assert.Equal(t, []string{span.SpanContext.String(), span.SpanContext.String()},
+		traceparents)
+}
@@ -0,0 +1,164 @@
+package minirpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gamerouter/discover"
+	"math/rand"
+)
+
+const (
+	TrafficSplitRoot = "/trafficsplit"
+	// DefaultSplitKey is the ServerMetadata key used when
+	// TrafficSplit.MetadataKey is empty.
+	DefaultSplitKey = "version"
+
+	keyTrafficSplit = "traffic_split"
+	splitBuckets    = 10000
+)
+
+type (
+	// TrafficSplit sends a percentage of the traffic of a service to the
+	// instances whose ServerMetadata[MetadataKey] equals a group value, the
+	// rest goes to the instances matching no group. Calls with the same hash
+	// key always land in the same group.
+	TrafficSplit struct {
+		MetadataKey string              `json:"metadataKey,omitempty"`
+		Splits      []TrafficSplitGroup `json:"splits"`
+	}
+
+	TrafficSplitGroup struct {
+		Value   string  `json:"value"`
+		Percent float64 `json:"percent"`
+	}
+)
+
+// MakeEtcdTrafficSplitKey returns the etcd key of the split document.
+func MakeEtcdTrafficSplitKey(namespace, servicename string) string {
+	return fmt.Sprintf("%s/%s/%s/split", TrafficSplitRoot, namespace,
+		servicename)
+}
+
+// SetTrafficSplit stores split in etcd, running clients pick it up without
+// redeploying. A nil split removes the current one.
+func SetTrafficSplit(ctx context.Context, endpoints []string, namespace, servicename string, split *TrafficSplit) error {
+	registry, err := discover.OpenRegistry(endpoints)
+	if err != nil {
+		return fmt.Errorf("etcd %v: %w", endpoints, err)
+	}
+	cli := registry.GetConn()
+	key := MakeEtcdTrafficSplitKey(namespace, servicename)
+	if split == nil {
+		_, err := cli.Delete(ctx, key)
+		return err
+	}
+	if err := split.validate(); err != nil {
+		return err
+	}
+	val, err := json.Marshal(split)
+	if err != nil {
+		return err
+	}
+	_, err = cli.Put(ctx, key, string(val))
+	return err
+}
+
+func (s *TrafficSplit) validate() error {
+	total := 0.0
+	for _, g := range s.Splits {
+		if g.Percent < 0 {
+			return fmt.Errorf("negative percent of %s", g.Value)
+		}
+		total += g.Percent
+	}
+	if total > 100 {
+		return fmt.Errorf("traffic split percents sum to %v", total)
+	}
+	return nil
+}
+
+func (s *TrafficSplit) metadataKey() string {
+	if len(s.MetadataKey) > 0 {
+		return s.MetadataKey
+	}
+	return DefaultSplitKey
+}
+
+func decodeTrafficSplit(val string) (*TrafficSplit, error) {
+	split := &TrafficSplit{}
+	if err := json.Unmarshal([]byte(val), split); err != nil {
+		return nil, err
+	}
+	if err := split.validate(); err != nil {
+		return nil, err
+	}
+	return split, nil
+}
+
+// splitPicker routes a bucket of the traffic to each group picker, the last
+// group holds the instances matching none of the split values.
+type splitPicker struct {
+	bounds []int
+	groups []*namingPicker
+}
+
+// applySplit partitions the instances of p into split groups.
+func (p *namingPicker) applySplit(split *TrafficSplit) {
+	if split == nil || len(split.Splits) == 0 {
+		return
+	}
+	p.splitConf = split
+	key := split.metadataKey()
+	sp := &splitPicker{}
+	bound := 0
+	rest := make([]ServerInfo, 0, len(p.serverInfos))
+	grouped := make([][]ServerInfo, len(split.Splits))
+	for _, info := range p.serverInfos {
+		matched := false
+		for i, g := range split.Splits {
+			if val, ok := info.ServerMetadata[key]; ok && val == g.Value {
+				grouped[i] = append(grouped[i], info)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			rest = append(rest, info)
+		}
+	}
+	for i, g := range split.Splits {
+		bound += int(g.Percent * splitBuckets / 100)
+		sp.bounds = append(sp.bounds, bound)
+		sp.groups = append(sp.groups, p.groupPicker(grouped[i]))
+	}
+	sp.bounds = append(sp.bounds, splitBuckets)
+	sp.groups = append(sp.groups, p.groupPicker(rest))
+	p.split = sp
+}
+
+func (p *namingPicker) groupPicker(instances []ServerInfo) *namingPicker {
+	g := newNamingPicker(p.balancer, p.readySCs, p.options, instances)
+	g.selector = p.selector
+	return g
+}
+
+// pick returns the group picker of hashKey, or nil if that group has no
+// ready instance.
+func (s *splitPicker) pick(hashKey string) *namingPicker {
+	var bucket int
+	if len(hashKey) > 0 {
+		bucket = int(hashString(3, hashKey) % splitBuckets)
+	} else {
+		bucket = rand.Intn(splitBuckets)
+	}
+	for i, bound := range s.bounds {
+		if bucket < bound {
+			if len(s.groups[i].serverInfos) == 0 {
+				return nil
+			}
+			return s.groups[i]
+		}
+	}
+	return nil
+}
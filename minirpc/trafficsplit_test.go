@@ -0,0 +1,76 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func splitInstances(canary int) []ServerInfo {
+	infos := make([]ServerInfo, 0, 10)
+	for i := 0; i < 10; i++ {
+		version := "1.4.2"
+		if i < canary {
+			version = "1.5.0"
+		}
+		infos = append(infos, ServerInfo{Host: "10.0.0.1", Port: 8000 + i,
+			Weight: 1, ServerMetadata: map[string]string{"version": version}})
+	}
+	return infos
+}
+
+func TestTrafficSplit(t *testing.T) {
+	infos := splitInstances(2)
+	p := newTestPicker(t, infos, WithLoadBalancer(Rendezvous))
+	p.applySplit(&TrafficSplit{Splits: []TrafficSplitGroup{
+		{Value: "1.5.0", Percent: 5},
+	}})
+	canary := map[string]bool{"10.0.0.1:8000": true, "10.0.0.1:8001": true}
+
+	hits := 0
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		ctx := RequestScopeHashKey(context.Background(), fmt.Sprintf("player-%d", i))
+		addr := pickAddr(t, p, ctx)
+		if canary[addr] {
+			hits++
+		}
+		// sticky by hash key
+		assert.Equal(t, addr, pickAddr(t, p, ctx))
+	}
+	assert.InDelta(t, 0.05, float64(hits)/keys, 0.01)
+}
+
+func TestTrafficSplitEmptyGroup(t *testing.T) {
+	// no canary instance, everything goes to the stable ones
+	p := newTestPicker(t, splitInstances(0))
+	p.applySplit(&TrafficSplit{Splits: []TrafficSplitGroup{
+		{Value: "1.5.0", Percent: 50},
+	}})
+	for i := 0; i < 100; i++ {
+		ctx := RequestScopeHashKey(context.Background(), fmt.Sprintf("%d", i))
+		assert.NotEqual(t, "", pickAddr(t, p, ctx))
+	}
+}
+
+func TestDecodeTrafficSplit(t *testing.T) {
+	split, err := decodeTrafficSplit(`{"metadataKey":"build","splits":[{"value":"2","percent":10}]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "build", split.metadataKey())
+	assert.Equal(t, 10.0, split.Splits[0].Percent)
+
+	_, err = decodeTrafficSplit(`{"splits":[{"value":"2","percent":60},{"value":"3","percent":60}]}`)
+	assert.NotNil(t, err)
+	_, err = decodeTrafficSplit(`{"splits":`)
+	assert.NotNil(t, err)
+}
+
+func TestSetTrafficSplitUnreachable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the etcd dial timeout")
+	}
+	err := SetTrafficSplit(context.Background(), []string{"127.0.0.1:1"},
+		DefaultNamespace, "test", nil)
+	assert.NotNil(t, err)
+}
@@ -1,7 +1,23 @@
 package minirpc
 
+import (
+	"gamerouter/logx"
+	"time"
+)
+
+const hotLogInterval = 10 * time.Second
+
+var (
+	logger = logx.Named("minirpc")
+	// for the paths which may log on every call or update
+	hotLogger = logx.RateLimited(logger, hotLogInterval)
+)
+
 var (
 	NodeWeight       = "weight"
 	DefaultNamespace = "default"
 	InstanceMetadata = "insmeta"
+	// DrainingMetadata is the ServerMetadata key of the instances which
+	// take no new calls, the resolvers skip them.
+	DrainingMetadata = "draining"
 )
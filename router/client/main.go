@@ -2,9 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"gamerouter/discover"
+	"gamerouter/logx"
 	"gamerouter/minirpc"
 	router "gamerouter/router/proto"
 	"google.golang.org/grpc"
@@ -55,13 +54,14 @@ func main() {
 			InstanceID:     p,
 			Weight:         1,
 			Host:           "0.0.0.1",
-			Port:           0,
+			Port:           8000,
 			ServerMetadata: nil,
 		}
-		val, _ := json.Marshal(info)
+		val, _ := minirpc.EncodeServerInfo(info, minirpc.RecordJSON)
 		if _, err := discover.GetRegistry(endpoints).GetConn().Put(context.Background(),
 			instanceKey, string(val)); err != nil {
-			fmt.Println(err.Error())
+			logx.Default().Warn("failed to put instance",
+				logx.Instance(p), logx.Err(err))
 		}
 
 		_, err = routercli.SetRouteRule(context.Background(),
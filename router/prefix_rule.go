@@ -2,11 +2,14 @@ package route
 
 import (
 	"gamerouter/discover"
+	"gamerouter/logx"
 	"sync"
 )
 
 var (
 	RouteRulePrefix = "/rule"
+
+	logger = logx.Named("router")
 )
 
 type RuleTable struct {
@@ -74,3 +77,20 @@ func (r *RuleTable) removeRule(namespace, serviceName, prefix string) {
 	}
 	tree.Delete(prefix)
 }
+
+// Rules returns the prefix rules by "namespace/service", each mapping a
+// prefix to an instance ID.
+func (r *RuleTable) Rules() map[string]map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make(map[string]map[string]string, len(r.serviceToPrefix))
+	for key, tree := range r.serviceToPrefix {
+		rules := make(map[string]string, tree.Len())
+		tree.Walk(func(prefix string, instanceID interface{}) bool {
+			rules[prefix] = instanceID.(string)
+			return false
+		})
+		res[key] = rules
+	}
+	return res
+}
@@ -1,10 +1,9 @@
 package route
 
 import (
-	"encoding/json"
 	"gamerouter/discover"
+	"gamerouter/logx"
 	"gamerouter/minirpc"
-	"log"
 	"strings"
 	"sync"
 )
@@ -30,9 +29,10 @@ func extractEtcdKey(key string) (namespace, serviceName, instanceID string) {
 func (r *RouteTable) OnAdd(kv discover.KV) {
 	namespace, serviceName, instanceID := extractEtcdKey(kv.Key)
 	key := getInstanceKey(namespace, serviceName, instanceID)
-	var info minirpc.ServerInfo
-	if err := json.Unmarshal([]byte(kv.Val), &info); err != nil {
-		log.Printf("Failed to unmarshal service info: %v", err)
+	info, err := minirpc.DecodeServerInfo([]byte(kv.Val))
+	if err != nil {
+		logger.Warn("route table ignores invalid server info",
+			logx.F("key", kv.Key), logx.Err(err))
 		return
 	}
 	r.table.Store(key, info)
@@ -5,19 +5,21 @@ import (
 	"flag"
 	"fmt"
 	"gamerouter/discover"
+	"gamerouter/logx"
 	"gamerouter/minirpc"
 	route "gamerouter/router"
 	router "gamerouter/router/proto"
 	"google.golang.org/grpc"
 	"log"
-	"net"
 	"strconv"
 )
 
 var (
 	RouterServiceName = "MiniRouter"
-	endpoints         = []string{"127.0.0.1:2379"}
-	address           = flag.String("addr", "localhost:50051", "listen addr")
+	confFile          = flag.String("f", "", "YAML, TOML or JSON conf file, see minirpc.LoadConf")
+	address           = flag.String("addr", "localhost:50051", "listen addr, unless set by the conf")
+	logLevel          = flag.String("log-level", "info", "debug, info, warn or error")
+	adminAddr         = flag.String("admin", "", "admin HTTP listen addr, disabled if empty")
 )
 
 type RouterService struct {
@@ -39,11 +41,18 @@ func NewRouterService(endpoints []string) *RouterService {
 }
 
 func (r *RouterService) GetOneInstanceWithPrefix(ctx context.Context, request *router.GetEndpointWithPrefixRequest) (*router.GetOneInstanceResponse, error) {
+	_, span := minirpc.StartSpan(ctx, "route.GetInstanceID")
+	span.SetAttribute(minirpc.SpanAttrService, request.ServiceName)
+	span.SetAttribute("route.key", request.Key)
 	instanceID, ok := r.prefixRuleTable.GetInstanceID(request.Namespace,
 		request.ServiceName, request.Key)
 	if !ok {
-		return nil, fmt.Errorf("no instance found")
+		err := fmt.Errorf("no instance found")
+		span.Finish(err)
+		return nil, err
 	}
+	span.SetAttribute(minirpc.SpanAttrInstance, instanceID)
+	span.Finish(nil)
 	info, ok := r.routeTable.GetServerInfo(request.Namespace,
 		request.ServiceName, instanceID)
 	if !ok {
@@ -98,18 +107,39 @@ func (r *RouterService) mustEmbedUnimplementedRouterServer() {
 
 func main() {
 	flag.Parse()
-	listen, err := net.Listen("tcp", *address)
+	level, err := logx.ParseLevel(*logLevel)
 	if err != nil {
-		log.Fatalf("failed to addr %s: %v", *address, err)
+		log.Fatal(err)
 	}
-	fmt.Printf("router is listening %s\n", listen.Addr().String())
+	logx.SetLevel(level)
 
-	srv := grpc.NewServer()
-	router.RegisterRouterServer(srv, NewRouterService(endpoints))
-	if err = minirpc.Serve(srv, listen,
-		minirpc.WithServerNamespace(minirpc.DefaultNamespace),
-		minirpc.WithServiceName(RouterServiceName),
-		minirpc.WithEtcdEndPoints(endpoints)); err != nil {
-		log.Printf("lisen err: %v", err)
+	conf := minirpc.ServerConf{
+		Etcd:       discover.EtcdConf{Hosts: []string{"127.0.0.1:2379"}},
+		ServerName: RouterServiceName,
+		ListenOn:   *address,
+		// spans continue the traces of the callers, see minirpc.WithTracing
+		Interceptors: minirpc.InterceptorConf{Tracing: true},
+	}
+	var files []string
+	if len(*confFile) > 0 {
+		files = append(files, *confFile)
+	}
+	if err = minirpc.LoadConf(&conf, files...); err != nil {
+		log.Fatal(err)
+	}
+
+	service := NewRouterService(conf.Etcd.Hosts)
+	if len(*adminAddr) > 0 {
+		minirpc.HandleAdmin("rules", "router prefix rules by namespace/service",
+			func() any { return service.prefixRuleTable.Rules() })
+		if _, err = minirpc.ServeAdmin(*adminAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	logx.Default().Info("router is listening", logx.F("addr", conf.ListenOn))
+	if err = minirpc.ServeFromConf(conf, func(srv *grpc.Server) {
+		router.RegisterRouterServer(srv, service)
+	}); err != nil {
+		logx.Default().Error("router stopped serving", logx.Err(err))
 	}
 }